@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Announcements can be lost, so every ReconcileInterval we pick a peer and
+// compare Merkle trees with it: one over the concepts it owns and one over
+// the relationships we both hold. The peer answers every range whose hash
+// differs from ours with the hashes of its subranges, or with the items
+// themselves once the range is small, so only the ranges that differ are
+// transferred. Messages carry a page of ranges at most, the ones that do
+// not fit are asked for in the following rounds. Reconciliation pulls: the
+// peer learns what we have when it reconciles with us.
+//
+// Relationships are compared by the digest of their state rather than by
+// CID, as the block a relationship is stored in links the current versions
+// of its concepts, which only their owner knows.
+
+type MerkleSet string
+
+const (
+	MerkleConcepts      MerkleSet = "concepts"
+	MerkleRelationships MerkleSet = "relationships"
+)
+
+// MerkleRange is a range of one of the trees. In a request it carries the
+// hash the requester has, in a response either the hashes of the subranges
+// or, if Leaf is set, every item in the range. Items are the CIDs of the
+// concepts, or the relationships with the CIDs to fetch them from, whose
+// state digests are in Digests.
+type MerkleRange struct {
+	Set      MerkleSet         `json:"set"`
+	Prefix   string            `json:"prefix"`
+	Hash     string            `json:"hash,omitempty"`
+	Children map[string]string `json:"children,omitempty"`
+	Leaf     bool              `json:"leaf,omitempty"`
+	Items    map[string]CID    `json:"items,omitempty"`
+	Digests  map[string]string `json:"digests,omitempty"`
+}
+
+// ReconcileRequest asks a peer to compare the given ranges with its own
+type ReconcileRequest struct {
+	To      PeerID        `json:"to"`
+	Session string        `json:"session"`
+	Ranges  []MerkleRange `json:"ranges"`
+}
+
+// ReconcileResponse holds the ranges of a request that differ. It is empty
+// once both sides agree. Unanswered counts the ranges at the end of the
+// request that did not fit in the response, the requester asks for them
+// again.
+type ReconcileResponse struct {
+	To         PeerID        `json:"to"`
+	Session    string        `json:"session"`
+	Ranges     []MerkleRange `json:"ranges,omitempty"`
+	Unanswered int           `json:"unanswered,omitempty"`
+}
+
+// Reconciliation reports the last reconciliation with a peer
+type Reconciliation struct {
+	Peer        PeerID     `json:"peer"`
+	StartedAt   time.Time  `json:"startedAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	// Rounds counts the requests sent and Ranges the ranges that differed
+	// down to their items
+	Rounds          int  `json:"rounds"`
+	Ranges          int  `json:"ranges"`
+	ConceptsAdded   int  `json:"conceptsAdded"`
+	ConceptsRemoved int  `json:"conceptsRemoved"`
+	Relationships   int  `json:"relationships"`
+	InSync          bool `json:"inSync"`
+
+	session string
+	// asked are the ranges of the request waiting for a response and
+	// pending the ones left for the following requests
+	asked   []MerkleRange
+	pending []MerkleRange
+}
+
+var (
+	reconciliations   = make(map[PeerID]*Reconciliation)
+	reconciliationsMu sync.Mutex
+)
+
+// ownMerkleTrees builds the trees the peers reconciling with us compare
+// their view of our state with
+func ownMerkleTrees() map[MerkleSet]*merkleTree {
+	conceptMu.RLock()
+	concepts := make(map[string]string, len(GUID2CID))
+	for _, cid := range GUID2CID {
+		concepts[string(cid)] = ""
+	}
+	conceptMu.RUnlock()
+
+	return map[MerkleSet]*merkleTree{
+		MerkleConcepts:      newMerkleTree(concepts),
+		MerkleRelationships: relationshipTree(),
+	}
+}
+
+// peerMerkleTrees builds the trees of what we know of a peer
+func peerMerkleTrees(id PeerID) map[MerkleSet]*merkleTree {
+	peerSyncMu.Lock()
+	st := syncState(id)
+	concepts := make(map[string]string, len(st.concepts))
+	for cid := range st.concepts {
+		concepts[string(cid)] = ""
+	}
+	peerSyncMu.Unlock()
+
+	return map[MerkleSet]*merkleTree{
+		MerkleConcepts:      newMerkleTree(concepts),
+		MerkleRelationships: relationshipTree(),
+	}
+}
+
+// relationshipTree hashes the state digest of every stored relationship
+func relationshipTree() *merkleTree {
+	relationshipMu.RLock()
+	defer relationshipMu.RUnlock()
+	items := make(map[string]string, len(relationshipMap))
+	for id, r := range relationshipMap {
+		if _, ok := relationship2CID[id]; ok {
+			items[string(id)] = r.digest()
+		}
+	}
+	return newMerkleTree(items)
+}
+
+// leafRange sends every item of a range of one of our trees
+func leafRange(set MerkleSet, prefix string, tree *merkleTree) MerkleRange {
+	r := MerkleRange{Set: set, Prefix: prefix, Leaf: true, Items: make(map[string]CID)}
+	items := tree.itemsIn(prefix)
+	if set != MerkleRelationships {
+		for key := range items {
+			r.Items[key] = ""
+		}
+		return r
+	}
+	r.Digests = items
+	for id := range items {
+		if cid, ok := relationshipCID(GUID(id)); ok {
+			r.Items[id] = cid
+		}
+	}
+	return r
+}
+
+// rangeSize is how many bytes a range takes in a message
+func rangeSize(r MerkleRange) int {
+	data, _ := json.Marshal(r)
+	return len(data) + 1
+}
+
+// rangePage splits off the ranges that fit in size bytes. The first range
+// is always taken, so that one larger than a page still gets through.
+func rangePage(ranges []MerkleRange, size int) (page, rest []MerkleRange) {
+	used := 0
+	for i, r := range ranges {
+		used += rangeSize(r)
+		if used > size && i > 0 {
+			return ranges[:i:i], ranges[i:]
+		}
+	}
+	return ranges, nil
+}
+
+// reconcileWithNextPeer starts a reconciliation with the peer we reconciled
+// with the longest ago
+func reconcileWithNextPeer(ctx context.Context) {
+	peerMapMu.RLock()
+	var candidates []PeerID
+	for id, p := range peerMap {
+		if id != peerID && p.GetOwnerGUID() != "" {
+			candidates = append(candidates, id)
+		}
+	}
+	peerMapMu.RUnlock()
+	if len(candidates) == 0 {
+		return
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+
+	reconciliationsMu.Lock()
+	next := candidates[0]
+	for _, id := range candidates {
+		last, ok := reconciliations[id]
+		if !ok {
+			next = id
+			break
+		}
+		if last.StartedAt.Before(reconciliations[next].StartedAt) {
+			next = id
+		}
+	}
+	reconciliationsMu.Unlock()
+
+	reconcileWith(ctx, next)
+}
+
+func reconcileWith(ctx context.Context, id PeerID) {
+	session := uuid.New().String()
+	trees := peerMerkleTrees(id)
+	req := ReconcileRequest{To: id, Session: session}
+	for _, set := range []MerkleSet{MerkleConcepts, MerkleRelationships} {
+		req.Ranges = append(req.Ranges, MerkleRange{Set: set, Hash: trees[set].hash("")})
+	}
+
+	reconciliationsMu.Lock()
+	reconciliations[id] = &Reconciliation{Peer: id, StartedAt: time.Now(), Rounds: 1, session: session, asked: req.Ranges}
+	reconciliationsMu.Unlock()
+
+	if err := publishMessage(ctx, MessageReconcileRequest, req); err != nil {
+		log.Printf("Failed to start reconciliation with peer %s: %v", id, err)
+	}
+}
+
+// answerReconcileRequest compares the ranges a peer sent with ours. The
+// ranges that do not fit in a page are left unanswered.
+func answerReconcileRequest(ctx context.Context, from PeerID, req ReconcileRequest) {
+	if req.To != peerID {
+		return
+	}
+	trees := ownMerkleTrees()
+	resp := ReconcileResponse{To: from, Session: req.Session}
+	size := 0
+	for i, r := range req.Ranges {
+		tree, ok := trees[r.Set]
+		if !ok || len(r.Prefix) > merkleDepth {
+			continue
+		}
+		if tree.hash(r.Prefix) == r.Hash {
+			continue
+		}
+		var answer MerkleRange
+		if tree.splits(r.Prefix) {
+			answer = MerkleRange{Set: r.Set, Prefix: r.Prefix, Hash: tree.hash(r.Prefix), Children: tree.children(r.Prefix)}
+		} else {
+			answer = leafRange(r.Set, r.Prefix, tree)
+		}
+		size += rangeSize(answer)
+		if size > syncPageSize() && len(resp.Ranges) > 0 {
+			resp.Unanswered = len(req.Ranges) - i
+			break
+		}
+		resp.Ranges = append(resp.Ranges, answer)
+	}
+	if err := publishMessage(ctx, MessageReconcileResponse, resp); err != nil {
+		log.Printf("Failed to answer reconciliation of peer %s: %v", from, err)
+	}
+}
+
+// handleReconcileResponse takes in the items of the ranges that differ and
+// asks for the subranges that differ, along with the ranges left unanswered,
+// a page at a time
+func handleReconcileResponse(ctx context.Context, from PeerID, resp ReconcileResponse) {
+	if resp.To != peerID {
+		return
+	}
+	reconciliationsMu.Lock()
+	rec, ok := reconciliations[from]
+	current := ok && rec.session == resp.Session && rec.CompletedAt == nil
+	reconciliationsMu.Unlock()
+	if !current {
+		return
+	}
+
+	trees := peerMerkleTrees(from)
+	var next []MerkleRange
+	var conceptRanges []MerkleRange
+	relationships := make(map[GUID]CID)
+	leaves := 0
+	for _, r := range resp.Ranges {
+		tree, ok := trees[r.Set]
+		if !ok {
+			continue
+		}
+		if r.Leaf {
+			leaves++
+			if r.Set == MerkleConcepts {
+				conceptRanges = append(conceptRanges, r)
+				continue
+			}
+			for id, cid := range r.Items {
+				if tree.items[id] != r.Digests[id] {
+					relationships[GUID(id)] = cid
+				}
+			}
+			continue
+		}
+		if len(r.Prefix) >= merkleDepth {
+			continue
+		}
+		ours := tree.children(r.Prefix)
+		for _, digit := range hexDigits {
+			child := r.Prefix + string(digit)
+			if ours[child] != r.Children[child] {
+				next = append(next, MerkleRange{Set: r.Set, Prefix: child, Hash: ours[child]})
+			}
+		}
+	}
+
+	added, removed := applyConceptRanges(from, conceptRanges)
+	replicator.AnnounceRelationships(from, relationships)
+
+	reconciliationsMu.Lock()
+	rec.Ranges += leaves
+	rec.ConceptsAdded += added
+	rec.ConceptsRemoved += removed
+	rec.Relationships += len(relationships)
+	if len(resp.Ranges) == 0 && resp.Unanswered == 0 && rec.Rounds == 1 {
+		rec.InSync = true
+	}
+	queue := rec.pending
+	if n := resp.Unanswered; n > 0 && n <= len(rec.asked) {
+		queue = append(slices.Clone(rec.asked[len(rec.asked)-n:]), queue...)
+	}
+	queue = append(queue, next...)
+	done := len(queue) == 0
+	if done {
+		now := time.Now()
+		rec.CompletedAt = &now
+		rec.asked, rec.pending = nil, nil
+	} else {
+		rec.Rounds++
+		rec.asked, rec.pending = rangePage(queue, syncPageSize())
+	}
+	asked := rec.asked
+	summary := *rec
+	reconciliationsMu.Unlock()
+
+	if done {
+		if !summary.InSync {
+			log.Printf("Reconciled with peer %s in %d rounds: %d concepts added, %d removed, %d relationships",
+				from, summary.Rounds, summary.ConceptsAdded, summary.ConceptsRemoved, summary.Relationships)
+		}
+		return
+	}
+	req := ReconcileRequest{To: from, Session: resp.Session, Ranges: asked}
+	if err := publishMessage(ctx, MessageReconcileRequest, req); err != nil {
+		log.Printf("Failed to continue reconciliation with peer %s: %v", from, err)
+	}
+}
+
+// applyConceptRanges replaces what we know of the concepts of a peer in the
+// given ranges with what it sent, and replicates the result
+func applyConceptRanges(from PeerID, ranges []MerkleRange) (added, removed int) {
+	if len(ranges) == 0 {
+		return 0, 0
+	}
+	peerSyncMu.Lock()
+	st := syncState(from)
+	for _, r := range ranges {
+		for cid := range st.concepts {
+			if _, ok := r.Items[string(cid)]; !ok && strings.HasPrefix(merklePath(string(cid)), r.Prefix) {
+				delete(st.concepts, cid)
+				removed++
+			}
+		}
+		for cid := range r.Items {
+			if !st.concepts[CID(cid)] {
+				st.concepts[CID(cid)] = true
+				added++
+			}
+		}
+	}
+	cids := sortedKeys(st.concepts)
+	peerSyncMu.Unlock()
+
+	if added > 0 || removed > 0 {
+		updatePeerCIDs(from, cids)
+	}
+	return added, removed
+}
+
+func getReconciliations(c *gin.Context) {
+	reconciliationsMu.Lock()
+	list := make([]Reconciliation, 0, len(reconciliations))
+	for _, rec := range reconciliations {
+		list = append(list, *rec)
+	}
+	reconciliationsMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Peer < list[j].Peer })
+	c.JSON(http.StatusOK, list)
+}
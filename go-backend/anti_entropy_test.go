@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReconcileInPages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	local := resetState(t)
+	remote := NewMemoryNode(local.hub)
+	config.MaxMessageSize = 8192
+	config.RateLimit = 0
+	config.ReplicationWorkers = 0
+
+	// Both nodes run in this process: GUID2CID is what the remote owns and
+	// its sync state what we know of it, a few concepts it has and a few
+	// it dropped
+	want := make(map[CID]bool)
+	for i := 0; i < 2000; i++ {
+		cid := CID(fmt.Sprintf("concept-%d", i))
+		GUID2CID[GUID(fmt.Sprint(i))] = cid
+		want[cid] = true
+	}
+	known := syncState(remote.id).concepts
+	for i := 0; i < 100; i++ {
+		known[CID(fmt.Sprintf("concept-%d", i))] = true
+		known[CID(fmt.Sprintf("dropped-%d", i))] = true
+	}
+
+	msgs, err := local.Subscribe(ctx, config.PubsubTopic)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	// deliver hands a message to the node that did not send it
+	deliver := func(msg PubSubMessage) {
+		t.Helper()
+		n := local
+		if msg.From == local.id {
+			n = remote
+		}
+		node, peerID = n, n.id
+		defer func() { node, peerID = local, local.id }()
+		if err := router.Route(ctx, msg); err != nil {
+			t.Fatalf("Route: %v", err)
+		}
+	}
+
+	reconcileWith(ctx, remote.id)
+	responses, split := 0, 0
+	for done := false; !done; {
+		select {
+		case msg := <-msgs:
+			if len(msg.Data) > config.MaxMessageSize {
+				t.Errorf("message of %d bytes is over the limit of %d", len(msg.Data), config.MaxMessageSize)
+			}
+			if env := decodeEnvelope(t, msg); env.Type == MessageReconcileResponse {
+				var resp ReconcileResponse
+				if err := json.Unmarshal(env.Body, &resp); err != nil {
+					t.Fatalf("Unmarshal: %v", err)
+				}
+				responses++
+				if resp.Unanswered > 0 {
+					split++
+				}
+			}
+			deliver(msg)
+		case <-time.After(100 * time.Millisecond):
+			done = true
+		}
+	}
+
+	rec := reconciliations[remote.id]
+	if rec.CompletedAt == nil {
+		t.Fatalf("reconciliation did not complete after %d rounds", rec.Rounds)
+	}
+	if rec.Rounds != responses {
+		t.Errorf("%d rounds got %d responses", rec.Rounds, responses)
+	}
+	if split == 0 {
+		t.Error("no response was split across rounds")
+	}
+	if rec.ConceptsAdded != 1900 || rec.ConceptsRemoved != 100 || rec.InSync {
+		t.Errorf("got %d concepts added and %d removed, in sync: %v, want 1900 and 100", rec.ConceptsAdded, rec.ConceptsRemoved, rec.InSync)
+	}
+	if got := syncState(remote.id).concepts; len(got) != len(want) {
+		t.Errorf("we know %d concepts of the peer, want %d", len(got), len(want))
+	} else {
+		for cid := range want {
+			if !got[cid] {
+				t.Errorf("concept %s of the peer is missing", cid)
+			}
+		}
+	}
+
+	// A second reconciliation finds nothing to do
+	reconcileWith(ctx, remote.id)
+	for i := 0; i < 2; i++ {
+		deliver(<-msgs)
+	}
+	if rec := reconciliations[remote.id]; !rec.InSync || rec.CompletedAt == nil || rec.Rounds != 1 {
+		t.Errorf("second reconciliation is %+v, want in sync after one round", rec)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"time"
 
@@ -42,17 +43,35 @@ type Network_i interface {
 	// List returns a list of all CIDs stored by this node
 	List(ctx context.Context) ([]CID, error)
 
-	// Load loads data from a given path in the network
+	// PutBlock stores a single IPLD block encoded with codec and returns its
+	// CID. Pinning only pins the block itself, not the blocks it links to.
+	PutBlock(ctx context.Context, codec uint64, data []byte, pin bool) (CID, error)
+
+	// GetBlock retrieves the raw bytes of a single block
+	GetBlock(ctx context.Context, cid CID) ([]byte, error)
+
+	// Load loads data from a given path in the network. The error wraps
+	// errNotFound if nothing was saved at the path.
 	Load(ctx context.Context, path string, target interface{}) error
 
 	// Save saves data to a given path in the network
 	Save(ctx context.Context, path string, data interface{}) error
 
+	// Delete removes the file at a given path. A path nothing was saved at
+	// is not an error.
+	Delete(ctx context.Context, path string) error
+
+	// PublishName points the name of this node, its IPNS name on IPFS, at cid
+	PublishName(ctx context.Context, cid CID) error
+
+	// ResolveName returns the CID the name of a peer currently points at
+	ResolveName(ctx context.Context, peerID PeerID) (CID, error)
+
 	// Publish publishes a message to a topic
 	Publish(ctx context.Context, topic string, data []byte) error
 
 	// Subscribe subscribes to a topic and returns a channel for receiving messages
-	Subscribe(ctx context.Context, topic string) (<-chan []byte, error)
+	Subscribe(ctx context.Context, topic string) (<-chan PubSubMessage, error)
 
 	// Connect connects to a peer
 	Connect(ctx context.Context, peerID PeerID) error
@@ -61,6 +80,9 @@ type Network_i interface {
 	ListPeers(ctx context.Context) ([]Peer_i, error)
 }
 
+// errNotFound is wrapped by Load when nothing was saved at a path
+var errNotFound = errors.New("file does not exist")
+
 // Node_i represents a node in the network
 type Node_i interface {
 	Network_i
@@ -70,6 +92,17 @@ type Node_i interface {
 
 	// ID returns the ID of this node
 	ID(ctx context.Context) (PeerID, error)
+
+	// Sign signs data with the key behind the ID of this node and returns
+	// the signature along with the marshalled public key
+	Sign(ctx context.Context, data []byte) (signature, publicKey []byte, err error)
+}
+
+// PubSubMessage is a message received on a topic
+type PubSubMessage struct {
+	// From is the peer that published the message
+	From PeerID
+	Data []byte
 }
 
 // Now let's define some concrete implementations of these interfaces
@@ -83,6 +116,12 @@ type Concept struct {
 	Type          string
 	Relationships []GUID // IDs of relationships this concept is involved in
 	Timestamp     time.Time
+	Content       *ConceptContent `json:",omitempty"` // optional payload stored as its own object
+	Previous      CID             `json:",omitempty"` // CID of the version this one replaced
+
+	// links holds the CIDs of the relationships and concepts the stored node
+	// links to
+	links []CID
 }
 
 func (c Concept) GetCID() CID             { return c.CID }
@@ -106,6 +145,8 @@ type Relationship struct {
 	Interactions    int
 	LastInteraction time.Time
 	Timestamp       time.Time
+	// State is what peers merge, the fields above are derived from it
+	State RelationshipState `json:"-"`
 }
 
 // RelationshipMap stores all relationships
@@ -113,7 +154,7 @@ type RelationshipMap map[GUID]*Relationship
 
 // Function to create a new relationship
 func CreateRelationship(sourceID, targetID GUID, relationType GUID) *Relationship {
-	return &Relationship{
+	r := &Relationship{
 		ID:            GUID(uuid.New().String()),
 		SourceID:      sourceID,
 		TargetID:      targetID,
@@ -126,15 +167,19 @@ func CreateRelationship(sourceID, targetID GUID, relationType GUID) *Relationshi
 		Interactions:  0,
 		Timestamp:     time.Now(),
 	}
+	r.ensureState()
+	return r
 }
 
 // Function to update a relationship
 func (r *Relationship) Deepen() {
-	r.EnergyFlow *= 1.1
-	r.Amplitude *= 1.05
-	r.Volume *= 1.05
-	r.FrequencySpec = append(r.FrequencySpec, float64(len(r.FrequencySpec)+1))
+	r.ensureState()
+	r.State.EnergyFlow.set(r.EnergyFlow * 1.1)
+	r.State.Amplitude.set(r.Amplitude * 1.05)
+	r.State.Volume.set(r.Volume * 1.05)
+	r.addFrequency(float64(len(r.FrequencySpec) + 1))
 	r.Timestamp = time.Now()
+	r.apply()
 }
 
 // ConcretePeer implements the Peer_i interface
@@ -143,6 +188,12 @@ type Peer struct {
 	OwnerGUID GUID
 	CIDs      map[CID]bool
 	Timestamp time.Time
+	// LastSeen is when the peer last sent us a message and Messages how many
+	// it sent, see peer_handlers.go
+	LastSeen time.Time
+	Messages int
+	// OwnerKey is the key of the owner for direct messages
+	OwnerKey []byte
 }
 
 func (p Peer) GetID() PeerID      { return p.ID }
@@ -164,11 +215,17 @@ func (p *Peer) MarshalJSON() ([]byte, error) {
 		OwnerGUID GUID
 		CIDs      []CID
 		Timestamp time.Time
+		LastSeen  time.Time
+		Messages  int
+		OwnerKey  []byte `json:",omitempty"`
 	}{
 		ID:        p.ID,
 		OwnerGUID: p.OwnerGUID,
 		CIDs:      p.GetCIDs(),
 		Timestamp: p.Timestamp,
+		LastSeen:  p.LastSeen,
+		Messages:  p.Messages,
+		OwnerKey:  p.OwnerKey,
 	})
 }
 
@@ -178,6 +235,9 @@ func (p *Peer) UnmarshalJSON(data []byte) error {
 		OwnerGUID GUID      `json:"ownerGuid"`
 		CIDs      []CID     `json:"cids"`
 		Timestamp time.Time `json:"timestamp"`
+		LastSeen  time.Time `json:"lastSeen"`
+		Messages  int       `json:"messages"`
+		OwnerKey  []byte    `json:"ownerKey"`
 	}
 
 	if err := json.Unmarshal(data, &temp); err != nil {
@@ -187,6 +247,9 @@ func (p *Peer) UnmarshalJSON(data []byte) error {
 	p.ID = temp.ID
 	p.OwnerGUID = temp.OwnerGUID
 	p.Timestamp = temp.Timestamp
+	p.LastSeen = temp.LastSeen
+	p.Messages = temp.Messages
+	p.OwnerKey = temp.OwnerKey
 	p.CIDs = make(map[CID]bool)
 
 	for _, cid := range temp.CIDs {
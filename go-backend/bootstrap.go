@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"os"
 	"time"
 )
 
@@ -24,22 +27,22 @@ func createCoreRelationship(ctx context.Context, sourceGUID, relationshipTypeGUI
 		LastInteraction: time.Now(),
 		Timestamp:       time.Now(),
 	}
+	relationship.ensureState()
 
+	relationshipMu.Lock()
 	relationshipMap[relationshipID] = relationship
+	relationshipMu.Unlock()
+	if _, err := saveRelationship(ctx, relationshipID); err != nil {
+		return err
+	}
 
 	// Update the relationships for the source and target concepts
-	sourceConcept, exists := conceptMap[sourceGUID]
-	if !exists {
-		return fmt.Errorf("source concept with GUID %s not found", sourceGUID)
+	if err := appendRelationship(ctx, sourceGUID, relationshipID); err != nil {
+		return fmt.Errorf("source: %v", err)
 	}
-	sourceConcept.Relationships = append(sourceConcept.Relationships, relationshipID)
-
-	targetConcept, exists := conceptMap[targetGUID]
-	if !exists {
-		return fmt.Errorf("target concept with GUID %s not found", targetGUID)
+	if err := appendRelationship(ctx, targetGUID, relationshipID); err != nil {
+		return fmt.Errorf("target: %v", err)
 	}
-	targetConcept.Relationships = append(targetConcept.Relationships, relationshipID)
-
 	return nil
 }
 
@@ -54,9 +57,19 @@ func InitializeSystem(ctx context.Context) error {
 			return err
 		}
 	*/
+	if config.ConceptsFile == "" {
+		log.Println("No concepts file configured, skipping bootstrap")
+		return nil
+	}
+
+	if _, err := os.Stat(config.ConceptsFile); errors.Is(err, fs.ErrNotExist) && config.ConceptsFile == defaultConfig().ConceptsFile {
+		log.Printf("Default concepts file %s not found, skipping bootstrap", config.ConceptsFile)
+		return nil
+	}
+
 	log.Println("Bootstrapping concepts and relationships...")
 
-	if err := BootstrapFromStructure(ctx, "data/concepts_structure.yaml"); err != nil {
+	if err := BootstrapFromStructure(ctx, config.ConceptsFile); err != nil {
 		log.Printf("Error during bootstrapping concepts: %v\n", err)
 		return err
 	}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	gocid "github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// A CARv1 archive is a varint-prefixed DAG-CBOR header naming the root CIDs,
+// followed by varint-prefixed sections of CID bytes and block data.
+
+// carMaxSection bounds a single section so a corrupt length cannot make the
+// reader allocate arbitrary amounts of memory
+const carMaxSection = 64 << 20
+
+type carWriter struct {
+	w *bufio.Writer
+}
+
+func newCARWriter(w io.Writer, roots []gocid.Cid) (*carWriter, error) {
+	header, err := qp.BuildMap(basicnode.Prototype.Map, 2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "roots", qp.List(int64(len(roots)), func(la datamodel.ListAssembler) {
+			for _, root := range roots {
+				qp.ListEntry(la, qp.Link(cidlink.Link{Cid: root}))
+			}
+		}))
+		qp.MapEntry(ma, "version", qp.Int(1))
+	})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := dagcbor.Encode(header, &buf); err != nil {
+		return nil, fmt.Errorf("failed to encode CAR header: %v", err)
+	}
+
+	cw := &carWriter{w: bufio.NewWriter(w)}
+	if err := cw.section(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *carWriter) section(parts ...[]byte) error {
+	var size uint64
+	for _, p := range parts {
+		size += uint64(len(p))
+	}
+	if _, err := cw.w.Write(binary.AppendUvarint(nil, size)); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := cw.w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cw *carWriter) WriteBlock(c gocid.Cid, data []byte) error {
+	return cw.section(c.Bytes(), data)
+}
+
+func (cw *carWriter) Flush() error {
+	return cw.w.Flush()
+}
+
+type carReader struct {
+	r     *bufio.Reader
+	Roots []gocid.Cid
+}
+
+func newCARReader(r io.Reader) (*carReader, error) {
+	cr := &carReader{r: bufio.NewReader(r)}
+	data, err := cr.section()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CAR header: %v", err)
+	}
+
+	nb := basicnode.Prototype.Map.NewBuilder()
+	if err := dagcbor.Decode(nb, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to decode CAR header: %v", err)
+	}
+	header := nb.Build()
+
+	version, err := header.LookupByString("version")
+	if err != nil {
+		return nil, fmt.Errorf("CAR header has no version")
+	}
+	if v, err := version.AsInt(); err != nil || v != 1 {
+		return nil, fmt.Errorf("unsupported CAR version")
+	}
+	roots, err := header.LookupByString("roots")
+	if err != nil {
+		return nil, fmt.Errorf("CAR header has no roots")
+	}
+	it := roots.ListIterator()
+	for it != nil && !it.Done() {
+		_, root, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		link, err := root.AsLink()
+		if err != nil {
+			return nil, fmt.Errorf("invalid CAR root: %v", err)
+		}
+		cr.Roots = append(cr.Roots, link.(cidlink.Link).Cid)
+	}
+	return cr, nil
+}
+
+func (cr *carReader) section() ([]byte, error) {
+	size, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > carMaxSection {
+		return nil, fmt.Errorf("CAR section of %d bytes exceeds the limit", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(cr.r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Next returns the next block after checking its data against its CID. It
+// returns io.EOF at the end of the archive.
+func (cr *carReader) Next() (Block, error) {
+	data, err := cr.section()
+	if err != nil {
+		if err == io.EOF {
+			return Block{}, io.EOF
+		}
+		return Block{}, fmt.Errorf("failed to read CAR block: %v", err)
+	}
+
+	n, c, err := gocid.CidFromBytes(data)
+	if err != nil {
+		return Block{}, fmt.Errorf("invalid CID in CAR block: %v", err)
+	}
+	block := Block{CID: c, Data: data[n:]}
+
+	sum, err := c.Prefix().Sum(block.Data)
+	if err != nil {
+		return Block{}, fmt.Errorf("failed to hash block %s: %v", c, err)
+	}
+	if !sum.Equals(c) {
+		return Block{}, fmt.Errorf("block %s does not match its CID", c)
+	}
+	return block, nil
+}
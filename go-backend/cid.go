@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+
+	gocid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// computeCID returns the CID `ipfs add --cid-version=1` assigns to data
+func computeCID(data []byte) (CID, error) {
+	root, _, err := buildUnixFSFile(data)
+	if err != nil {
+		return "", err
+	}
+	return CID(root.String()), nil
+}
+
+func newCID(codec uint64, data []byte) (gocid.Cid, error) {
+	hash, err := mh.Sum(data, mh.SHA2_256, -1)
+	if err != nil {
+		return gocid.Undef, fmt.Errorf("failed to hash content: %v", err)
+	}
+	return gocid.NewCidV1(codec, hash), nil
+}
@@ -2,26 +2,56 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/google/uuid"
 )
 
 func addConcept(c *gin.Context) {
 	var newConcept struct {
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		Type        string `json:"type"`
+		Name        string `json:"name" form:"name"`
+		Description string `json:"description" form:"description"`
+		Type        string `json:"type" form:"type"`
+		Content     string `json:"content" form:"-"` // multipart uploads send a file part instead
 	}
 
-	if err := c.BindJSON(&newConcept); err != nil {
+	// Leave room for the other fields next to the largest content accepted
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(config.MaxContentSize)+1<<20)
+
+	var err error
+	if c.ContentType() == binding.MIMEMultipartPOSTForm {
+		err = c.ShouldBindWith(&newConcept, binding.FormMultipart)
+		newConcept.Content = c.PostForm("content")
+	} else {
+		err = c.ShouldBindJSON(&newConcept)
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Content exceeds %d bytes", config.MaxContentSize)})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse request body"})
 		return
 	}
 
+	content, err := contentFromRequest(c, newConcept.Content)
+	if errors.Is(err, errContentTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Content exceeds %d bytes", config.MaxContentSize)})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to store concept content: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store content"})
+		return
+	}
+
 	concept := &Concept{
 		GUID:          GUID(uuid.New().String()),
 		Name:          newConcept.Name,
@@ -29,8 +59,13 @@ func addConcept(c *gin.Context) {
 		Type:          newConcept.Type,
 		Timestamp:     time.Now(),
 		Relationships: []GUID{},
+		Content:       content,
+	}
+	if err := concept.Update(c.Request.Context()); err != nil {
+		log.Printf("Failed to store concept: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store concept"})
+		return
 	}
-	concept.Update(c.Request.Context())
 
 	addNewConcept(concept)
 	c.JSON(http.StatusOK, gin.H{
@@ -66,12 +101,13 @@ func updateOwner(c *gin.Context) {
 	ownerMu.RUnlock()
 	ownerConcept.Timestamp = time.Now()
 
-	addOrUpdateConcept(c.Request.Context(), &ownerConcept)
-
-	if err := node.Save(context.Background(), peerListPath, peerMap); err != nil {
-		log.Printf("Failed to save peerMap: %v", err)
+	if err := addOrUpdateConcept(c.Request.Context(), &ownerConcept); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update owner"})
+		return
 	}
 
+	persister.MarkDirty(peerListPath)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Owner updated successfully", "guid": ownerConcept.GUID})
 }
 
@@ -92,28 +128,37 @@ func deleteConcept(c *gin.Context) {
 	guid := GUID(c.Param("guid"))
 
 	conceptMu.Lock()
-	defer conceptMu.Unlock()
-
 	concept, exists := conceptMap[guid]
 	if !exists {
+		conceptMu.Unlock()
 		c.JSON(http.StatusNotFound, gin.H{"error": "Concept not found"})
 		return
 	}
-
-	if err := node.Remove(context.Background(), concept.GetCID()); err != nil {
-		log.Printf("Failed to remove concept: %v", err)
-	}
 	delete(conceptMap, guid)
 	delete(GUID2CID, guid)
-	if err := node.Save(context.Background(), GUID2CIDPath, GUID2CID); err != nil {
-		log.Printf("Failed to save concept list: %v", err)
+	conceptMu.Unlock()
+	persister.MarkDirty(GUID2CIDPath)
+
+	peerMapMu.Lock()
+	peerMap[peerID].RemoveCID(concept.GetCID())
+	peerMapMu.Unlock()
+	persister.MarkDirty(peerListPath)
+
+	released := append([]CID{concept.GetCID(), concept.contentCID()}, forgetVersions(guid)...)
+	for _, cid := range released {
+		releasePin(c.Request.Context(), cid)
 	}
 
+	t := newTombstone(TombstoneConcept, guid, concept.GetCID())
+	addTombstone(t)
+	go publishTombstones(context.Background(), t)
+
 	c.Status(http.StatusNoContent)
 }
 
 func queryConcepts(c *gin.Context) {
 	filter := ConceptFilter{
+		Peer:        PeerID(c.Query("peer")),
 		CID:         c.Query("cid"),
 		GUID:        GUID(c.Query("guid")),
 		Name:        c.Query("name"),
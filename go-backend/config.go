@@ -0,0 +1,467 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds every tunable of the backend. Values are resolved in order:
+// built-in defaults, the YAML config file, KUDO_* environment variables and
+// finally command line flags.
+type Config struct {
+	Backend           string        `yaml:"backend"`
+	IPFSAPI           string        `yaml:"ipfs_api"`
+	DataDir           string        `yaml:"data_dir"`
+	ListenAddr        string        `yaml:"listen_addr"`
+	PubsubTopic       string        `yaml:"pubsub_topic"`
+	PublishInterval   time.Duration `yaml:"publish_interval"`
+	PeerCheckInterval time.Duration `yaml:"peer_check_interval"`
+	PersistInterval   time.Duration `yaml:"persist_interval"`
+	GCInterval        time.Duration `yaml:"gc_interval"`
+	IndexInterval     time.Duration `yaml:"index_interval"`
+	ReconcileInterval time.Duration `yaml:"reconcile_interval"`
+	HistoryDepth      int           `yaml:"history_depth"`
+	MaxContentSize    int           `yaml:"max_content_size"`
+	MaxImportSize     int           `yaml:"max_import_size"`
+
+	ReplicationWorkers int `yaml:"replication_workers"`
+	ReplicationRetries int `yaml:"replication_retries"`
+	ChangeLogSize      int `yaml:"change_log_size"`
+
+	// Limits on the messages received from peers
+	MaxMessageSize          int `yaml:"max_message_size"`
+	MaxMessageRelationships int `yaml:"max_message_relationships"`
+	RateLimit               int `yaml:"rate_limit"`
+	RateBurst               int `yaml:"rate_burst"`
+
+	TombstoneRetention time.Duration `yaml:"tombstone_retention"`
+	PeerEviction       time.Duration `yaml:"peer_eviction"`
+	DefaultTrust       string        `yaml:"default_trust"`
+	QuarantineLimit    int           `yaml:"quarantine_limit"`
+	InboxLimit         int           `yaml:"inbox_limit"`
+
+	SubscribeMinBackoff time.Duration `yaml:"subscribe_min_backoff"`
+	SubscribeMaxBackoff time.Duration `yaml:"subscribe_max_backoff"`
+
+	BootstrapPeers []string `yaml:"bootstrap_peers"`
+	// ConceptsFile is bootstrapped at startup. The default is skipped if it
+	// is missing, an empty one turns bootstrapping off.
+	ConceptsFile string `yaml:"concepts_file"`
+	MFSRoot      string `yaml:"mfs_root"`
+
+	// Timeouts bounds each IPFS API operation unless the caller's context
+	// already carries an earlier deadline
+	Timeouts map[string]time.Duration `yaml:"timeouts"`
+}
+
+// ipfsOperations lists the operations that accept a default timeout
+var ipfsOperations = []string{"add", "get", "remove", "list", "load", "save", "publish", "subscribe", "connect", "list_peers", "id", "sign", "name_publish", "name_resolve"}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Backend:           "ipfs",
+		IPFSAPI:           "localhost:5001",
+		DataDir:           "kudo-data",
+		ListenAddr:        ":9090",
+		PubsubTopic:       "concept-list",
+		PublishInterval:   1 * time.Minute,
+		PeerCheckInterval: 5 * time.Minute,
+		PersistInterval:   5 * time.Second,
+		GCInterval:        1 * time.Hour,
+		IndexInterval:     5 * time.Minute,
+		ReconcileInterval: 10 * time.Minute,
+		HistoryDepth:      10,
+		MaxContentSize:    32 << 20,
+		MaxImportSize:     1 << 30,
+
+		ReplicationWorkers: 4,
+		ReplicationRetries: 3,
+		ChangeLogSize:      1000,
+
+		MaxMessageSize:          1 << 20,
+		MaxMessageRelationships: 500,
+		RateLimit:               300,
+		RateBurst:               100,
+
+		TombstoneRetention: 30 * 24 * time.Hour,
+		PeerEviction:       7 * 24 * time.Hour,
+		DefaultTrust:       string(TrustKnown),
+		QuarantineLimit:    1000,
+		InboxLimit:         1000,
+
+		SubscribeMinBackoff: 1 * time.Second,
+		SubscribeMaxBackoff: 1 * time.Minute,
+
+		BootstrapPeers: []string{
+			"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+			"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
+			"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
+			"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
+		},
+		ConceptsFile: "data/concepts_structure.yaml",
+		MFSRoot:      "/ccn",
+		Timeouts: map[string]time.Duration{
+			"add":        30 * time.Second,
+			"get":        30 * time.Second,
+			"remove":     10 * time.Second,
+			"list":       30 * time.Second,
+			"load":       10 * time.Second,
+			"save":       10 * time.Second,
+			"publish":    10 * time.Second,
+			"subscribe":  10 * time.Second,
+			"connect":    30 * time.Second,
+			"list_peers": 10 * time.Second,
+			"id":         5 * time.Second,
+			"sign":       5 * time.Second,
+			// IPNS records travel through the DHT, which takes a while
+			"name_publish": 2 * time.Minute,
+			"name_resolve": 1 * time.Minute,
+		},
+	}
+}
+
+// configOption binds one Config field to its flag and environment variable
+type configOption struct {
+	name  string
+	usage string
+	get   func(*Config) string
+	set   func(*Config, string) error
+}
+
+func (o configOption) env() string {
+	return "KUDO_" + strings.ToUpper(strings.ReplaceAll(o.name, "-", "_"))
+}
+
+func stringOption(name, usage string, field func(*Config) *string) configOption {
+	return configOption{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return *field(c) },
+		set: func(c *Config, v string) error {
+			*field(c) = v
+			return nil
+		},
+	}
+}
+
+func durationOption(name, usage string, field func(*Config) *time.Duration) configOption {
+	return configOption{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return field(c).String() },
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid duration %q: %v", v, err)
+			}
+			*field(c) = d
+			return nil
+		},
+	}
+}
+
+func intOption(name, usage string, field func(*Config) *int) configOption {
+	return configOption{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.Itoa(*field(c)) },
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid integer %q", v)
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func listOption(name, usage string, field func(*Config) *[]string) configOption {
+	return configOption{
+		name:  name,
+		usage: usage + " (comma separated)",
+		get:   func(c *Config) string { return strings.Join(*field(c), ",") },
+		set: func(c *Config, v string) error {
+			var list []string
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			*field(c) = list
+			return nil
+		},
+	}
+}
+
+func durationMapOption(name, usage string, field func(*Config) *map[string]time.Duration) configOption {
+	return configOption{
+		name:  name,
+		usage: usage + " (comma separated key=duration pairs)",
+		get: func(c *Config) string {
+			pairs := make([]string, 0, len(*field(c)))
+			for k, v := range *field(c) {
+				pairs = append(pairs, k+"="+v.String())
+			}
+			sort.Strings(pairs)
+			return strings.Join(pairs, ",")
+		},
+		set: func(c *Config, v string) error {
+			merged := make(map[string]time.Duration, len(*field(c)))
+			for k, d := range *field(c) {
+				merged[k] = d
+			}
+			for _, pair := range strings.Split(v, ",") {
+				if pair = strings.TrimSpace(pair); pair == "" {
+					continue
+				}
+				key, value, ok := strings.Cut(pair, "=")
+				if !ok {
+					return fmt.Errorf("invalid pair %q, expected key=duration", pair)
+				}
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					return fmt.Errorf("invalid duration for %s: %v", key, err)
+				}
+				merged[strings.TrimSpace(key)] = d
+			}
+			*field(c) = merged
+			return nil
+		},
+	}
+}
+
+var configOptions = []configOption{
+	stringOption("backend", "storage and network backend: ipfs, memory or fs", func(c *Config) *string { return &c.Backend }),
+	stringOption("ipfs-api", "address of the IPFS HTTP API for the ipfs backend", func(c *Config) *string { return &c.IPFSAPI }),
+	stringOption("data-dir", "data directory for the fs backend", func(c *Config) *string { return &c.DataDir }),
+	stringOption("listen-addr", "address the HTTP API listens on", func(c *Config) *string { return &c.ListenAddr }),
+	stringOption("pubsub-topic", "pubsub topic peers announce themselves on", func(c *Config) *string { return &c.PubsubTopic }),
+	durationOption("publish-interval", "interval between peer announcements", func(c *Config) *time.Duration { return &c.PublishInterval }),
+	durationOption("peer-check-interval", "interval between peer discovery runs", func(c *Config) *time.Duration { return &c.PeerCheckInterval }),
+	durationOption("persist-interval", "how often pending state file writes are flushed", func(c *Config) *time.Duration { return &c.PersistInterval }),
+	durationOption("gc-interval", "interval between pin garbage collections, 0 disables", func(c *Config) *time.Duration { return &c.GCInterval }),
+	durationOption("index-interval", "interval between publishing the peer index under the node's name, 0 disables", func(c *Config) *time.Duration { return &c.IndexInterval }),
+	durationOption("reconcile-interval", "interval between anti-entropy reconciliations with a peer, 0 disables", func(c *Config) *time.Duration { return &c.ReconcileInterval }),
+	intOption("history-depth", "number of previous versions kept pinned per concept", func(c *Config) *int { return &c.HistoryDepth }),
+	intOption("max-content-size", "largest content payload accepted on a concept, in bytes", func(c *Config) *int { return &c.MaxContentSize }),
+	intOption("max-import-size", "largest CAR archive accepted by POST /import, in bytes", func(c *Config) *int { return &c.MaxImportSize }),
+	intOption("replication-workers", "concurrent fetches of concepts announced by peers, 0 disables replication", func(c *Config) *int { return &c.ReplicationWorkers }),
+	intOption("replication-retries", "attempts after the first before a remote concept is given up until announced again", func(c *Config) *int { return &c.ReplicationRetries }),
+	intOption("change-log-size", "announcements kept to catch up peers that missed some", func(c *Config) *int { return &c.ChangeLogSize }),
+	intOption("max-message-size", "largest message accepted from the topic, in bytes", func(c *Config) *int { return &c.MaxMessageSize }),
+	intOption("max-message-relationships", "most relationships a peer may push in one message", func(c *Config) *int { return &c.MaxMessageRelationships }),
+	intOption("rate-limit", "messages a minute accepted from each peer, 0 disables", func(c *Config) *int { return &c.RateLimit }),
+	intOption("rate-burst", "messages a peer may send at once above the rate limit", func(c *Config) *int { return &c.RateBurst }),
+	durationOption("tombstone-retention", "how long deletions are remembered and passed on to peers", func(c *Config) *time.Duration { return &c.TombstoneRetention }),
+	durationOption("peer-eviction", "how long a peer may go unseen before it is dropped from the peer list, 0 disables", func(c *Config) *time.Duration { return &c.PeerEviction }),
+	stringOption("default-trust", "trust level of peers not given one: blocked, untrusted, known or trusted", func(c *Config) *string { return &c.DefaultTrust }),
+	intOption("quarantine-limit", "most items an untrusted peer may have in quarantine", func(c *Config) *int { return &c.QuarantineLimit }),
+	intOption("inbox-limit", "most direct messages kept in the inbox", func(c *Config) *int { return &c.InboxLimit }),
+	durationOption("subscribe-min-backoff", "initial delay before resubscribing after a failure", func(c *Config) *time.Duration { return &c.SubscribeMinBackoff }),
+	durationOption("subscribe-max-backoff", "upper bound of the resubscribe delay", func(c *Config) *time.Duration { return &c.SubscribeMaxBackoff }),
+	listOption("bootstrap-peers", "multiaddrs of bootstrap peers", func(c *Config) *[]string { return &c.BootstrapPeers }),
+	stringOption("concepts-file", "YAML file with the concept structure to bootstrap, empty to skip", func(c *Config) *string { return &c.ConceptsFile }),
+	stringOption("mfs-root", "MFS directory the node keeps its state files in", func(c *Config) *string { return &c.MFSRoot }),
+	durationMapOption("timeouts", "default timeouts of IPFS operations", func(c *Config) *map[string]time.Duration { return &c.Timeouts }),
+}
+
+// loadConfig resolves the effective configuration from the config file,
+// environment and the given command line arguments
+func loadConfig(args []string) (Config, []string, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet("kudo-network", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kudo-network [flags] [export FILE | import [-adopt-owner] FILE]\n\n")
+		fmt.Fprintf(fs.Output(), "Without a command the node serves the HTTP API. FILE may be - for stdout or stdin.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", os.Getenv("KUDO_CONFIG"), "path to a YAML config file")
+	values := make(map[string]*string, len(configOptions))
+	for _, opt := range configOptions {
+		values[opt.name] = fs.String(opt.name, opt.get(&c), fmt.Sprintf("%s [%s]", opt.usage, opt.env()))
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, nil, err
+	}
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return c, nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(data, &c); err != nil {
+			return c, nil, fmt.Errorf("failed to parse config file %s: %v", *configFile, err)
+		}
+	}
+
+	for _, opt := range configOptions {
+		if v, ok := os.LookupEnv(opt.env()); ok {
+			if err := opt.set(&c, v); err != nil {
+				return c, nil, fmt.Errorf("%s: %v", opt.env(), err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, opt := range configOptions {
+			if opt.name == f.Name && flagErr == nil {
+				if err := opt.set(&c, *values[opt.name]); err != nil {
+					flagErr = fmt.Errorf("-%s: %v", opt.name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return c, nil, flagErr
+	}
+
+	return c, fs.Args(), c.Validate()
+}
+
+func (c Config) Validate() error {
+	var problems []string
+	switch c.Backend {
+	case "ipfs":
+		if c.IPFSAPI == "" {
+			problems = append(problems, "ipfs_api is required for the ipfs backend")
+		}
+	case "memory":
+	case "fs":
+		if c.DataDir == "" {
+			problems = append(problems, "data_dir is required for the fs backend")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown backend %q", c.Backend))
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid listen_addr %q: %v", c.ListenAddr, err))
+	}
+	if c.PubsubTopic == "" {
+		problems = append(problems, "pubsub_topic must not be empty")
+	}
+	if c.PublishInterval <= 0 {
+		problems = append(problems, "publish_interval must be positive")
+	}
+	if c.PeerCheckInterval <= 0 {
+		problems = append(problems, "peer_check_interval must be positive")
+	}
+	if c.PersistInterval <= 0 {
+		problems = append(problems, "persist_interval must be positive")
+	}
+	if c.GCInterval < 0 {
+		problems = append(problems, "gc_interval must not be negative")
+	}
+	if c.IndexInterval < 0 {
+		problems = append(problems, "index_interval must not be negative")
+	}
+	if c.ReconcileInterval < 0 {
+		problems = append(problems, "reconcile_interval must not be negative")
+	}
+	if c.HistoryDepth < 0 {
+		problems = append(problems, "history_depth must not be negative")
+	}
+	if c.MaxContentSize <= 0 {
+		problems = append(problems, "max_content_size must be positive")
+	}
+	if c.MaxImportSize <= 0 {
+		problems = append(problems, "max_import_size must be positive")
+	}
+	if c.ReplicationWorkers < 0 {
+		problems = append(problems, "replication_workers must not be negative")
+	}
+	if c.ReplicationRetries < 0 {
+		problems = append(problems, "replication_retries must not be negative")
+	}
+	if c.ChangeLogSize <= 0 {
+		problems = append(problems, "change_log_size must be positive")
+	}
+	if c.MaxMessageSize <= 0 {
+		problems = append(problems, "max_message_size must be positive")
+	}
+	if c.MaxMessageRelationships <= 0 {
+		problems = append(problems, "max_message_relationships must be positive")
+	}
+	if c.RateLimit < 0 {
+		problems = append(problems, "rate_limit must not be negative")
+	}
+	if c.RateLimit > 0 && c.RateBurst <= 0 {
+		problems = append(problems, "rate_burst must be positive")
+	}
+	if c.TombstoneRetention <= 0 {
+		problems = append(problems, "tombstone_retention must be positive")
+	}
+	if c.PeerEviction < 0 {
+		problems = append(problems, "peer_eviction must not be negative")
+	}
+	if !validTrustLevel(TrustLevel(c.DefaultTrust)) {
+		problems = append(problems, fmt.Sprintf("unknown default_trust %q", c.DefaultTrust))
+	}
+	if c.QuarantineLimit <= 0 {
+		problems = append(problems, "quarantine_limit must be positive")
+	}
+	if c.InboxLimit <= 0 {
+		problems = append(problems, "inbox_limit must be positive")
+	}
+	if c.SubscribeMinBackoff <= 0 {
+		problems = append(problems, "subscribe_min_backoff must be positive")
+	}
+	if c.SubscribeMaxBackoff < c.SubscribeMinBackoff {
+		problems = append(problems, "subscribe_max_backoff must not be less than subscribe_min_backoff")
+	}
+	for _, addr := range c.BootstrapPeers {
+		if _, err := ma.NewMultiaddr(addr); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid bootstrap peer %q: %v", addr, err))
+		}
+	}
+	// The default concepts file is optional, bootstrapping skips it if it is
+	// missing. One that was configured explicitly has to exist.
+	if c.ConceptsFile != "" && c.ConceptsFile != defaultConfig().ConceptsFile {
+		if _, err := os.Stat(c.ConceptsFile); err != nil {
+			problems = append(problems, fmt.Sprintf("concepts_file: %v", err))
+		}
+	}
+	for op, d := range c.Timeouts {
+		if !slices.Contains(ipfsOperations, op) {
+			problems = append(problems, fmt.Sprintf("unknown timeout operation %q, expected one of %s", op, strings.Join(ipfsOperations, ", ")))
+		}
+		if d < 0 {
+			problems = append(problems, fmt.Sprintf("timeout for %s must not be negative", op))
+		}
+	}
+	if !path.IsAbs(c.MFSRoot) {
+		problems = append(problems, fmt.Sprintf("mfs_root %q must be an absolute path", c.MFSRoot))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Print writes the effective configuration as YAML
+func (c Config) Print(w io.Writer) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		log.Printf("Failed to marshal config: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "Effective configuration:\n%s", data)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a YAML config file and returns its path
+func writeConfigFile(t *testing.T, data string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return name
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := writeConfigFile(t, "pubsub_topic: from-file\nhistory_depth: 3\nrate_limit: 30\n")
+
+	// settings are the fields the test sets from each source
+	type settings struct {
+		topic    string
+		depth    int
+		rate     int
+		interval time.Duration
+	}
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want settings
+	}{
+		{name: "defaults", want: settings{"concept-list", 10, 300, time.Minute}},
+		{name: "file over defaults", args: []string{"-config", file}, want: settings{"from-file", 3, 30, time.Minute}},
+		{name: "config file from the environment", env: map[string]string{"KUDO_CONFIG": file}, want: settings{"from-file", 3, 30, time.Minute}},
+		{name: "environment over file", env: map[string]string{"KUDO_HISTORY_DEPTH": "4", "KUDO_PUBLISH_INTERVAL": "2m"},
+			args: []string{"-config", file}, want: settings{"from-file", 4, 30, 2 * time.Minute}},
+		{name: "flags over environment", env: map[string]string{"KUDO_HISTORY_DEPTH": "4", "KUDO_RATE_LIMIT": "60"},
+			args: []string{"-config", file, "-history-depth", "5"}, want: settings{"from-file", 5, 60, time.Minute}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c, _, err := loadConfig(tt.args)
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if got := (settings{c.PubsubTopic, c.HistoryDepth, c.RateLimit, c.PublishInterval}); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	file := writeConfigFile(t, "pubsub_topic: ok\npubsub_topik: typo\n")
+	_, _, err := loadConfig([]string{"-config", file})
+	if err == nil || !strings.Contains(err.Error(), "pubsub_topik") {
+		t.Errorf("got error %v, want one naming the unknown key", err)
+	}
+}
+
+func TestValidateConceptsFile(t *testing.T) {
+	existing := writeConfigFile(t, "")
+	// Away from data/, where the default file is
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+	}{
+		{name: "missing default file is skipped", file: defaultConfig().ConceptsFile},
+		{name: "bootstrapping turned off", file: ""},
+		{name: "configured file exists", file: existing},
+		{name: "configured file is missing", file: filepath.Join(t.TempDir(), "missing.yaml"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			c.ConceptsFile = tt.file
+			err := c.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "concepts_file") {
+				t.Errorf("got error %v, want one about concepts_file", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigConceptsFileOptOut(t *testing.T) {
+	file := writeConfigFile(t, "concepts_file: \"\"\n")
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+	}{
+		{name: "file", args: []string{"-config", file}},
+		{name: "environment", env: map[string]string{"KUDO_CONCEPTS_FILE": ""}},
+		{name: "flag", args: []string{"-concepts-file="}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c, _, err := loadConfig(tt.args)
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if c.ConceptsFile != "" {
+				t.Errorf("got concepts file %q, want none", c.ConceptsFile)
+			}
+		})
+	}
+}
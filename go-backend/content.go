@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConceptContent describes the payload attached to a concept. The bytes are
+// stored as a separate IPFS object the concept links to.
+type ConceptContent struct {
+	CID       CID
+	MediaType string
+	Size      int64
+}
+
+var errContentTooLarge = errors.New("content too large")
+
+// storeContent adds a payload to the network. Without a media type the type
+// is sniffed from the first bytes. A payload larger than MaxContentSize
+// fails the add as soon as the limit is passed.
+func storeContent(ctx context.Context, r io.Reader, mediaType string) (*ConceptContent, error) {
+	limited := &limitedReader{r: r, limit: int64(config.MaxContentSize)}
+	buffered := bufio.NewReaderSize(limited, 512)
+	if mediaType == "" || mediaType == "application/octet-stream" {
+		head, _ := buffered.Peek(512)
+		mediaType = http.DetectContentType(head)
+	}
+
+	cid, err := node.Add(ctx, buffered)
+	if limited.exceeded() {
+		// A backend that added the content anyway must not keep it. Identical
+		// bytes may already be pinned for someone else.
+		if err == nil && !isManagedPin(cid) {
+			if err := node.Remove(ctx, cid); err != nil {
+				return nil, fmt.Errorf("%w, and failed to remove it: %v", errContentTooLarge, err)
+			}
+		}
+		return nil, errContentTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	trackPin(cid)
+	return &ConceptContent{CID: cid, MediaType: mediaType, Size: limited.n}, nil
+}
+
+// limitedReader counts what is read and fails with errContentTooLarge once
+// more than limit bytes were read
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.exceeded() {
+		return 0, errContentTooLarge
+	}
+	if int64(len(p)) > l.limit-l.n+1 {
+		p = p[:l.limit-l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.exceeded() {
+		return n, errContentTooLarge
+	}
+	return n, err
+}
+
+func (l *limitedReader) exceeded() bool {
+	return l.n > l.limit
+}
+
+// contentFromRequest stores the content of a new concept. A multipart upload
+// keeps its declared media type, a plain content field is stored as text.
+func contentFromRequest(c *gin.Context, text string) (*ConceptContent, error) {
+	if file, err := c.FormFile("content"); err == nil {
+		if file.Size > int64(config.MaxContentSize) {
+			return nil, errContentTooLarge
+		}
+		f, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return storeContent(c.Request.Context(), f, file.Header.Get("Content-Type"))
+	}
+	if text == "" {
+		return nil, nil
+	}
+	return storeContent(c.Request.Context(), strings.NewReader(text), "text/plain; charset=utf-8")
+}
+
+func getConceptContent(c *gin.Context) {
+	guid := GUID(c.Param("guid"))
+
+	conceptMu.RLock()
+	concept, exists := conceptMap[guid]
+	var content *ConceptContent
+	if exists {
+		content = concept.Content
+	}
+	conceptMu.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Concept not found"})
+		return
+	}
+	if content == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Concept has no content"})
+		return
+	}
+
+	etag := strconv.Quote(string(content.CID))
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	reader, err := node.Get(c.Request.Context(), content.CID)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to fetch content"})
+		return
+	}
+	defer reader.Close()
+
+	// Content is uploaded by anyone and served from the API's origin, so
+	// browsers must not render it, nor guess a type that they would
+	c.DataFromReader(http.StatusOK, content.Size, content.MediaType, reader, map[string]string{
+		"ETag":                   etag,
+		"Content-Disposition":    "attachment",
+		"X-Content-Type-Options": "nosniff",
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStoreContentLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		wantErr error
+	}{
+		{name: "below the limit", size: 100},
+		{name: "at the limit", size: 1024},
+		{name: "above the limit", size: 1025, wantErr: errContentTooLarge},
+		{name: "far above the limit", size: 1 << 20, wantErr: errContentTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			n := resetState(t)
+			config.MaxContentSize = 1024
+
+			content, err := storeContent(ctx, bytes.NewReader(bytes.Repeat([]byte("a"), tt.size)), "")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			pinned, _ := n.List(ctx)
+			if tt.wantErr != nil {
+				if len(pinned) != 0 {
+					t.Errorf("rejected content left %d pins", len(pinned))
+				}
+				return
+			}
+			if content.Size != int64(tt.size) || !strings.HasPrefix(content.MediaType, "text/plain") {
+				t.Errorf("got size %d and type %q", content.Size, content.MediaType)
+			}
+		})
+	}
+}
+
+func TestAddConceptRejectsLargeUpload(t *testing.T) {
+	resetState(t)
+	config.MaxContentSize = 1024
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/concepts", addConcept)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("name", "large")
+	part, _ := form.CreateFormFile("content", "large.bin")
+	part.Write(bytes.Repeat([]byte("a"), 2<<20))
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/concepts", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want %d: %s", rec.Code, http.StatusRequestEntityTooLarge, rec.Body)
+	}
+}
+
+func TestConceptContentIsServedAsAttachment(t *testing.T) {
+	ctx := context.Background()
+	resetState(t)
+	content, err := storeContent(ctx, strings.NewReader("<script>alert(1)</script>"), "text/html")
+	if err != nil {
+		t.Fatalf("storeContent: %v", err)
+	}
+	conceptMap["page"] = &Concept{GUID: "page", Content: content}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/concepts/:guid/content", getConceptContent)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/concepts/page/content", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	for header, want := range map[string]string{"Content-Disposition": "attachment", "X-Content-Type-Options": "nosniff"} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s is %q, want %q", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	gocid "github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// Concepts and relationships are stored as DAG-JSON nodes. References
+// between them keep the GUID, which identifies the entity across versions,
+// next to a CID link to the version that was current when the node was
+// written, so the graph can be walked and pinned as a Merkle DAG.
+
+// dagRef points at a concept or relationship
+type dagRef struct {
+	GUID GUID
+	CID  CID // empty if no stored version was known
+}
+
+func (r dagRef) assemble() (qp.Assemble, error) {
+	var link datamodel.Link
+	if r.CID != "" {
+		c, err := gocid.Decode(string(r.CID))
+		if err != nil {
+			return nil, fmt.Errorf("invalid link to %s: %v", r.GUID, err)
+		}
+		link = cidlink.Link{Cid: c}
+	}
+	return qp.Map(2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "GUID", qp.String(string(r.GUID)))
+		if link != nil {
+			qp.MapEntry(ma, "Link", qp.Link(link))
+		}
+	}), nil
+}
+
+// currentRef resolves guid to the CID of the locally stored concept version
+func currentRef(guid GUID) dagRef {
+	conceptMu.RLock()
+	defer conceptMu.RUnlock()
+	return dagRef{GUID: guid, CID: GUID2CID[guid]}
+}
+
+// linkRelationships resolves the entries of a concept's relationship list.
+// Relationships are stored as nodes of their own, other entries link to the
+// current version of the concept they name.
+func linkRelationships(ctx context.Context, guids []GUID) ([]dagRef, error) {
+	refs := make([]dagRef, 0, len(guids))
+	for _, guid := range guids {
+		relationshipMu.RLock()
+		_, isRelationship := relationshipMap[guid]
+		cid, stored := relationship2CID[guid]
+		relationshipMu.RUnlock()
+
+		if !isRelationship {
+			refs = append(refs, currentRef(guid))
+			continue
+		}
+		if !stored {
+			var err error
+			if cid, err = saveRelationship(ctx, guid); err != nil {
+				return nil, err
+			}
+		}
+		refs = append(refs, dagRef{GUID: guid, CID: cid})
+	}
+	return refs, nil
+}
+
+// refLinks returns the CIDs a list of references links to
+func refLinks(refs []dagRef) []CID {
+	links := make([]CID, 0, len(refs))
+	for _, ref := range refs {
+		if ref.CID != "" {
+			links = append(links, ref.CID)
+		}
+	}
+	return links
+}
+
+// relationshipBlock encodes r as a DAG-JSON node linking the current
+// versions of the concepts it connects
+func relationshipBlock(r *Relationship) (Block, error) {
+	data, err := encodeRelationship(r, currentRef(r.SourceID), currentRef(r.TargetID), currentRef(r.Type))
+	if err != nil {
+		return Block{}, err
+	}
+	c, err := newCID(gocid.DagJSON, data)
+	if err != nil {
+		return Block{}, err
+	}
+	return Block{CID: c, Data: data}, nil
+}
+
+func encodeDAG(build func(ma datamodel.MapAssembler)) ([]byte, error) {
+	n, err := qp.BuildMap(basicnode.Prototype.Map, -1, build)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := dagjson.Encode(n, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeConcept(c *Concept, relationships []dagRef) ([]byte, error) {
+	refs := make([]qp.Assemble, len(relationships))
+	for i, ref := range relationships {
+		a, err := ref.assemble()
+		if err != nil {
+			return nil, err
+		}
+		refs[i] = a
+	}
+	var content qp.Assemble
+	if c.Content != nil {
+		link, err := gocid.Decode(string(c.Content.CID))
+		if err != nil {
+			return nil, fmt.Errorf("invalid content link: %v", err)
+		}
+		content = qp.Map(3, func(ma datamodel.MapAssembler) {
+			qp.MapEntry(ma, "Link", qp.Link(cidlink.Link{Cid: link}))
+			qp.MapEntry(ma, "MediaType", qp.String(c.Content.MediaType))
+			qp.MapEntry(ma, "Size", qp.Int(c.Content.Size))
+		})
+	}
+	var previous datamodel.Link
+	if c.Previous != "" {
+		p, err := gocid.Decode(string(c.Previous))
+		if err != nil {
+			return nil, fmt.Errorf("invalid previous version: %v", err)
+		}
+		previous = cidlink.Link{Cid: p}
+	}
+
+	return encodeDAG(func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "GUID", qp.String(string(c.GUID)))
+		qp.MapEntry(ma, "Name", qp.String(c.Name))
+		qp.MapEntry(ma, "Description", qp.String(c.Description))
+		qp.MapEntry(ma, "Type", qp.String(c.Type))
+		qp.MapEntry(ma, "Relationships", qp.List(int64(len(refs)), func(la datamodel.ListAssembler) {
+			for _, ref := range refs {
+				qp.ListEntry(la, ref)
+			}
+		}))
+		qp.MapEntry(ma, "Timestamp", qp.String(c.Timestamp.Format(time.RFC3339Nano)))
+		if content != nil {
+			qp.MapEntry(ma, "Content", content)
+		}
+		if previous != nil {
+			qp.MapEntry(ma, "Previous", qp.Link(previous))
+		}
+	})
+}
+
+func encodeRelationship(r *Relationship, source, target, relType dagRef) ([]byte, error) {
+	refs := make(map[string]qp.Assemble, 3)
+	for key, ref := range map[string]dagRef{"Source": source, "Target": target, "Type": relType} {
+		a, err := ref.assemble()
+		if err != nil {
+			return nil, err
+		}
+		refs[key] = a
+	}
+	state := r.State
+	if state.Interactions == nil {
+		state = r.baseState()
+	}
+
+	return encodeDAG(func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "ID", qp.String(string(r.ID)))
+		qp.MapEntry(ma, "Source", refs["Source"])
+		qp.MapEntry(ma, "Target", refs["Target"])
+		qp.MapEntry(ma, "Type", refs["Type"])
+		qp.MapEntry(ma, "EnergyFlow", qp.Float(r.EnergyFlow))
+		qp.MapEntry(ma, "FrequencySpec", qp.List(int64(len(r.FrequencySpec)), func(la datamodel.ListAssembler) {
+			for _, f := range r.FrequencySpec {
+				qp.ListEntry(la, qp.Float(f))
+			}
+		}))
+		qp.MapEntry(ma, "Amplitude", qp.Float(r.Amplitude))
+		qp.MapEntry(ma, "Volume", qp.Float(r.Volume))
+		qp.MapEntry(ma, "Depth", qp.Int(int64(r.Depth)))
+		qp.MapEntry(ma, "Interactions", qp.Int(int64(r.Interactions)))
+		qp.MapEntry(ma, "LastInteraction", qp.String(r.LastInteraction.Format(time.RFC3339Nano)))
+		qp.MapEntry(ma, "Timestamp", qp.String(r.Timestamp.Format(time.RFC3339Nano)))
+		qp.MapEntry(ma, "State", assembleRelationshipState(state))
+	})
+}
+
+func assembleRelationshipState(s RelationshipState) qp.Assemble {
+	register := func(r lwwRegister) qp.Assemble {
+		return qp.Map(3, func(ma datamodel.MapAssembler) {
+			qp.MapEntry(ma, "Value", qp.Float(r.Value))
+			qp.MapEntry(ma, "Time", qp.String(r.Time.Format(time.RFC3339Nano)))
+			qp.MapEntry(ma, "Peer", qp.String(string(r.Peer)))
+		})
+	}
+	return qp.Map(5, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "Interactions", qp.Map(int64(len(s.Interactions)), func(ma datamodel.MapAssembler) {
+			for _, p := range sortedKeys(s.Interactions) {
+				qp.MapEntry(ma, string(p), qp.Int(int64(s.Interactions[p])))
+			}
+		}))
+		qp.MapEntry(ma, "EnergyFlow", register(s.EnergyFlow))
+		qp.MapEntry(ma, "Amplitude", register(s.Amplitude))
+		qp.MapEntry(ma, "Volume", register(s.Volume))
+		qp.MapEntry(ma, "Frequencies", qp.Map(int64(len(s.Frequencies)), func(ma datamodel.MapAssembler) {
+			for _, tag := range sortedKeys(s.Frequencies) {
+				e := s.Frequencies[tag]
+				qp.MapEntry(ma, tag, qp.Map(2, func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, "Value", qp.Float(e.Value))
+					qp.MapEntry(ma, "Added", qp.String(e.Added.Format(time.RFC3339Nano)))
+				}))
+			}
+		}))
+	})
+}
+
+func decodeDAG(data []byte) (datamodel.Node, error) {
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dagjson.Decode(nb, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to decode DAG-JSON: %v", err)
+	}
+	return nb.Build(), nil
+}
+
+// dagFields reads typed fields out of a decoded map node, remembering the
+// first error so decoders can read every field and check once
+type dagFields struct {
+	n   datamodel.Node
+	err error
+}
+
+func (f *dagFields) lookup(key string, optional bool) datamodel.Node {
+	if f.err != nil {
+		return nil
+	}
+	v, err := f.n.LookupByString(key)
+	if err != nil {
+		if !optional {
+			f.err = fmt.Errorf("missing field %s", key)
+		}
+		return nil
+	}
+	return v
+}
+
+func (f *dagFields) String(key string) string {
+	v := f.lookup(key, false)
+	if v == nil {
+		return ""
+	}
+	s, err := v.AsString()
+	if err != nil {
+		f.err = fmt.Errorf("field %s: %v", key, err)
+	}
+	return s
+}
+
+// Int accepts integers and floats without a fraction, as DAG-JSON does not
+// tell them apart once encoded
+func (f *dagFields) Int(key string) int64 {
+	v := f.lookup(key, false)
+	if v == nil {
+		return 0
+	}
+	if v.Kind() == datamodel.Kind_Float {
+		fl, err := v.AsFloat()
+		if err != nil || fl != float64(int64(fl)) {
+			f.err = fmt.Errorf("field %s: not an integer", key)
+		}
+		return int64(fl)
+	}
+	i, err := v.AsInt()
+	if err != nil {
+		f.err = fmt.Errorf("field %s: %v", key, err)
+	}
+	return i
+}
+
+// Float accepts integers too, as DAG-JSON writes floats without a fraction
+// as integers
+func (f *dagFields) Float(key string) float64 {
+	v := f.lookup(key, false)
+	if v == nil {
+		return 0
+	}
+	return f.asFloat(key, v)
+}
+
+func (f *dagFields) asFloat(key string, v datamodel.Node) float64 {
+	if v.Kind() == datamodel.Kind_Int {
+		i, err := v.AsInt()
+		if err != nil {
+			f.err = fmt.Errorf("field %s: %v", key, err)
+		}
+		return float64(i)
+	}
+	fl, err := v.AsFloat()
+	if err != nil {
+		f.err = fmt.Errorf("field %s: %v", key, err)
+	}
+	return fl
+}
+
+func (f *dagFields) Floats(key string) []float64 {
+	v := f.lookup(key, false)
+	if v == nil {
+		return nil
+	}
+	values := make([]float64, 0, v.Length())
+	it := v.ListIterator()
+	for it != nil && !it.Done() {
+		_, entry, err := it.Next()
+		if err != nil {
+			f.err = fmt.Errorf("field %s: %v", key, err)
+			return nil
+		}
+		values = append(values, f.asFloat(key, entry))
+	}
+	return values
+}
+
+// Ref returns the GUID of a reference to another concept
+func (f *dagFields) Ref(key string) GUID {
+	ref := f.Map(key)
+	if ref == nil {
+		if f.err == nil {
+			f.err = fmt.Errorf("missing field %s", key)
+		}
+		return ""
+	}
+	guid := GUID(ref.String("GUID"))
+	if ref.err != nil && f.err == nil {
+		f.err = fmt.Errorf("field %s: %v", key, ref.err)
+	}
+	return guid
+}
+
+// Map returns the fields of an optional nested map
+func (f *dagFields) Map(key string) *dagFields {
+	v := f.lookup(key, true)
+	if v == nil {
+		return nil
+	}
+	if v.Kind() != datamodel.Kind_Map {
+		f.err = fmt.Errorf("field %s: not a map", key)
+		return nil
+	}
+	return &dagFields{n: v}
+}
+
+func (f *dagFields) Time(key string) time.Time {
+	s := f.String(key)
+	if f.err != nil {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		f.err = fmt.Errorf("field %s: %v", key, err)
+	}
+	return t
+}
+
+// Link returns the CID of an optional link field
+func (f *dagFields) Link(key string) CID {
+	v := f.lookup(key, true)
+	if v == nil {
+		return ""
+	}
+	l, err := v.AsLink()
+	if err != nil {
+		f.err = fmt.Errorf("field %s: %v", key, err)
+		return ""
+	}
+	return CID(l.String())
+}
+
+func (f *dagFields) Refs(key string) []GUID {
+	v := f.lookup(key, false)
+	if v == nil {
+		return nil
+	}
+	guids := make([]GUID, 0, v.Length())
+	it := v.ListIterator()
+	for it != nil && !it.Done() {
+		_, entry, err := it.Next()
+		if err != nil {
+			f.err = fmt.Errorf("field %s: %v", key, err)
+			return nil
+		}
+		ref := dagFields{n: entry}
+		guids = append(guids, GUID(ref.String("GUID")))
+		if ref.err != nil {
+			f.err = fmt.Errorf("field %s: %v", key, ref.err)
+			return nil
+		}
+	}
+	return guids
+}
+
+// RefLinks returns the CIDs a list of references links to
+func (f *dagFields) RefLinks(key string) []CID {
+	v := f.lookup(key, false)
+	if v == nil {
+		return nil
+	}
+	links := make([]CID, 0, v.Length())
+	it := v.ListIterator()
+	for it != nil && !it.Done() {
+		_, entry, err := it.Next()
+		if err != nil {
+			f.err = fmt.Errorf("field %s: %v", key, err)
+			return nil
+		}
+		ref := dagFields{n: entry}
+		if link := ref.Link("Link"); link != "" {
+			links = append(links, link)
+		}
+		if ref.err != nil {
+			f.err = fmt.Errorf("field %s: %v", key, ref.err)
+			return nil
+		}
+	}
+	return links
+}
+
+// Links returns a list field of links
+func (f *dagFields) Links(key string) []CID {
+	v := f.lookup(key, false)
+	if v == nil {
+		return nil
+	}
+	links := make([]CID, 0, v.Length())
+	it := v.ListIterator()
+	for it != nil && !it.Done() {
+		_, entry, err := it.Next()
+		if err != nil {
+			f.err = fmt.Errorf("field %s: %v", key, err)
+			return nil
+		}
+		l, err := entry.AsLink()
+		if err != nil {
+			f.err = fmt.Errorf("field %s: %v", key, err)
+			return nil
+		}
+		links = append(links, CID(l.String()))
+	}
+	return links
+}
+
+// entries calls fn for every entry of a map field
+func (f *dagFields) entries(key string, fn func(k string, v datamodel.Node) error) {
+	v := f.lookup(key, false)
+	if v == nil {
+		return
+	}
+	it := v.MapIterator()
+	if it == nil {
+		f.err = fmt.Errorf("field %s: not a map", key)
+		return
+	}
+	for !it.Done() {
+		k, entry, err := it.Next()
+		if err == nil {
+			var ks string
+			if ks, err = k.AsString(); err == nil {
+				err = fn(ks, entry)
+			}
+		}
+		if err != nil {
+			f.err = fmt.Errorf("field %s: %v", key, err)
+			return
+		}
+	}
+}
+
+// LinkMap returns a map field whose values are links
+func (f *dagFields) LinkMap(key string) map[string]CID {
+	links := make(map[string]CID)
+	f.entries(key, func(k string, v datamodel.Node) error {
+		l, err := v.AsLink()
+		if err != nil {
+			return err
+		}
+		links[k] = CID(l.String())
+		return nil
+	})
+	return links
+}
+
+// LinkLists returns a map field whose values are lists of links
+func (f *dagFields) LinkLists(key string) map[string][]CID {
+	lists := make(map[string][]CID)
+	f.entries(key, func(k string, v datamodel.Node) error {
+		it := v.ListIterator()
+		if it == nil {
+			return fmt.Errorf("%s: not a list", k)
+		}
+		for !it.Done() {
+			_, entry, err := it.Next()
+			if err != nil {
+				return err
+			}
+			l, err := entry.AsLink()
+			if err != nil {
+				return err
+			}
+			lists[k] = append(lists[k], CID(l.String()))
+		}
+		return nil
+	})
+	return lists
+}
+
+func decodeConcept(data []byte) (*Concept, error) {
+	n, err := decodeDAG(data)
+	if err != nil {
+		return nil, err
+	}
+	f := dagFields{n: n}
+	c := &Concept{
+		GUID:          GUID(f.String("GUID")),
+		Name:          f.String("Name"),
+		Description:   f.String("Description"),
+		Type:          f.String("Type"),
+		Relationships: f.Refs("Relationships"),
+		Timestamp:     f.Time("Timestamp"),
+		Previous:      f.Link("Previous"),
+		links:         f.RefLinks("Relationships"),
+	}
+	if content := f.Map("Content"); content != nil {
+		c.Content = &ConceptContent{
+			CID:       content.Link("Link"),
+			MediaType: content.String("MediaType"),
+			Size:      content.Int("Size"),
+		}
+		if content.err == nil && c.Content.CID == "" {
+			content.err = fmt.Errorf("missing link")
+		}
+		if content.err != nil {
+			return nil, fmt.Errorf("invalid concept content: %v", content.err)
+		}
+	}
+	if f.err != nil {
+		return nil, fmt.Errorf("invalid concept: %v", f.err)
+	}
+	return c, nil
+}
+
+func decodeRelationship(data []byte) (*Relationship, error) {
+	n, err := decodeDAG(data)
+	if err != nil {
+		return nil, err
+	}
+	f := dagFields{n: n}
+	r := &Relationship{
+		ID:              GUID(f.String("ID")),
+		SourceID:        f.Ref("Source"),
+		TargetID:        f.Ref("Target"),
+		Type:            f.Ref("Type"),
+		EnergyFlow:      f.Float("EnergyFlow"),
+		FrequencySpec:   f.Floats("FrequencySpec"),
+		Amplitude:       f.Float("Amplitude"),
+		Volume:          f.Float("Volume"),
+		Depth:           int(f.Int("Depth")),
+		Interactions:    int(f.Int("Interactions")),
+		LastInteraction: f.Time("LastInteraction"),
+		Timestamp:       f.Time("Timestamp"),
+	}
+	// Relationships stored before they carried a state get their base state
+	if state := f.Map("State"); state != nil {
+		r.State = state.relationshipState()
+		if state.err != nil && f.err == nil {
+			f.err = fmt.Errorf("field State: %v", state.err)
+		}
+	}
+	if f.err != nil {
+		return nil, fmt.Errorf("invalid relationship: %v", f.err)
+	}
+	r.ensureState()
+	r.apply()
+	return r, nil
+}
+
+func (f *dagFields) relationshipState() RelationshipState {
+	s := RelationshipState{
+		Interactions: make(map[PeerID]int),
+		Frequencies:  make(map[string]frequencyEntry),
+	}
+	register := func(key string) lwwRegister {
+		fields := f.Map(key)
+		if fields == nil {
+			if f.err == nil {
+				f.err = fmt.Errorf("missing field %s", key)
+			}
+			return lwwRegister{}
+		}
+		r := lwwRegister{Value: fields.Float("Value"), Time: fields.Time("Time"), Peer: PeerID(fields.String("Peer"))}
+		if fields.err != nil && f.err == nil {
+			f.err = fmt.Errorf("field %s: %v", key, fields.err)
+		}
+		return r
+	}
+	s.EnergyFlow = register("EnergyFlow")
+	s.Amplitude = register("Amplitude")
+	s.Volume = register("Volume")
+	f.entries("Interactions", func(k string, v datamodel.Node) error {
+		n, err := v.AsInt()
+		s.Interactions[PeerID(k)] = int(n)
+		return err
+	})
+	f.entries("Frequencies", func(k string, v datamodel.Node) error {
+		e := dagFields{n: v}
+		s.Frequencies[k] = frequencyEntry{Value: e.Float("Value"), Added: e.Time("Added")}
+		return e.err
+	})
+	return s
+}
+
+func fetchConcept(ctx context.Context, cid CID) (*Concept, error) {
+	parsed, err := gocid.Decode(string(cid))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CID %s: %v", cid, err)
+	}
+
+	var c *Concept
+	if parsed.Type() == gocid.DagJSON {
+		data, err := node.GetBlock(ctx, cid)
+		if err != nil {
+			return nil, err
+		}
+		if c, err = decodeConcept(data); err != nil {
+			return nil, err
+		}
+	} else {
+		// Concepts stored before the DAG encoding are plain JSON files
+		reader, err := node.Get(ctx, cid)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		c = &Concept{}
+		if err := json.NewDecoder(reader).Decode(c); err != nil {
+			return nil, err
+		}
+	}
+	c.CID = cid
+	return c, nil
+}
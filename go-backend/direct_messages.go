@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Owners can send each other direct messages, encrypted with NaCl box to an
+// X25519 key of the recipient. Every owner has such a key, and every
+// envelope a node signs carries the key of its owner along with the owner's
+// GUID, so peers learn which key belongs to which owner from messages they
+// can verify. The first key seen for an owner is pinned: a node announcing
+// another one is not believed until the owner changes the key through
+// PUT /owner-keys/:guid, as any node can claim an owner GUID. A message is
+// published on the topic of its recipient, which only the recipient's node
+// subscribes to, and kept in its inbox.
+
+const maxDirectMessageSize = 64 << 10
+
+// OwnerKey is the X25519 key pair of the owner
+type OwnerKey struct {
+	Owner      GUID   `json:"owner"`
+	PublicKey  []byte `json:"publicKey"`
+	PrivateKey []byte `json:"privateKey"`
+}
+
+// ownerKeyring is the key of the owner as saved, along with the keys of the
+// owners the node had before, which messages already in the inbox are sealed
+// to
+type ownerKeyring struct {
+	OwnerKey
+	Retired []OwnerKey `json:"retired,omitempty"`
+}
+
+// The keys of the owner are guarded by ownerMu along with its GUID
+var (
+	ownerPublicKey, ownerPrivateKey *[32]byte
+	retiredOwnerKeys                = make(map[GUID]*[32]byte)
+)
+
+// loadOrCreateOwnerKey loads the key of the owner, generating one if the
+// owner has none yet
+func loadOrCreateOwnerKey(ctx context.Context) {
+	if err := updateOwnerKeyring(ctx); err != nil {
+		log.Fatalf("Failed to set up owner key: %v", err)
+	}
+}
+
+// updateOwnerKeyring loads the keyring and generates a key for the owner if
+// the current one belongs to another owner or there is none, keeping the
+// key it replaces
+func updateOwnerKeyring(ctx context.Context) error {
+	ownerMu.RLock()
+	owner := ownerGUID
+	ownerMu.RUnlock()
+
+	var keyring ownerKeyring
+	if err := node.Load(ctx, ownerKeyPath, &keyring); err != nil && !errors.Is(err, errNotFound) {
+		return fmt.Errorf("failed to load owner key: %v", err)
+	}
+	valid := len(keyring.PublicKey) == 32 && len(keyring.PrivateKey) == 32
+	if !valid || keyring.Owner != owner {
+		if valid {
+			keyring.Retired = append(keyring.Retired, keyring.OwnerKey)
+		}
+		// An owner the node had before gets its key back
+		i := slices.IndexFunc(keyring.Retired, func(k OwnerKey) bool { return k.Owner == owner })
+		if i >= 0 {
+			keyring.OwnerKey = keyring.Retired[i]
+			keyring.Retired = slices.Delete(keyring.Retired, i, i+1)
+		} else {
+			log.Println("Generating new owner key...")
+			public, private, err := box.GenerateKey(rand.Reader)
+			if err != nil {
+				return fmt.Errorf("failed to generate owner key: %v", err)
+			}
+			keyring.OwnerKey = OwnerKey{Owner: owner, PublicKey: public[:], PrivateKey: private[:]}
+		}
+		if err := node.Save(ctx, ownerKeyPath, keyring); err != nil {
+			return fmt.Errorf("failed to save owner key: %v", err)
+		}
+	}
+
+	ownerMu.Lock()
+	defer ownerMu.Unlock()
+	ownerPublicKey, ownerPrivateKey = new([32]byte), new([32]byte)
+	copy(ownerPublicKey[:], keyring.PublicKey)
+	copy(ownerPrivateKey[:], keyring.PrivateKey)
+	retiredOwnerKeys = make(map[GUID]*[32]byte, len(keyring.Retired))
+	for _, key := range keyring.Retired {
+		if len(key.PrivateKey) == 32 {
+			private := new([32]byte)
+			copy(private[:], key.PrivateKey)
+			retiredOwnerKeys[key.Owner] = private
+		}
+	}
+	return nil
+}
+
+// privateKeyOf returns the private key messages to owner are sealed to,
+// which is a retired one for the owners the node had before
+func privateKeyOf(owner GUID) (*[32]byte, bool) {
+	ownerMu.RLock()
+	defer ownerMu.RUnlock()
+	if owner == ownerGUID {
+		return ownerPrivateKey, ownerPrivateKey != nil
+	}
+	key, ok := retiredOwnerKeys[owner]
+	return key, ok
+}
+
+// directMessageTopic is the topic the node of an owner receives its direct
+// messages on
+func directMessageTopic(owner GUID) string {
+	return path.Join(config.PubsubTopic, "dm", string(owner))
+}
+
+// SealedMessage is the body of a direct message
+type SealedMessage struct {
+	ID        string    `json:"id"`
+	From      GUID      `json:"from"`
+	To        GUID      `json:"to"`
+	SenderKey []byte    `json:"senderKey"`
+	Nonce     []byte    `json:"nonce"`
+	Box       []byte    `json:"box"`
+	SentAt    time.Time `json:"sentAt"`
+}
+
+// InboxMessage is a received direct message. It is kept sealed and opened
+// when read.
+type InboxMessage struct {
+	SealedMessage
+	Peer       PeerID     `json:"peer"`
+	ReceivedAt time.Time  `json:"receivedAt"`
+	ReadAt     *time.Time `json:"readAt,omitempty"`
+}
+
+var (
+	inbox   = make(map[string]*InboxMessage)
+	inboxMu sync.RWMutex
+)
+
+var (
+	// pinnedKeys maps every owner to the first key seen for it, and
+	// keyChanges to the last other key a node announced for it
+	pinnedKeys   = make(map[GUID][]byte)
+	keyChanges   = make(map[GUID]KeyChange)
+	pinnedKeysMu sync.RWMutex
+)
+
+// KeyChange is a key announced for an owner that differs from the one
+// pinned
+type KeyChange struct {
+	PublicKey []byte    `json:"publicKey"`
+	Peer      PeerID    `json:"peer"`
+	SeenAt    time.Time `json:"seenAt"`
+}
+
+var (
+	errUnknownRecipient = errors.New("no key known for recipient")
+	errCannotOpen       = errors.New("cannot open direct message")
+)
+
+func (m *SealedMessage) open() ([]byte, error) {
+	if len(m.SenderKey) != 32 || len(m.Nonce) != 24 {
+		return nil, errCannotOpen
+	}
+	var senderKey [32]byte
+	var nonce [24]byte
+	copy(senderKey[:], m.SenderKey)
+	copy(nonce[:], m.Nonce)
+	privateKey, ok := privateKeyOf(m.To)
+	if !ok {
+		return nil, errCannotOpen
+	}
+	text, ok := box.Open(nil, m.Box, &nonce, &senderKey, privateKey)
+	if !ok {
+		return nil, errCannotOpen
+	}
+	return text, nil
+}
+
+// pinOwnerKey pins the key a peer announced for its owner if the owner has
+// none yet, and records it as a change otherwise
+func pinOwnerKey(owner GUID, key []byte, from PeerID) {
+	if owner == "" || len(key) != 32 {
+		return
+	}
+	pinnedKeysMu.Lock()
+	defer pinnedKeysMu.Unlock()
+	pinned, ok := pinnedKeys[owner]
+	switch {
+	case !ok:
+		pinnedKeys[owner] = bytes.Clone(key)
+		persister.MarkDirty(pinnedKeysPath)
+	case !bytes.Equal(pinned, key):
+		if change, seen := keyChanges[owner]; !seen || !bytes.Equal(change.PublicKey, key) {
+			log.Printf("Peer %s announced a new key for owner %s, keeping the pinned one until it is changed", from, owner)
+		}
+		keyChanges[owner] = KeyChange{PublicKey: bytes.Clone(key), Peer: from, SeenAt: time.Now()}
+	}
+}
+
+// recipientKey returns the key pinned for an owner
+func recipientKey(owner GUID) (*[32]byte, bool) {
+	pinnedKeysMu.RLock()
+	defer pinnedKeysMu.RUnlock()
+	pinned, ok := pinnedKeys[owner]
+	if !ok {
+		return nil, false
+	}
+	key := new([32]byte)
+	copy(key[:], pinned)
+	return key, true
+}
+
+// sendDirectMessage seals text for an owner and publishes it on its topic
+func sendDirectMessage(ctx context.Context, to GUID, text []byte) (*SealedMessage, error) {
+	key, ok := recipientKey(to)
+	if !ok {
+		return nil, fmt.Errorf("%w %s", errUnknownRecipient, to)
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	ownerMu.RLock()
+	from, publicKey, privateKey := ownerGUID, ownerPublicKey, ownerPrivateKey
+	ownerMu.RUnlock()
+
+	msg := &SealedMessage{
+		ID:        uuid.New().String(),
+		From:      from,
+		To:        to,
+		SenderKey: publicKey[:],
+		Nonce:     nonce[:],
+		Box:       box.Seal(nil, text, &nonce, key, privateKey),
+		SentAt:    time.Now().UTC(),
+	}
+	if err := publishMessageTo(ctx, directMessageTopic(to), MessageDirect, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// handleDirectMessage keeps a direct message for our owner in the inbox. The
+// sender must be the owner of the node that signed it, with the key pinned
+// for that owner. Once the inbox is full, the oldest read message makes room,
+// and new messages are dropped if there is none.
+func handleDirectMessage(ctx context.Context, from PeerID, msg SealedMessage) {
+	ownerMu.RLock()
+	owner := ownerGUID
+	ownerMu.RUnlock()
+	if msg.To != owner {
+		return
+	}
+
+	peerMapMu.RLock()
+	p, ok := peerMap[from].(*Peer)
+	genuine := ok && p.OwnerGUID == msg.From && bytes.Equal(p.OwnerKey, msg.SenderKey)
+	peerMapMu.RUnlock()
+	pinnedKeysMu.RLock()
+	genuine = genuine && bytes.Equal(pinnedKeys[msg.From], msg.SenderKey)
+	pinnedKeysMu.RUnlock()
+	if !genuine {
+		log.Printf("Ignoring direct message %s claiming to be from %s sent by peer %s", msg.ID, msg.From, from)
+		return
+	}
+	if _, err := msg.open(); err != nil {
+		log.Printf("Ignoring direct message %s from %s: %v", msg.ID, msg.From, err)
+		return
+	}
+
+	m := &InboxMessage{SealedMessage: msg, Peer: from, ReceivedAt: time.Now()}
+	inboxMu.Lock()
+	_, duplicate := inbox[msg.ID]
+	full := !duplicate && len(inbox) >= config.InboxLimit && !dropOldestRead()
+	if !duplicate && !full {
+		inbox[msg.ID] = m
+	}
+	inboxMu.Unlock()
+	if full {
+		log.Printf("Inbox is full, dropping direct message %s from %s", msg.ID, msg.From)
+	}
+	if duplicate || full {
+		return
+	}
+	persister.MarkDirty(inboxPath)
+	log.Printf("Received direct message %s from %s", msg.ID, msg.From)
+
+	if view, err := m.view(); err == nil {
+		inboxWatchers.notify(view)
+	}
+}
+
+// dropOldestRead removes the read message received first from the inbox.
+// inboxMu must be held.
+func dropOldestRead() bool {
+	var oldest *InboxMessage
+	for _, m := range inbox {
+		if m.ReadAt != nil && (oldest == nil || m.ReceivedAt.Before(oldest.ReceivedAt)) {
+			oldest = m
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(inbox, oldest.ID)
+	return true
+}
+
+// DirectMessage is an opened inbox message
+type DirectMessage struct {
+	ID         string     `json:"id"`
+	From       GUID       `json:"from"`
+	Peer       PeerID     `json:"peer"`
+	Text       string     `json:"text"`
+	SentAt     time.Time  `json:"sentAt"`
+	ReceivedAt time.Time  `json:"receivedAt"`
+	ReadAt     *time.Time `json:"readAt,omitempty"`
+}
+
+func (m *InboxMessage) view() (DirectMessage, error) {
+	text, err := m.open()
+	if err != nil {
+		return DirectMessage{}, err
+	}
+	return DirectMessage{
+		ID:         m.ID,
+		From:       m.From,
+		Peer:       m.Peer,
+		Text:       string(text),
+		SentAt:     m.SentAt,
+		ReceivedAt: m.ReceivedAt,
+		ReadAt:     m.ReadAt,
+	}, nil
+}
+
+// inboxWatcherSet fans arriving messages out to the open WebSocket
+// connections
+type inboxWatcherSet struct {
+	mu       sync.Mutex
+	watchers map[chan DirectMessage]bool
+}
+
+var inboxWatchers = &inboxWatcherSet{watchers: make(map[chan DirectMessage]bool)}
+
+func (s *inboxWatcherSet) add() chan DirectMessage {
+	ch := make(chan DirectMessage, 16)
+	s.mu.Lock()
+	s.watchers[ch] = true
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *inboxWatcherSet) remove(ch chan DirectMessage) {
+	s.mu.Lock()
+	delete(s.watchers, ch)
+	s.mu.Unlock()
+}
+
+func (s *inboxWatcherSet) notify(m DirectMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.watchers {
+		select {
+		case ch <- m:
+		default:
+			// A client that does not keep up still finds the message in
+			// the inbox
+		}
+	}
+}
+
+func sendDirectMessageHandler(c *gin.Context) {
+	var req struct {
+		To   GUID   `json:"to"`
+		Text string `json:"text"`
+	}
+	if err := c.BindJSON(&req); err != nil || req.To == "" || req.Text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if len(req.Text) > maxDirectMessageSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Message exceeds %d bytes", maxDirectMessageSize)})
+		return
+	}
+
+	msg, err := sendDirectMessage(c.Request.Context(), req.To, []byte(req.Text))
+	if errors.Is(err, errUnknownRecipient) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"id": msg.ID, "sentAt": msg.SentAt})
+}
+
+func listDirectMessages(c *gin.Context) {
+	unread := c.Query("unread") == "true"
+
+	inboxMu.RLock()
+	list := make([]DirectMessage, 0, len(inbox))
+	for _, m := range inbox {
+		if unread && m.ReadAt != nil {
+			continue
+		}
+		view, err := m.view()
+		if err != nil {
+			log.Printf("Failed to open direct message %s: %v", m.ID, err)
+			continue
+		}
+		list = append(list, view)
+	}
+	inboxMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ReceivedAt.After(list[j].ReceivedAt) })
+	c.JSON(http.StatusOK, list)
+}
+
+func markDirectMessageRead(c *gin.Context) {
+	id := c.Param("id")
+
+	inboxMu.Lock()
+	m, ok := inbox[id]
+	unread := ok && m.ReadAt == nil
+	if unread {
+		now := time.Now()
+		m.ReadAt = &now
+	}
+	inboxMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+	if unread {
+		persister.MarkDirty(inboxPath)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleDirectMessageWebSocket pushes direct messages to the client as they
+// arrive
+func handleDirectMessageWebSocket(c *gin.Context) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ch := inboxWatchers.add()
+	defer inboxWatchers.remove(ch)
+
+	closed := make(chan struct{})
+	go func() {
+		keepAlive(conn)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case m := <-ch:
+			if err := conn.WriteJSON(m); err != nil {
+				log.Printf("Failed to push direct message %s: %v", m.ID, err)
+				return
+			}
+		}
+	}
+}
+
+// directMessages is the subscription to the topic of the owner, moved to the
+// topic of the new owner when the owner changes
+var directMessages struct {
+	sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	topic  string
+}
+
+// subscribeDirectMessages subscribes to the topic of the owner until ctx is
+// done
+func subscribeDirectMessages(ctx context.Context) {
+	directMessages.Lock()
+	directMessages.ctx = ctx
+	directMessages.Unlock()
+	resubscribeDirectMessages()
+}
+
+// resubscribeDirectMessages moves the subscription to the topic of the
+// current owner
+func resubscribeDirectMessages() {
+	ownerMu.RLock()
+	topic := directMessageTopic(ownerGUID)
+	ownerMu.RUnlock()
+
+	directMessages.Lock()
+	defer directMessages.Unlock()
+	if directMessages.ctx == nil || directMessages.topic == topic {
+		return
+	}
+	if directMessages.cancel != nil {
+		directMessages.cancel()
+		subscriptionsMu.Lock()
+		delete(subscriptions, directMessages.topic)
+		subscriptionsMu.Unlock()
+	}
+	ctx, cancel := context.WithCancel(directMessages.ctx)
+	directMessages.cancel, directMessages.topic = cancel, topic
+	startSubscription(ctx, topic, router.Route)
+}
+
+// OwnerKeyStatus is the key pinned for an owner and the other key announced
+// for it, if any
+type OwnerKeyStatus struct {
+	Owner     GUID       `json:"owner"`
+	PublicKey []byte     `json:"publicKey"`
+	Change    *KeyChange `json:"change,omitempty"`
+}
+
+func getOwnerKeys(c *gin.Context) {
+	pinnedKeysMu.RLock()
+	list := make([]OwnerKeyStatus, 0, len(pinnedKeys))
+	for owner, key := range pinnedKeys {
+		status := OwnerKeyStatus{Owner: owner, PublicKey: key}
+		if change, ok := keyChanges[owner]; ok {
+			status.Change = &change
+		}
+		list = append(list, status)
+	}
+	pinnedKeysMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Owner < list[j].Owner })
+	c.JSON(http.StatusOK, list)
+}
+
+// updateOwnerKey pins another key for an owner, typically the change a node
+// of the owner announced
+func updateOwnerKey(c *gin.Context) {
+	owner := GUID(c.Param("guid"))
+	var req struct {
+		PublicKey []byte `json:"publicKey"`
+	}
+	if err := c.BindJSON(&req); err != nil || len(req.PublicKey) != 32 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "publicKey must be a base64 encoded 32 byte key"})
+		return
+	}
+
+	pinnedKeysMu.Lock()
+	pinnedKeys[owner] = req.PublicKey
+	if change, ok := keyChanges[owner]; ok && bytes.Equal(change.PublicKey, req.PublicKey) {
+		delete(keyChanges, owner)
+	}
+	pinnedKeysMu.Unlock()
+	persister.MarkDirty(pinnedKeysPath)
+	log.Printf("Pinned a new key for owner %s", owner)
+	c.JSON(http.StatusOK, OwnerKeyStatus{Owner: owner, PublicKey: req.PublicKey})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// resetDirectMessages sets up an owner with a key and empty inbox and key
+// pins
+func resetDirectMessages(t *testing.T, owner GUID) {
+	t.Helper()
+	resetState(t)
+	ownerMu.Lock()
+	ownerGUID = owner
+	ownerMu.Unlock()
+	if err := updateOwnerKeyring(context.Background()); err != nil {
+		t.Fatalf("updateOwnerKeyring: %v", err)
+	}
+}
+
+func newBoxKey(t *testing.T) (public, private *[32]byte) {
+	t.Helper()
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return public, private
+}
+
+// sealFrom seals text from a sender to the current owner
+func sealFrom(t *testing.T, id string, from GUID, public, private *[32]byte, text string) SealedMessage {
+	t.Helper()
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	ownerMu.RLock()
+	to, recipient := ownerGUID, ownerPublicKey
+	ownerMu.RUnlock()
+	return SealedMessage{ID: id, From: from, To: to, SenderKey: public[:], Nonce: nonce[:],
+		Box: box.Seal(nil, []byte(text), &nonce, recipient, private), SentAt: time.Now()}
+}
+
+func TestPinOwnerKey(t *testing.T) {
+	resetDirectMessages(t, "us")
+	first, second := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+
+	steps := []struct {
+		name       string
+		peer       PeerID
+		key        []byte
+		wantPinned []byte
+		wantChange []byte
+	}{
+		{name: "first key is pinned", peer: "a", key: first, wantPinned: first},
+		{name: "same key again", peer: "a", key: first, wantPinned: first},
+		{name: "other key is not believed", peer: "b", key: second, wantPinned: first, wantChange: second},
+		{name: "invalid key is ignored", peer: "b", key: []byte("short"), wantPinned: first, wantChange: second},
+	}
+	for _, step := range steps {
+		addOrUpdatePeer(context.Background(), step.peer, "them", step.key)
+		key, ok := recipientKey("them")
+		if !ok || !bytes.Equal(key[:], step.wantPinned) {
+			t.Errorf("%s: recipient key %x, want %x", step.name, key, step.wantPinned)
+		}
+		if change := keyChanges["them"]; !bytes.Equal(change.PublicKey, step.wantChange) {
+			t.Errorf("%s: key change %x, want %x", step.name, change.PublicKey, step.wantChange)
+		}
+	}
+}
+
+func TestOwnerChangeKeepsOldKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resetDirectMessages(t, "first")
+	subscribeDirectMessages(ctx)
+	t.Cleanup(func() {
+		directMessages.Lock()
+		directMessages.ctx, directMessages.cancel, directMessages.topic = nil, nil, ""
+		directMessages.Unlock()
+	})
+
+	public, private := newBoxKey(t)
+	firstKey := *ownerPublicKey
+	m := &InboxMessage{SealedMessage: sealFrom(t, "m", "sender", public, private, "hello")}
+
+	if err := adoptOwner(ctx, "second"); err != nil {
+		t.Fatalf("adoptOwner: %v", err)
+	}
+	if *ownerPublicKey == firstKey {
+		t.Error("the new owner kept the key of the previous one")
+	}
+	if text, err := m.open(); err != nil || string(text) != "hello" {
+		t.Errorf("opening a message to the previous owner: got %q, %v", text, err)
+	}
+
+	subscriptionsMu.RLock()
+	_, old := subscriptions[directMessageTopic("first")]
+	_, current := subscriptions[directMessageTopic("second")]
+	subscriptionsMu.RUnlock()
+	if old || !current {
+		t.Errorf("subscribed to the topic of the previous owner: %v, of the new one: %v", old, current)
+	}
+
+	if err := adoptOwner(ctx, "first"); err != nil {
+		t.Fatalf("adoptOwner: %v", err)
+	}
+	if *ownerPublicKey != firstKey {
+		t.Error("the previous owner did not get its key back")
+	}
+}
+
+func TestInboxLimit(t *testing.T) {
+	resetDirectMessages(t, "us")
+	config.InboxLimit = 2
+	const sender = PeerID("sender")
+	public, private := newBoxKey(t)
+	addOrUpdatePeer(context.Background(), sender, "them", public[:])
+
+	read := time.Now()
+	inbox["read"] = &InboxMessage{SealedMessage: SealedMessage{ID: "read"}, ReceivedAt: read.Add(-time.Hour), ReadAt: &read}
+	inbox["unread"] = &InboxMessage{SealedMessage: SealedMessage{ID: "unread"}, ReceivedAt: read.Add(-time.Hour)}
+
+	steps := []struct {
+		id   string
+		want []string
+	}{
+		// The read message makes room
+		{id: "first", want: []string{"first", "unread"}},
+		// Nothing read is left to drop
+		{id: "second", want: []string{"first", "unread"}},
+	}
+	for _, step := range steps {
+		handleDirectMessage(context.Background(), sender, sealFrom(t, step.id, "them", public, private, "hello"))
+		if got := sortedKeys(inbox); !slices.Equal(got, step.want) {
+			t.Errorf("after %s: inbox holds %v, want %v", step.id, got, step.want)
+		}
+	}
+}
+
+func TestDirectMessageAfterIndexPull(t *testing.T) {
+	resetDirectMessages(t, "us")
+	local := node.(*MemoryNode)
+	remote := newRemoteNode(t, local)
+
+	public, private := newBoxKey(t)
+	addOrUpdatePeer(context.Background(), remote.id, "them", public[:])
+	publishIndex(t, remote, PeerIndex{PeerID: remote.id, OwnerGUID: "them"}, nil)
+	if _, _, err := pullPeerIndex(context.Background(), remote.id); err != nil {
+		t.Fatalf("pullPeerIndex: %v", err)
+	}
+
+	handleDirectMessage(context.Background(), remote.id, sealFrom(t, "m", "them", public, private, "hello"))
+	if _, ok := inbox["m"]; !ok {
+		t.Error("direct message sent after pulling the index of its peer was rejected")
+	}
+}
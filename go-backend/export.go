@@ -0,0 +1,779 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gocid "github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// An export is a CARv1 archive whose single root is a DAG-JSON manifest. The
+// manifest links every local concept with its retained history, every known
+// relationship and a JSON snapshot of the peer list. The archive carries all
+// blocks needed to rebuild the node, including concept content.
+
+const (
+	exportFormat  = "kudo-network-export"
+	exportVersion = 1
+)
+
+var errInvalidArchive = errors.New("invalid archive")
+
+type exportManifest struct {
+	PeerID        PeerID
+	OwnerGUID     GUID
+	ExportedAt    time.Time
+	Concepts      map[GUID]CID
+	History       map[GUID][]CID
+	Relationships map[GUID]CID
+	Peers         CID
+}
+
+// ExportReport summarizes a written archive
+type ExportReport struct {
+	Root          CID `json:"root"`
+	Concepts      int `json:"concepts"`
+	Versions      int `json:"versions"`
+	Relationships int `json:"relationships"`
+	Blocks        int `json:"blocks"`
+}
+
+// ImportReport summarizes what an archive added to the node
+type ImportReport struct {
+	Root          CID    `json:"root"`
+	PeerID        PeerID `json:"peerID"`
+	OwnerGUID     GUID   `json:"ownerGUID"`
+	Concepts      int    `json:"concepts"`
+	Versions      int    `json:"versions"`
+	Relationships int    `json:"relationships"`
+	Peers         int    `json:"peers"`
+	Blocks        int    `json:"blocks"`
+	// OwnerAdopted is set when the owner of the archive became the owner of
+	// this node
+	OwnerAdopted bool `json:"ownerAdopted"`
+}
+
+func sortedKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func cidLink(cid CID) (datamodel.Link, error) {
+	c, err := gocid.Decode(string(cid))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CID %s: %v", cid, err)
+	}
+	return cidlink.Link{Cid: c}, nil
+}
+
+func encodeManifest(m *exportManifest) ([]byte, error) {
+	var linkErr error
+	link := func(cid CID) qp.Assemble {
+		l, err := cidLink(cid)
+		if err != nil {
+			linkErr = err
+			return qp.Null()
+		}
+		return qp.Link(l)
+	}
+
+	data, err := encodeDAG(func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "Format", qp.String(exportFormat))
+		qp.MapEntry(ma, "Version", qp.Int(exportVersion))
+		qp.MapEntry(ma, "PeerID", qp.String(string(m.PeerID)))
+		qp.MapEntry(ma, "OwnerGUID", qp.String(string(m.OwnerGUID)))
+		qp.MapEntry(ma, "ExportedAt", qp.String(m.ExportedAt.UTC().Format(time.RFC3339Nano)))
+		qp.MapEntry(ma, "Concepts", qp.Map(int64(len(m.Concepts)), func(ma datamodel.MapAssembler) {
+			for _, guid := range sortedKeys(m.Concepts) {
+				qp.MapEntry(ma, string(guid), link(m.Concepts[guid]))
+			}
+		}))
+		qp.MapEntry(ma, "History", qp.Map(int64(len(m.History)), func(ma datamodel.MapAssembler) {
+			for _, guid := range sortedKeys(m.History) {
+				versions := m.History[guid]
+				qp.MapEntry(ma, string(guid), qp.List(int64(len(versions)), func(la datamodel.ListAssembler) {
+					for _, cid := range versions {
+						qp.ListEntry(la, link(cid))
+					}
+				}))
+			}
+		}))
+		qp.MapEntry(ma, "Relationships", qp.Map(int64(len(m.Relationships)), func(ma datamodel.MapAssembler) {
+			for _, id := range sortedKeys(m.Relationships) {
+				qp.MapEntry(ma, string(id), link(m.Relationships[id]))
+			}
+		}))
+		qp.MapEntry(ma, "Peers", link(m.Peers))
+	})
+	if linkErr != nil {
+		return nil, linkErr
+	}
+	return data, err
+}
+
+func decodeManifest(data []byte) (*exportManifest, error) {
+	n, err := decodeDAG(data)
+	if err != nil {
+		return nil, err
+	}
+	f := dagFields{n: n}
+	if format := f.String("Format"); f.err == nil && format != exportFormat {
+		return nil, fmt.Errorf("not a %s manifest", exportFormat)
+	}
+	if version := f.Int("Version"); f.err == nil && version != exportVersion {
+		return nil, fmt.Errorf("unsupported export version %d", version)
+	}
+	m := &exportManifest{
+		PeerID:        PeerID(f.String("PeerID")),
+		OwnerGUID:     GUID(f.String("OwnerGUID")),
+		ExportedAt:    f.Time("ExportedAt"),
+		Concepts:      make(map[GUID]CID),
+		History:       make(map[GUID][]CID),
+		Relationships: make(map[GUID]CID),
+		Peers:         f.Link("Peers"),
+	}
+	for guid, cid := range f.LinkMap("Concepts") {
+		m.Concepts[GUID(guid)] = cid
+	}
+	for guid, versions := range f.LinkLists("History") {
+		m.History[GUID(guid)] = versions
+	}
+	for id, cid := range f.LinkMap("Relationships") {
+		m.Relationships[GUID(id)] = cid
+	}
+	if f.err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", f.err)
+	}
+	return m, nil
+}
+
+// exportCAR writes the local graph to w as a CAR archive
+func exportCAR(ctx context.Context, w io.Writer) (ExportReport, error) {
+	var report ExportReport
+
+	conceptMu.RLock()
+	heads := maps.Clone(GUID2CID)
+	conceptMu.RUnlock()
+
+	conceptVersionsMu.RLock()
+	history := make(map[GUID][]CID, len(conceptVersions))
+	for guid, versions := range conceptVersions {
+		if _, ok := heads[guid]; ok {
+			history[guid] = slices.Clone(versions)
+		}
+	}
+	conceptVersionsMu.RUnlock()
+
+	manifest := &exportManifest{
+		PeerID:        peerID,
+		ExportedAt:    time.Now(),
+		Concepts:      heads,
+		History:       history,
+		Relationships: make(map[GUID]CID),
+	}
+	relationshipMu.RLock()
+	for id, cid := range relationship2CID {
+		manifest.Relationships[id] = cid
+	}
+	relationshipMu.RUnlock()
+
+	peerMapMu.RLock()
+	peers, err := json.Marshal(peerMap)
+	peerMapMu.RUnlock()
+	if err != nil {
+		return report, fmt.Errorf("failed to encode peer list: %v", err)
+	}
+	peersCID, err := newCID(gocid.Raw, peers)
+	if err != nil {
+		return report, err
+	}
+	manifest.Peers = CID(peersCID.String())
+
+	ownerMu.RLock()
+	manifest.OwnerGUID = ownerGUID
+	ownerMu.RUnlock()
+
+	data, err := encodeManifest(manifest)
+	if err != nil {
+		return report, fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	root, err := newCID(gocid.DagJSON, data)
+	if err != nil {
+		return report, err
+	}
+	report.Root = CID(root.String())
+
+	cw, err := newCARWriter(w, []gocid.Cid{root})
+	if err != nil {
+		return report, err
+	}
+	seen := make(map[gocid.Cid]bool)
+	write := func(c gocid.Cid, data []byte) error {
+		if seen[c] {
+			return nil
+		}
+		seen[c] = true
+		report.Blocks++
+		return cw.WriteBlock(c, data)
+	}
+
+	if err := write(root, data); err != nil {
+		return report, err
+	}
+	if err := write(peersCID, peers); err != nil {
+		return report, err
+	}
+
+	get := func(c gocid.Cid) ([]byte, error) { return node.GetBlock(ctx, CID(c.String())) }
+	for _, id := range sortedKeys(manifest.Relationships) {
+		c, err := gocid.Decode(string(manifest.Relationships[id]))
+		if err != nil {
+			return report, fmt.Errorf("invalid CID for relationship %s: %v", id, err)
+		}
+		data, err := get(c)
+		if err != nil {
+			return report, fmt.Errorf("failed to export relationship %s: %v", id, err)
+		}
+		if err := write(c, data); err != nil {
+			return report, err
+		}
+		report.Relationships++
+	}
+	exportFile := func(root gocid.Cid) error {
+		return walkUnixFSFile(ctx, root, get, func(c gocid.Cid, data, _ []byte) error {
+			return write(c, data)
+		})
+	}
+	exportConcept := func(cid CID) error {
+		c, err := gocid.Decode(string(cid))
+		if err != nil {
+			return fmt.Errorf("invalid CID %s: %v", cid, err)
+		}
+		if c.Type() != gocid.DagJSON {
+			// Concepts stored before the DAG encoding are UnixFS files
+			return exportFile(c)
+		}
+		data, err := get(c)
+		if err != nil {
+			return err
+		}
+		if err := write(c, data); err != nil {
+			return err
+		}
+		concept, err := decodeConcept(data)
+		if err != nil {
+			return err
+		}
+		if concept.Content == nil {
+			return nil
+		}
+		content, err := gocid.Decode(string(concept.Content.CID))
+		if err != nil {
+			return fmt.Errorf("invalid content CID %s: %v", concept.Content.CID, err)
+		}
+		return exportFile(content)
+	}
+
+	for _, guid := range sortedKeys(heads) {
+		if err := exportConcept(heads[guid]); err != nil {
+			return report, fmt.Errorf("failed to export concept %s: %v", guid, err)
+		}
+		report.Concepts++
+		for _, cid := range history[guid] {
+			if err := exportConcept(cid); err != nil {
+				return report, fmt.Errorf("failed to export version %s of %s: %v", cid, guid, err)
+			}
+			report.Versions++
+		}
+	}
+	return report, cw.Flush()
+}
+
+// blockSpool keeps the blocks of an archive being imported in a temporary
+// file, so only their offsets are held in memory
+type blockSpool struct {
+	f      *os.File
+	size   int64
+	blocks map[gocid.Cid][2]int64
+}
+
+func newBlockSpool() (*blockSpool, error) {
+	f, err := os.CreateTemp("", "kudo-import-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create import spool: %v", err)
+	}
+	return &blockSpool{f: f, blocks: make(map[gocid.Cid][2]int64)}, nil
+}
+
+func (s *blockSpool) put(b Block) error {
+	if _, ok := s.blocks[b.CID]; ok {
+		return nil
+	}
+	if _, err := s.f.Write(b.Data); err != nil {
+		return fmt.Errorf("failed to spool block %s: %v", b.CID, err)
+	}
+	s.blocks[b.CID] = [2]int64{s.size, int64(len(b.Data))}
+	s.size += int64(len(b.Data))
+	return nil
+}
+
+func (s *blockSpool) get(c gocid.Cid) ([]byte, error) {
+	at, ok := s.blocks[c]
+	if !ok {
+		return nil, fmt.Errorf("%w: block %s is missing", errInvalidArchive, c)
+	}
+	data := make([]byte, at[1])
+	if _, err := s.f.ReadAt(data, at[0]); err != nil {
+		return nil, fmt.Errorf("failed to read spooled block %s: %v", c, err)
+	}
+	return data, nil
+}
+
+func (s *blockSpool) Close() error {
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
+
+// importCAR reads an archive written by exportCAR and merges it into the
+// node. Every block is checked against its CID before anything is stored.
+// Imported concepts replace local versions with the same GUID. The owner of
+// the archive only replaces ours with adopt set.
+func importCAR(ctx context.Context, r io.Reader, adopt bool) (ImportReport, error) {
+	var report ImportReport
+
+	cr, err := newCARReader(r)
+	if err != nil {
+		return report, fmt.Errorf("%w: %v", errInvalidArchive, err)
+	}
+	if len(cr.Roots) != 1 {
+		return report, fmt.Errorf("%w: expected one root, found %d", errInvalidArchive, len(cr.Roots))
+	}
+	spool, err := newBlockSpool()
+	if err != nil {
+		return report, err
+	}
+	defer spool.Close()
+	for {
+		block, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+		if err := spool.put(block); err != nil {
+			return report, err
+		}
+	}
+	report.Blocks = len(spool.blocks)
+	get := spool.get
+
+	root := cr.Roots[0]
+	report.Root = CID(root.String())
+	data, err := get(root)
+	if err != nil {
+		return report, err
+	}
+	manifest, err := decodeManifest(data)
+	if err != nil {
+		return report, fmt.Errorf("%w: %v", errInvalidArchive, err)
+	}
+	report.PeerID = manifest.PeerID
+	report.OwnerGUID = manifest.OwnerGUID
+
+	// Decode everything before touching the node, so a broken archive
+	// leaves no partial state behind
+	concepts := make(map[CID]*Concept)
+	for guid, head := range manifest.Concepts {
+		for _, cid := range append([]CID{head}, manifest.History[guid]...) {
+			c, err := importedConcept(ctx, cid, get)
+			if err != nil {
+				return report, fmt.Errorf("%w: concept %s: %v", errInvalidArchive, guid, err)
+			}
+			if c.GUID != guid {
+				return report, fmt.Errorf("%w: %s is not a version of %s", errInvalidArchive, cid, guid)
+			}
+			concepts[cid] = c
+		}
+	}
+	relationships := make(RelationshipMap, len(manifest.Relationships))
+	for id, cid := range manifest.Relationships {
+		c, err := gocid.Decode(string(cid))
+		if err != nil {
+			return report, fmt.Errorf("%w: invalid CID %s", errInvalidArchive, cid)
+		}
+		data, err := get(c)
+		if err != nil {
+			return report, err
+		}
+		rel, err := decodeRelationship(data)
+		if err != nil || rel.ID != id {
+			return report, fmt.Errorf("%w: relationship %s: %v", errInvalidArchive, id, err)
+		}
+		relationships[id] = rel
+	}
+	peers := make(PeerMap)
+	if manifest.Peers != "" {
+		c, err := gocid.Decode(string(manifest.Peers))
+		if err != nil {
+			return report, fmt.Errorf("%w: invalid CID %s", errInvalidArchive, manifest.Peers)
+		}
+		data, err := get(c)
+		if err != nil {
+			return report, err
+		}
+		if err := json.Unmarshal(data, &peers); err != nil {
+			return report, fmt.Errorf("%w: peer list: %v", errInvalidArchive, err)
+		}
+	}
+
+	// Store the blocks
+	for cid, concept := range concepts {
+		if err := storeImportedConcept(ctx, cid, concept, get); err != nil {
+			return report, err
+		}
+	}
+	for id, cid := range manifest.Relationships {
+		c, _ := gocid.Decode(string(cid))
+		data, err := get(c)
+		if err != nil {
+			return report, err
+		}
+		if _, err := storeRelationshipBlock(ctx, data); err != nil {
+			return report, fmt.Errorf("relationship %s: %v", id, err)
+		}
+	}
+
+	// Rebuild the in-memory state
+	conceptUpdateMu.Lock()
+	defer conceptUpdateMu.Unlock()
+
+	var released []CID
+	conceptMu.Lock()
+	for guid, head := range manifest.Concepts {
+		if prev, ok := GUID2CID[guid]; ok && prev != head {
+			released = append(released, prev)
+		}
+		conceptMap[guid] = concepts[head]
+		GUID2CID[guid] = head
+	}
+	conceptMu.Unlock()
+	report.Concepts = len(manifest.Concepts)
+
+	conceptVersionsMu.Lock()
+	for guid := range manifest.Concepts {
+		released = append(released, dropVersionContent(conceptVersions[guid])...)
+		if versions := manifest.History[guid]; len(versions) > 0 {
+			conceptVersions[guid] = slices.Clone(versions)
+			for _, cid := range versions {
+				if content := concepts[cid].contentCID(); content != "" {
+					versionContent[cid] = content
+				}
+			}
+			report.Versions += len(versions)
+		} else {
+			delete(conceptVersions, guid)
+		}
+	}
+	conceptVersionsMu.Unlock()
+
+	relationshipMu.Lock()
+	for id, rel := range relationships {
+		cid := manifest.Relationships[id]
+		if prev, ok := relationship2CID[id]; ok && prev != cid {
+			released = append(released, prev)
+		}
+		relationshipMap[id] = rel
+		relationship2CID[id] = cid
+	}
+	relationshipMu.Unlock()
+	report.Relationships = len(relationships)
+
+	peerMapMu.Lock()
+	self := peerMap[peerID]
+	for _, cid := range released {
+		self.RemoveCID(cid)
+	}
+	for _, head := range manifest.Concepts {
+		self.AddCID(head)
+	}
+	for id, peer := range peers {
+		// The exporting peer is the one being restored, not a remote
+		if id == peerID || id == manifest.PeerID {
+			continue
+		}
+		if _, exists := peerMap[id]; !exists {
+			peerMap[id] = peer
+			report.Peers++
+		}
+	}
+	peerMapMu.Unlock()
+
+	ownerMu.RLock()
+	owner := ownerGUID
+	ownerMu.RUnlock()
+	switch {
+	case manifest.OwnerGUID == "" || manifest.OwnerGUID == owner:
+	case adopt:
+		if err := adoptOwner(ctx, manifest.OwnerGUID); err != nil {
+			return report, err
+		}
+		report.OwnerAdopted = true
+	default:
+		log.Printf("Keeping owner %s, the archive belongs to %s", owner, manifest.OwnerGUID)
+	}
+
+	persister.MarkDirty(GUID2CIDPath)
+	persister.MarkDirty(conceptsPath)
+	persister.MarkDirty(historyPath)
+	persister.MarkDirty(relationshipIndexPath)
+	persister.MarkDirty(peerListPath)
+
+	for _, cid := range released {
+		releasePin(ctx, cid)
+	}
+	log.Printf("Imported %d concepts, %d versions and %d relationships from %s", report.Concepts, report.Versions, report.Relationships, report.Root)
+	return report, nil
+}
+
+// importedConcept decodes a concept from the archive blocks
+func importedConcept(ctx context.Context, cid CID, get func(gocid.Cid) ([]byte, error)) (*Concept, error) {
+	c, err := gocid.Decode(string(cid))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CID %s: %v", cid, err)
+	}
+	concept := &Concept{}
+	if c.Type() == gocid.DagJSON {
+		data, err := get(c)
+		if err != nil {
+			return nil, err
+		}
+		if concept, err = decodeConcept(data); err != nil {
+			return nil, err
+		}
+	} else {
+		var buf bytes.Buffer
+		if err := readUnixFSFile(ctx, c, get, &buf); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(buf.Bytes(), concept); err != nil {
+			return nil, err
+		}
+	}
+	concept.CID = cid
+	return concept, nil
+}
+
+// storeImportedConcept stores and pins a concept and its content
+func storeImportedConcept(ctx context.Context, cid CID, concept *Concept, get func(gocid.Cid) ([]byte, error)) error {
+	c, _ := gocid.Decode(string(cid))
+	if c.Type() != gocid.DagJSON {
+		return storeImportedFile(ctx, c, get)
+	}
+
+	data, _ := get(c)
+	stored, err := node.PutBlock(ctx, gocid.DagJSON, data, true)
+	if err != nil {
+		return fmt.Errorf("failed to store concept %s: %v", concept.GUID, err)
+	}
+	if stored != cid {
+		return fmt.Errorf("concept %s was stored as %s instead of %s", concept.GUID, stored, cid)
+	}
+	trackPin(cid)
+
+	if concept.Content == nil {
+		return nil
+	}
+	content, err := gocid.Decode(string(concept.Content.CID))
+	if err != nil {
+		return fmt.Errorf("%w: invalid content CID %s", errInvalidArchive, concept.Content.CID)
+	}
+	return storeImportedFile(ctx, content, get)
+}
+
+// storeImportedFile adds a UnixFS file from the archive blocks. The file is
+// added again rather than copied block by block, so it must come out with
+// the same CID.
+func storeImportedFile(ctx context.Context, root gocid.Cid, get func(gocid.Cid) ([]byte, error)) error {
+	var buf bytes.Buffer
+	if err := readUnixFSFile(ctx, root, get, &buf); err != nil {
+		return fmt.Errorf("%w: file %s: %v", errInvalidArchive, root, err)
+	}
+	want := CID(root.String())
+	if computed, err := computeCID(buf.Bytes()); err != nil || computed != want {
+		return fmt.Errorf("file %s was not added with the default chunking and cannot be imported", root)
+	}
+	cid, err := node.Add(ctx, &buf)
+	if err != nil {
+		return fmt.Errorf("failed to add file %s: %v", root, err)
+	}
+	if cid != want {
+		return fmt.Errorf("file %s was added as %s", root, cid)
+	}
+	trackPin(cid)
+	return nil
+}
+
+// adoptOwner makes guid the owner of this node. A previous owner concept
+// that was never related to anything was only a placeholder and is dropped.
+func adoptOwner(ctx context.Context, guid GUID) error {
+	ownerMu.Lock()
+	prev := ownerGUID
+	ownerGUID = guid
+	ownerMu.Unlock()
+	if prev == guid {
+		return nil
+	}
+	if err := node.Save(ctx, ownerGUIDPath, guid); err != nil {
+		return fmt.Errorf("failed to save owner GUID: %v", err)
+	}
+
+	var dropped CID
+	conceptMu.Lock()
+	if c, ok := conceptMap[prev]; ok && len(c.Relationships) == 0 {
+		dropped = GUID2CID[prev]
+		delete(conceptMap, prev)
+		delete(GUID2CID, prev)
+	}
+	conceptMu.Unlock()
+
+	peerMapMu.Lock()
+	if self, ok := peerMap[peerID].(*Peer); ok {
+		self.OwnerGUID = guid
+		if dropped != "" {
+			self.RemoveCID(dropped)
+		}
+	}
+	peerMapMu.Unlock()
+
+	if dropped != "" {
+		forgetVersions(prev)
+		releasePin(ctx, dropped)
+	}
+	log.Printf("Owner GUID changed from %s to %s", prev, guid)
+
+	// The key of the previous owner is kept to open the messages sent to it
+	if err := updateOwnerKeyring(ctx); err != nil {
+		return err
+	}
+	resubscribeDirectMessages()
+	return nil
+}
+
+// exportGraph writes the archive to a temporary file first, so a failure
+// is reported as an error instead of a truncated archive
+func exportGraph(c *gin.Context) {
+	f, err := os.CreateTemp("", "kudo-export-*.car")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	report, err := exportCAR(c.Request.Context(), f)
+	if err != nil {
+		log.Printf("Export failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.DataFromReader(http.StatusOK, size, "application/vnd.ipld.car; version=1", f, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=\"kudo-%s.car\"", peerID),
+	})
+	log.Printf("Exported %d concepts and %d relationships in %d blocks", report.Concepts, report.Relationships, report.Blocks)
+}
+
+func importGraph(c *gin.Context) {
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, int64(config.MaxImportSize))
+	report, err := importCAR(c.Request.Context(), body, c.Query("adopt-owner") == "true")
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Archive too large"})
+	case errors.Is(err, errInvalidArchive):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// runCommand runs a one-shot command instead of serving the API
+func runCommand(ctx context.Context, args []string) error {
+	usage := fmt.Errorf("usage: export FILE | import [-adopt-owner] FILE")
+	if len(args) == 0 {
+		return usage
+	}
+	name := args[0]
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	adopt := fs.Bool("adopt-owner", false, "make the owner of the archive the owner of this node")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 || (*adopt && name != "import") {
+		return usage
+	}
+	file := fs.Arg(0)
+	switch name {
+	case "export":
+		w := os.Stdout
+		if file != "-" {
+			f, err := os.Create(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		report, err := exportCAR(ctx, w)
+		if err != nil {
+			return err
+		}
+		log.Printf("Exported %d concepts, %d versions and %d relationships in %d blocks, root %s",
+			report.Concepts, report.Versions, report.Relationships, report.Blocks, report.Root)
+		if w != os.Stdout {
+			return w.Close()
+		}
+		return nil
+	case "import":
+		r := os.Stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		_, err := importCAR(ctx, r, *adopt)
+		return err
+	default:
+		return fmt.Errorf("unknown command: %s", name)
+	}
+}
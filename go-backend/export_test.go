@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportTestGraph stores a concept related to another and exports them
+func exportTestGraph(t *testing.T) []byte {
+	t.Helper()
+	ctx := context.Background()
+	resetState(t)
+	ownerGUID = "exporter"
+
+	source, target, id := GUID("source"), GUID("target"), GUID("relationship")
+	for _, guid := range []GUID{source, target} {
+		if err := addOrUpdateConcept(ctx, &Concept{GUID: guid, Name: string(guid), Timestamp: time.Now()}); err != nil {
+			t.Fatalf("addOrUpdateConcept: %v", err)
+		}
+	}
+	relationshipMap[id] = &Relationship{ID: id, SourceID: source, TargetID: target, EnergyFlow: 1, Timestamp: time.Now()}
+	if err := appendRelationship(ctx, source, id); err != nil {
+		t.Fatalf("appendRelationship: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := exportCAR(ctx, &buf); err != nil {
+		t.Fatalf("exportCAR: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportCAR(t *testing.T) {
+	tests := []struct {
+		name      string
+		adopt     bool
+		wantOwner GUID
+	}{
+		{name: "keeps the owner", adopt: false, wantOwner: "importer"},
+		{name: "adopts the owner when asked", adopt: true, wantOwner: "exporter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := exportTestGraph(t)
+
+			resetState(t)
+			ownerGUID = "importer"
+			report, err := importCAR(context.Background(), bytes.NewReader(archive), tt.adopt)
+			if err != nil {
+				t.Fatalf("importCAR: %v", err)
+			}
+			if report.Concepts != 2 || report.Relationships != 1 || report.OwnerAdopted != tt.adopt {
+				t.Errorf("got report %+v", report)
+			}
+			if ownerGUID != tt.wantOwner {
+				t.Errorf("owner is %s, want %s", ownerGUID, tt.wantOwner)
+			}
+			if c := conceptMap["source"]; c == nil || len(c.Relationships) != 1 {
+				t.Errorf("source concept not restored: %+v", c)
+			}
+			if _, ok := relationshipMap["relationship"]; !ok {
+				t.Error("relationship not restored")
+			}
+		})
+	}
+}
+
+func TestImportCARRejectsTruncatedArchive(t *testing.T) {
+	archive := exportTestGraph(t)
+
+	resetState(t)
+	if _, err := importCAR(context.Background(), bytes.NewReader(archive[:len(archive)-10]), false); err == nil {
+		t.Fatal("truncated archive imported")
+	}
+	if len(conceptMap) != 0 || len(relationshipMap) != 0 {
+		t.Errorf("truncated archive left %d concepts and %d relationships", len(conceptMap), len(relationshipMap))
+	}
+}
+
+func TestExportGraphReportsFailure(t *testing.T) {
+	resetState(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/export.car", exportGraph)
+
+	// A concept whose block is missing fails the export
+	GUID2CID["missing"] = "bagaaierasords4njcts6vs7qvdjfcvgnume4hqohf65zsfguprqphs3icwea"
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/export.car", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+
+	delete(GUID2CID, "missing")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/export.car", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") == "" {
+		t.Errorf("got status %d with length %q", rec.Code, rec.Header().Get("Content-Length"))
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	gocid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// FilesystemNode implements the Node_i interface on top of a local data
+// directory, for single-node installations that cannot run an IPFS daemon.
+// Blocks are laid out exactly as `ipfs add --cid-version=1` would produce
+// them, and MFS-style paths map to files under the mfs directory.
+type FilesystemNode struct {
+	dir string
+	id  PeerID
+	key crypto.PrivKey
+
+	// Pubsub only reaches subscribers inside this process
+	hub *MemoryHub
+}
+
+func NewFilesystemNode(dir string) (*FilesystemNode, error) {
+	for _, sub := range []string{"blocks", "pins", "mfs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory: %v", err)
+		}
+	}
+
+	f := &FilesystemNode{dir: dir, hub: NewMemoryHub()}
+	if err := f.loadOrCreateIdentity(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FilesystemNode) loadOrCreateIdentity() error {
+	identityPath := filepath.Join(f.dir, "identity.json")
+	var identity struct {
+		ID  PeerID `json:"id"`
+		Key []byte `json:"key,omitempty"`
+	}
+
+	data, err := os.ReadFile(identityPath)
+	if err == nil {
+		if err := json.Unmarshal(data, &identity); err != nil {
+			return fmt.Errorf("failed to decode identity: %v", err)
+		}
+		if len(identity.Key) > 0 {
+			f.id = identity.ID
+			if f.key, err = crypto.UnmarshalPrivateKey(identity.Key); err != nil {
+				return fmt.Errorf("failed to decode identity key: %v", err)
+			}
+			return nil
+		}
+		// Identities created before messages were signed have no key. Their
+		// ID was not derived from a key either, so nothing we sign could be
+		// verified against it and the whole identity is replaced.
+		f.key, f.id = newNodeKey()
+		log.Printf("Replaced node identity %s without a key by %s", identity.ID, f.id)
+	} else if os.IsNotExist(err) {
+		f.key, f.id = newNodeKey()
+		log.Printf("Generated new node identity: %s", f.id)
+	} else {
+		return fmt.Errorf("failed to read identity: %v", err)
+	}
+
+	identity.ID = f.id
+	if identity.Key, err = crypto.MarshalPrivateKey(f.key); err != nil {
+		return fmt.Errorf("failed to marshal identity key: %v", err)
+	}
+	data, err = json.Marshal(identity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal identity: %v", err)
+	}
+	if err := writeFileAtomic(identityPath, data); err != nil {
+		return fmt.Errorf("failed to write identity: %v", err)
+	}
+	return nil
+}
+
+func (f *FilesystemNode) blockPath(c gocid.Cid) string {
+	return filepath.Join(f.dir, "blocks", c.String())
+}
+
+func (f *FilesystemNode) pinPath(cid CID) string {
+	return filepath.Join(f.dir, "pins", string(cid))
+}
+
+func (f *FilesystemNode) mfsPath(p string) string {
+	return filepath.Join(f.dir, "mfs", filepath.FromSlash(path.Clean("/"+p)))
+}
+
+func (f *FilesystemNode) Add(ctx context.Context, content io.Reader) (CID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to read content: %v", err)
+	}
+	root, blocks, err := buildUnixFSFile(data)
+	if err != nil {
+		return "", err
+	}
+
+	for _, block := range blocks {
+		if _, err := os.Stat(f.blockPath(block.CID)); err == nil {
+			continue
+		}
+		if err := writeFileAtomic(f.blockPath(block.CID), block.Data); err != nil {
+			return "", fmt.Errorf("failed to write block: %v", err)
+		}
+	}
+
+	cid := CID(root.String())
+	if err := os.WriteFile(f.pinPath(cid), nil, 0o644); err != nil {
+		return "", fmt.Errorf("failed to pin content: %v", err)
+	}
+	return cid, nil
+}
+
+func (f *FilesystemNode) Get(ctx context.Context, cid CID) (io.ReadCloser, error) {
+	root, err := gocid.Decode(string(cid))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CID %s: %v", cid, err)
+	}
+
+	var buf bytes.Buffer
+	if err := readUnixFSFile(ctx, root, f.readBlock, &buf); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&buf), nil
+}
+
+func (f *FilesystemNode) readBlock(c gocid.Cid) ([]byte, error) {
+	data, err := os.ReadFile(f.blockPath(c))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("content not found: %s", c)
+		}
+		return nil, fmt.Errorf("failed to read block %s: %v", c, err)
+	}
+	return data, nil
+}
+
+// Remove unpins content. As with an IPFS repo, the blocks stay on disk
+// until garbage collected.
+func (f *FilesystemNode) Remove(ctx context.Context, cid CID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.Remove(f.pinPath(cid)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("not pinned: %s", cid)
+		}
+		return fmt.Errorf("failed to unpin %s: %v", cid, err)
+	}
+	return nil
+}
+
+func (f *FilesystemNode) List(ctx context.Context) ([]CID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(f.dir, "pins"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pins: %v", err)
+	}
+	ret := make([]CID, 0, len(entries))
+	for _, entry := range entries {
+		ret = append(ret, CID(entry.Name()))
+	}
+	return ret, nil
+}
+
+func (f *FilesystemNode) PutBlock(ctx context.Context, codec uint64, data []byte, pin bool) (CID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	c, err := newCID(codec, data)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(f.blockPath(c)); err != nil {
+		if err := writeFileAtomic(f.blockPath(c), data); err != nil {
+			return "", fmt.Errorf("failed to write block: %v", err)
+		}
+	}
+
+	cid := CID(c.String())
+	if pin {
+		if err := os.WriteFile(f.pinPath(cid), nil, 0o644); err != nil {
+			return "", fmt.Errorf("failed to pin block: %v", err)
+		}
+	}
+	return cid, nil
+}
+
+func (f *FilesystemNode) GetBlock(ctx context.Context, cid CID) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c, err := gocid.Decode(string(cid))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CID %s: %v", cid, err)
+	}
+	return f.readBlock(c)
+}
+
+func (f *FilesystemNode) Load(ctx context.Context, path string, target interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(f.mfsPath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", errNotFound, path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file %s: %v", path, err)
+	}
+
+	if err := json.Unmarshal(data, target); err != nil {
+		return fmt.Errorf("failed to decode data: %v", err)
+	}
+
+	log.Printf("Loaded data from path: %s", path)
+	return nil
+}
+
+func (f *FilesystemNode) Save(ctx context.Context, path string, data interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal data: %v", err)
+	}
+
+	target := f.mfsPath(path)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", path, err)
+	}
+	if err := writeFileAtomic(target, jsonData); err != nil {
+		return fmt.Errorf("failed to write file %s: %v", path, err)
+	}
+
+	log.Printf("Saved data to path: %s", path)
+	return nil
+}
+
+func (f *FilesystemNode) Delete(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.Remove(f.mfsPath(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete file %s: %v", path, err)
+	}
+	log.Printf("Deleted path: %s", path)
+	return nil
+}
+
+// PublishName only records the name locally, as there is nobody to resolve it
+func (f *FilesystemNode) PublishName(ctx context.Context, cid CID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.hub.publishName(f.id, cid)
+	return nil
+}
+
+func (f *FilesystemNode) ResolveName(ctx context.Context, peerID PeerID) (CID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return f.hub.resolveName(peerID)
+}
+
+func (f *FilesystemNode) Publish(ctx context.Context, topic string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.hub.publish(f.id, topic, data)
+	return nil
+}
+
+func (f *FilesystemNode) Subscribe(ctx context.Context, topic string) (<-chan PubSubMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.hub.listen(ctx, topic), nil
+}
+
+func (f *FilesystemNode) Connect(ctx context.Context, peerID PeerID) error {
+	return fmt.Errorf("filesystem backend cannot connect to peers")
+}
+
+func (f *FilesystemNode) ListPeers(ctx context.Context) ([]Peer_i, error) {
+	return []Peer_i{}, nil
+}
+
+func (f *FilesystemNode) Bootstrap(ctx context.Context) error {
+	log.Printf("Filesystem backend runs standalone, skipping bootstrap")
+	return nil
+}
+
+func (f *FilesystemNode) ID(ctx context.Context) (PeerID, error) {
+	return f.id, nil
+}
+
+func (f *FilesystemNode) Sign(ctx context.Context, data []byte) ([]byte, []byte, error) {
+	return signWithKey(f.key, data)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place
+// so readers never observe a partially written file
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-"+filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestFilesystemNodeAdd(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f, err := NewFilesystemNode(dir)
+	if err != nil {
+		t.Fatalf("NewFilesystemNode: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want CID
+	}{
+		{name: "single chunk", data: []byte("hello world\n"), want: "bafkreifjjcie6lypi6ny7amxnfftagclbuxndqonfipmb64f2km2devei4"},
+		{name: "several chunks", data: multiChunkFile(), want: "bafybeib7rtiuapefdrbklxz5ysik3bixpon5h6cdrim7jhclqfyaz2t5cu"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cid, err := f.Add(ctx, bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+			if cid != tt.want {
+				t.Errorf("got %s, want %s", cid, tt.want)
+			}
+
+			// A node opened on the same directory reads what was added
+			reopened, err := NewFilesystemNode(dir)
+			if err != nil {
+				t.Fatalf("NewFilesystemNode: %v", err)
+			}
+			r, err := reopened.Get(ctx, cid)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("read back %d bytes that differ from the %d added", len(got), len(tt.data))
+			}
+			pins, err := reopened.List(ctx)
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			if !slices.Contains(pins, cid) {
+				t.Errorf("%s is not pinned", cid)
+			}
+		})
+	}
+}
+
+func TestFilesystemNodeIdentity(t *testing.T) {
+	tests := []struct {
+		name string
+		// identity is written to the directory first, if any
+		identity string
+	}{
+		{name: "new identity"},
+		{name: "identity without a key is replaced", identity: `{"id":"legacy-node"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.identity != "" {
+				if err := os.WriteFile(filepath.Join(dir, "identity.json"), []byte(tt.identity), 0o644); err != nil {
+					t.Fatalf("WriteFile: %v", err)
+				}
+			}
+
+			f, err := NewFilesystemNode(dir)
+			if err != nil {
+				t.Fatalf("NewFilesystemNode: %v", err)
+			}
+			if f.id == "legacy-node" {
+				t.Errorf("kept the ID of an identity without a key")
+			}
+			id, err := peer.IDFromPrivateKey(f.key)
+			if err != nil {
+				t.Fatalf("IDFromPrivateKey: %v", err)
+			}
+			if PeerID(id.String()) != f.id {
+				t.Errorf("ID %s does not belong to the key of %s", f.id, id)
+			}
+
+			var saved struct {
+				ID  PeerID `json:"id"`
+				Key []byte `json:"key"`
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "identity.json"))
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if err := json.Unmarshal(data, &saved); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if saved.ID != f.id || len(saved.Key) == 0 {
+				t.Errorf("saved identity %s with a %d byte key, want %s with a key", saved.ID, len(saved.Key), f.id)
+			}
+
+			reopened, err := NewFilesystemNode(dir)
+			if err != nil {
+				t.Fatalf("NewFilesystemNode: %v", err)
+			}
+			if reopened.id != f.id || !reopened.key.Equals(f.key) {
+				t.Errorf("reopened as %s, want %s with the same key", reopened.id, f.id)
+			}
+		})
+	}
+}
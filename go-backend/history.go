@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// conceptVersions holds the CIDs of the retained previous versions of each
+// local concept, newest first. They stay pinned until they fall out of the
+// configured history depth.
+var (
+	conceptVersions   = make(map[GUID][]CID)
+	conceptVersionsMu sync.RWMutex
+)
+
+// versionContent maps every retained version to the CID of its content, so
+// the content stays pinned as long as the version can be restored or
+// exported. It is guarded by conceptVersionsMu and rebuilt from the versions
+// at startup.
+var versionContent = make(map[CID]CID)
+
+// ConceptVersion is one entry of a concept's history
+type ConceptVersion struct {
+	CID CID
+	*Concept
+}
+
+// sameContent reports whether o differs from c only in bookkeeping fields,
+// in which case storing it would not be a new version
+func (c *Concept) sameContent(o *Concept) bool {
+	return c.Name == o.Name &&
+		c.Description == o.Description &&
+		c.Type == o.Type &&
+		c.contentCID() == o.contentCID() &&
+		slices.Equal(c.Relationships, o.Relationships)
+}
+
+func (c *Concept) contentCID() CID {
+	if c.Content == nil {
+		return ""
+	}
+	return c.Content.CID
+}
+
+// retainVersion records cid, whose content is content, as the newest
+// previous version of guid and returns the versions that no longer fit the
+// history depth together with their content
+func retainVersion(guid GUID, cid, content CID) []CID {
+	conceptVersionsMu.Lock()
+	if content != "" {
+		versionContent[cid] = content
+	}
+	versions := append([]CID{cid}, conceptVersions[guid]...)
+	var dropped []CID
+	if len(versions) > config.HistoryDepth {
+		dropped = dropVersionContent(versions[config.HistoryDepth:])
+		versions = versions[:config.HistoryDepth]
+	}
+	if len(versions) == 0 {
+		delete(conceptVersions, guid)
+	} else {
+		conceptVersions[guid] = versions
+	}
+	conceptVersionsMu.Unlock()
+	persister.MarkDirty(historyPath)
+	return dropped
+}
+
+// forgetVersions drops the retained history of guid and returns it together
+// with the content of its versions
+func forgetVersions(guid GUID) []CID {
+	conceptVersionsMu.Lock()
+	versions := dropVersionContent(conceptVersions[guid])
+	delete(conceptVersions, guid)
+	conceptVersionsMu.Unlock()
+	persister.MarkDirty(historyPath)
+	return versions
+}
+
+// dropVersionContent forgets the content of versions and returns the
+// versions followed by their content. conceptVersionsMu must be held.
+func dropVersionContent(versions []CID) []CID {
+	dropped := slices.Clone(versions)
+	for _, cid := range versions {
+		if content, ok := versionContent[cid]; ok {
+			dropped = append(dropped, content)
+			delete(versionContent, cid)
+		}
+	}
+	return dropped
+}
+
+// indexVersionContent rebuilds versionContent from the retained versions
+func indexVersionContent(ctx context.Context) {
+	conceptVersionsMu.RLock()
+	var versions []CID
+	for _, cids := range conceptVersions {
+		versions = append(versions, cids...)
+	}
+	conceptVersionsMu.RUnlock()
+
+	content := make(map[CID]CID)
+	for _, cid := range versions {
+		c, err := fetchConcept(ctx, cid)
+		if err != nil {
+			log.Printf("Unable to load version %s: %v", cid, err)
+			continue
+		}
+		if c.contentCID() != "" {
+			content[cid] = c.contentCID()
+		}
+	}
+	conceptVersionsMu.Lock()
+	versionContent = content
+	conceptVersionsMu.Unlock()
+}
+
+// walkHistory follows the previous-version links starting at head. The
+// returned CID is where the walk stopped, empty if the chain was complete.
+func walkHistory(ctx context.Context, head CID, limit int) ([]ConceptVersion, CID) {
+	versions := []ConceptVersion{}
+	cid := head
+	for cid != "" && len(versions) < limit {
+		c, err := fetchConcept(ctx, cid)
+		if err != nil {
+			// Versions beyond the history depth are unpinned and may be gone
+			break
+		}
+		versions = append(versions, ConceptVersion{CID: cid, Concept: c})
+		cid = c.Previous
+	}
+	return versions, cid
+}
+
+func getConceptHistory(c *gin.Context) {
+	guid := GUID(c.Param("guid"))
+
+	limit := config.HistoryDepth + 1
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	conceptMu.RLock()
+	head, exists := GUID2CID[guid]
+	conceptMu.RUnlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Concept not found"})
+		return
+	}
+
+	versions, next := walkHistory(c.Request.Context(), head, limit)
+	c.JSON(http.StatusOK, gin.H{
+		"guid":      guid,
+		"versions":  versions,
+		"truncated": next != "",
+		"next":      next,
+	})
+}
+
+// lookupVersion fetches cid and makes sure it is a version of guid
+func lookupVersion(c *gin.Context) (*Concept, bool) {
+	guid := GUID(c.Param("guid"))
+	cid := CID(c.Param("cid"))
+
+	version, err := fetchConcept(c.Request.Context(), cid)
+	if err != nil || version.GUID != guid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return nil, false
+	}
+	return version, true
+}
+
+func getConceptVersion(c *gin.Context) {
+	version, ok := lookupVersion(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, ConceptVersion{CID: version.CID, Concept: version})
+}
+
+// restoreConceptVersion stores an older version as the newest one. The
+// relationship list is kept as it is, since relationships live on their own.
+func restoreConceptVersion(c *gin.Context) {
+	version, ok := lookupVersion(c)
+	if !ok {
+		return
+	}
+
+	conceptMu.RLock()
+	current, exists := conceptMap[version.GUID]
+	var relationships []GUID
+	if exists {
+		relationships = slices.Clone(current.Relationships)
+	}
+	conceptMu.RUnlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Concept not found"})
+		return
+	}
+
+	restored := &Concept{
+		GUID:          version.GUID,
+		Name:          version.Name,
+		Description:   version.Description,
+		Type:          version.Type,
+		Relationships: relationships,
+		Content:       version.Content,
+		Timestamp:     time.Now(),
+	}
+	if err := addOrUpdateConcept(c.Request.Context(), restored); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore concept"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"guid":         restored.GUID,
+		"cid":          restored.CID,
+		"restoredFrom": version.CID,
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// storeVersions stores a concept once for every name and returns the CIDs of
+// its versions, oldest first
+func storeVersions(t *testing.T, guid GUID, names ...string) []CID {
+	t.Helper()
+	var cids []CID
+	for _, name := range names {
+		content, err := storeContent(context.Background(), strings.NewReader(name+" content"), "")
+		if err != nil {
+			t.Fatalf("storeContent: %v", err)
+		}
+		c := &Concept{GUID: guid, Name: name, Content: content, Timestamp: time.Now()}
+		if err := addOrUpdateConcept(context.Background(), c); err != nil {
+			t.Fatalf("addOrUpdateConcept: %v", err)
+		}
+		cids = append(cids, c.CID)
+	}
+	return cids
+}
+
+func TestWalkHistory(t *testing.T) {
+	resetState(t)
+	cids := storeVersions(t, "concept", "first", "second", "third")
+
+	tests := []struct {
+		name      string
+		limit     int
+		wantNames []string
+		wantNext  CID
+	}{
+		{name: "whole chain", limit: 10, wantNames: []string{"third", "second", "first"}},
+		{name: "limited walk", limit: 2, wantNames: []string{"third", "second"}, wantNext: cids[0]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versions, next := walkHistory(context.Background(), cids[2], tt.limit)
+			var names []string
+			for i, v := range versions {
+				names = append(names, v.Name)
+				if v.CID != cids[len(cids)-1-i] {
+					t.Errorf("version %d is %s, want %s", i, v.CID, cids[len(cids)-1-i])
+				}
+			}
+			if !slices.Equal(names, tt.wantNames) || next != tt.wantNext {
+				t.Errorf("got %v stopping at %q, want %v stopping at %q", names, next, tt.wantNames, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestRestoreConceptVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		// guid is the concept the restore is asked for
+		guid       GUID
+		wantStatus int
+	}{
+		{name: "version is restored as the newest", guid: "concept", wantStatus: http.StatusOK},
+		{name: "version of another concept", guid: "other", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			resetState(t)
+			cids := storeVersions(t, "concept", "first", "second")
+			storeVersions(t, "other", "other")
+			first, err := fetchConcept(ctx, cids[0])
+			if err != nil {
+				t.Fatalf("fetchConcept: %v", err)
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/concept/:guid/version/:cid/restore", restoreConceptVersion)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/concept/"+string(tt.guid)+"/version/"+string(cids[0])+"/restore", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if GUID2CID["concept"] != cids[1] {
+					t.Errorf("concept moved to %s, want it left at %s", GUID2CID["concept"], cids[1])
+				}
+				return
+			}
+
+			var resp struct {
+				CID          CID `json:"cid"`
+				RestoredFrom CID `json:"restoredFrom"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if resp.RestoredFrom != cids[0] || resp.CID != GUID2CID["concept"] {
+				t.Errorf("restored %s as %s, want %s as %s", resp.RestoredFrom, resp.CID, cids[0], GUID2CID["concept"])
+			}
+			current := conceptMap["concept"]
+			if current.Name != "first" || current.contentCID() != first.contentCID() {
+				t.Errorf("concept is %q with content %s, want %q with %s", current.Name, current.contentCID(), "first", first.contentCID())
+			}
+
+			// The restore is a new version on top of the history
+			versions, _ := walkHistory(ctx, resp.CID, 10)
+			var chain []CID
+			for _, v := range versions {
+				chain = append(chain, v.CID)
+			}
+			if want := []CID{resp.CID, cids[1], cids[0]}; !slices.Equal(chain, want) {
+				t.Errorf("history is %v, want %v", chain, want)
+			}
+		})
+	}
+}
@@ -3,21 +3,58 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
-	"math"
-	"strings"
+	"path"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	gocid "github.com/ipfs/go-cid"
 )
 
-const (
-	GUID2CIDPath  = "/ccn/GUID-CID.json"
-	peerListPath  = "/ccn/peer-list.json"
-	ownerGUIDPath = "/ccn/owner-guid.json"
+// MFS paths of the persisted state files, relative to the configured root
+var (
+	GUID2CIDPath          = "/ccn/GUID-CID.json"
+	peerListPath          = "/ccn/peer-list.json"
+	ownerGUIDPath         = "/ccn/owner-guid.json"
+	ownerKeyPath          = "/ccn/owner-key.json"
+	pinnedKeysPath        = "/ccn/owner-keys.json"
+	inboxPath             = "/ccn/inbox.json"
+	relationshipsPath     = "/ccn/relationships.json"
+	relationshipIndexPath = "/ccn/relationship-CID.json"
+	schemaPath            = "/ccn/schema.json"
+	remoteConceptsPath    = "/ccn/remote-concepts.json"
+	changeLogPath         = "/ccn/change-log.json"
+	tombstonesPath        = "/ccn/tombstones.json"
+	peerTrustPath         = "/ccn/peer-trust.json"
+	quarantinePath        = "/ccn/quarantine.json"
+	conceptsPath          = "/ccn/concepts.json"
+	pinsPath              = "/ccn/pins.json"
+	historyPath           = "/ccn/history.json"
 )
 
+func setMFSRoot(root string) {
+	GUID2CIDPath = path.Join(root, "GUID-CID.json")
+	peerListPath = path.Join(root, "peer-list.json")
+	ownerGUIDPath = path.Join(root, "owner-guid.json")
+	ownerKeyPath = path.Join(root, "owner-key.json")
+	pinnedKeysPath = path.Join(root, "owner-keys.json")
+	inboxPath = path.Join(root, "inbox.json")
+	relationshipsPath = path.Join(root, "relationships.json")
+	relationshipIndexPath = path.Join(root, "relationship-CID.json")
+	schemaPath = path.Join(root, "schema.json")
+	remoteConceptsPath = path.Join(root, "remote-concepts.json")
+	changeLogPath = path.Join(root, "change-log.json")
+	tombstonesPath = path.Join(root, "tombstones.json")
+	peerTrustPath = path.Join(root, "peer-trust.json")
+	quarantinePath = path.Join(root, "quarantine.json")
+	conceptsPath = path.Join(root, "concepts.json")
+	pinsPath = path.Join(root, "pins.json")
+	historyPath = path.Join(root, "history.json")
+}
+
 func (pm *PeerMap) UnmarshalJSON(data []byte) error {
 	var rawMap map[PeerID]json.RawMessage
 	if err := json.Unmarshal(data, &rawMap); err != nil {
@@ -36,7 +73,7 @@ func (pm *PeerMap) UnmarshalJSON(data []byte) error {
 }
 
 func (rm *RelationshipMap) UnmarshalJSON(data []byte) error {
-	var rawMap map[PeerID]json.RawMessage
+	var rawMap map[GUID]json.RawMessage
 	if err := json.Unmarshal(data, &rawMap); err != nil {
 		return err
 	}
@@ -47,40 +84,118 @@ func (rm *RelationshipMap) UnmarshalJSON(data []byte) error {
 		if err := json.Unmarshal(raw, &r); err != nil {
 			return err
 		}
-		(*rm)[GUID(guid)] = &r
+		(*rm)[guid] = &r
 	}
 	return nil
 }
 
+// Update stores the concept as a DAG-JSON node linking to its relationships
+// and its previous version
 func (c *Concept) Update(ctx context.Context) error {
-	conceptJSON, _ := json.Marshal(c)
-	cid, err := node.Add(ctx, strings.NewReader(string(conceptJSON)))
+	refs, err := linkRelationships(ctx, c.Relationships)
+	if err != nil {
+		return err
+	}
+	data, err := encodeConcept(c, refs)
 	if err != nil {
 		return err
 	}
+	cid, err := node.PutBlock(ctx, gocid.DagJSON, data, true)
+	if err != nil {
+		return err
+	}
+	trackPin(cid)
 	c.CID = cid
+	c.links = refLinks(refs)
 	return nil
 }
 
+// conceptUpdateMu serializes concept writes so every new version links to
+// the one it replaces, while conceptMu stays free for resolving links
+var conceptUpdateMu sync.Mutex
+
 func addOrUpdateConcept(ctx context.Context, concept *Concept) error {
-	conceptMu.Lock()
-	defer conceptMu.Unlock()
+	conceptUpdateMu.Lock()
+	defer conceptUpdateMu.Unlock()
 
-	if err := concept.Update(context.Background()); err != nil {
+	conceptMu.RLock()
+	prevCID := GUID2CID[concept.GetGUID()]
+	var prevContent CID
+	existing, ok := conceptMap[concept.GetGUID()]
+	if ok {
+		prevContent = existing.contentCID()
+	}
+	if ok && existing != concept && existing.sameContent(concept) {
+		concept.CID, concept.Previous, concept.Timestamp, concept.links = existing.CID, existing.Previous, existing.Timestamp, existing.links
+		conceptMu.RUnlock()
+		log.Printf("Concept unchanged: GUID=%s, CID=%s", concept.GetGUID(), concept.GetCID())
+		return nil
+	}
+	conceptMu.RUnlock()
+
+	concept.Previous = prevCID
+	if err := concept.Update(ctx); err != nil {
 		log.Printf("Failed to update concept: %v", err)
 		return err
 	}
+	conceptMu.Lock()
 	conceptMap[concept.GetGUID()] = concept
 	GUID2CID[concept.GetGUID()] = concept.GetCID()
+	conceptMu.Unlock()
 	log.Printf("Added/Updated concept: GUID=%s, Name=%s, CID=%s\n", concept.GetGUID(), concept.GetName(), concept.GetCID())
+	persister.MarkDirty(GUID2CIDPath)
 
-	if err := node.Save(ctx, GUID2CIDPath, GUID2CID); err != nil {
-		log.Printf("Failed to save concept list: %v", err)
-		return err
+	if prevCID != "" && prevCID != concept.GetCID() {
+		replaceOwnCID(prevCID, concept.GetCID())
+		for _, cid := range retainVersion(concept.GetGUID(), prevCID, prevContent) {
+			releasePin(ctx, cid)
+		}
 	}
 	return nil
 }
 
+// appendRelationship stores a new version of a local concept that includes
+// relationshipID, so the concept node links to the relationship
+func appendRelationship(ctx context.Context, guid, relationshipID GUID) error {
+	conceptMu.RLock()
+	concept, ok := conceptMap[guid]
+	var updated Concept
+	if ok {
+		updated = *concept
+		updated.Relationships = append(slices.Clone(concept.Relationships), relationshipID)
+	}
+	conceptMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("concept with GUID %s not found", guid)
+	}
+
+	updated.Timestamp = time.Now()
+	return addOrUpdateConcept(ctx, &updated)
+}
+
+// unlinkRelationship stores a new version of a local concept without its
+// link to a relationship. Concepts that are not ours or do not link to the
+// relationship are left alone.
+func unlinkRelationship(ctx context.Context, guid, relationshipID GUID) error {
+	conceptMu.RLock()
+	concept, ok := conceptMap[guid]
+	linked := ok && slices.Contains(concept.Relationships, relationshipID)
+	var updated Concept
+	if linked {
+		updated = *concept
+		updated.Relationships = slices.DeleteFunc(slices.Clone(concept.Relationships), func(id GUID) bool {
+			return id == relationshipID
+		})
+	}
+	conceptMu.RUnlock()
+	if !linked {
+		return nil
+	}
+
+	updated.Timestamp = time.Now()
+	return addOrUpdateConcept(ctx, &updated)
+}
+
 func periodicSend(conn *websocket.Conn, sendFunc func(*websocket.Conn)) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
@@ -133,37 +248,17 @@ func sendJSONList(conn *websocket.Conn, list interface{}, mu sync.Locker, itemTy
 	}
 }
 
-func handleReceivedMessage(data []byte) {
-	var message PeerMessage
-	if err := json.Unmarshal(data, &message); err != nil {
-		log.Printf("Error unmarshaling received message: %v", err)
-		return
-	}
-
-	log.Printf("Received message from peer: %s", message.PeerID)
-
-	// Add or update the sender in the peer list
-	addOrUpdatePeer(message.PeerID, message.OwnerGUID)
-
-	// Update local relationships with received ones
-	for id, relationship := range message.Relationships {
-		if _, exists := relationshipMap[id]; !exists {
-			relationshipMap[id] = relationship
-		}
-	}
-	saveRelationships(context.Background())
-
-	// Update the CIDs for this peer
-	updatePeerCIDs(message.PeerID, message.CIDs)
-}
-
 func addNewConcept(concept *Concept) {
 	conceptMu.Lock()
 	conceptMap[concept.GetGUID()] = concept
 	GUID2CID[concept.GetGUID()] = concept.GetCID()
 	conceptMu.Unlock()
+	persister.MarkDirty(GUID2CIDPath)
 
+	peerMapMu.Lock()
 	peerMap[peerID].AddCID(concept.GetCID())
+	peerMapMu.Unlock()
+	persister.MarkDirty(peerListPath)
 
 	log.Printf("Added new concept: GUID=%s, CID=%s, Name=%s", concept.GetGUID(), concept.GetCID(), concept.GetName())
 
@@ -172,8 +267,9 @@ func addNewConcept(concept *Concept) {
 
 // Modify the Interact method of Relationship
 func (r *Relationship) Interact(interactionType GUID) {
-	r.Interactions++
-	r.Depth = int(math.Log2(float64(r.Interactions))) + 1
+	r.ensureState()
+	defer r.apply()
+	r.countInteraction()
 	r.LastInteraction = time.Now()
 
 	// Get the interaction type concept
@@ -189,17 +285,17 @@ func (r *Relationship) Interact(interactionType GUID) {
 	// Apply effects based on the interaction type
 	switch interactionConcept.Name {
 	case "Music":
-		r.FrequencySpec = append(r.FrequencySpec, 440.0) // Add A4 note
-		r.Amplitude *= 1.05
+		r.addFrequency(440.0) // Add A4 note
+		r.State.Amplitude.set(r.Amplitude * 1.05)
 	case "Meditation":
-		r.EnergyFlow *= 1.1
-		r.Volume *= 0.95
+		r.State.EnergyFlow.set(r.EnergyFlow * 1.1)
+		r.State.Volume.set(r.Volume * 0.95)
 	case "FlowState":
-		r.EnergyFlow *= 1.2
-		r.Amplitude *= 1.1
-		r.Volume *= 1.05
+		r.State.EnergyFlow.set(r.EnergyFlow * 1.2)
+		r.State.Amplitude.set(r.Amplitude * 1.1)
+		r.State.Volume.set(r.Volume * 1.05)
 	default:
-		r.EnergyFlow *= 1.05
+		r.State.EnergyFlow.set(r.EnergyFlow * 1.05)
 	}
 
 	r.Timestamp = time.Now()
@@ -3,84 +3,291 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"strings"
 	"time"
 
+	files "github.com/ipfs/boxo/files"
 	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mbase "github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multicodec"
 )
 
 // IPFSShell implements the Node_i interface using go-ipfs-api
 type IPFSShell struct {
-	sh *shell.Shell
+	sh             *shell.Shell
+	bootstrapPeers []string
+	timeouts       map[string]time.Duration
 }
 
-func NewIPFSShell(url string) *IPFSShell {
-	return &IPFSShell{sh: shell.NewShell(url)}
+func NewIPFSShell(url string, bootstrapPeers []string, timeouts map[string]time.Duration) *IPFSShell {
+	return &IPFSShell{sh: shell.NewShell(url), bootstrapPeers: bootstrapPeers, timeouts: timeouts}
+}
+
+// withTimeout bounds ctx by the default timeout configured for op. A deadline
+// the caller already set is kept if it is earlier.
+func (i *IPFSShell) withTimeout(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	if d := i.timeouts[op]; d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+// cancelOnClose releases the request context once the caller is done reading
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+func multipartBody(content io.Reader) io.Reader {
+	fr := files.NewReaderFile(content)
+	slf := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("", fr)})
+	return files.NewMultiFileReader(slf, true, false)
 }
 
 func (i *IPFSShell) Add(ctx context.Context, content io.Reader) (CID, error) {
-	cid, err := i.sh.Add(content, shell.CidVersion(1), shell.Pin(true))
-	return CID(cid), err
+	ctx, cancel := i.withTimeout(ctx, "add")
+	defer cancel()
+
+	var out struct{ Hash string }
+	err := i.sh.Request("add").
+		Option("cid-version", 1).
+		Option("pin", true).
+		Body(multipartBody(content)).
+		Exec(ctx, &out)
+	return CID(out.Hash), err
 }
 
 func (i *IPFSShell) Get(ctx context.Context, cid CID) (io.ReadCloser, error) {
-	return i.sh.Cat(string(cid))
+	ctx, cancel := i.withTimeout(ctx, "get")
+
+	resp, err := i.sh.Request("cat", string(cid)).Send(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.Error != nil {
+		resp.Close()
+		cancel()
+		return nil, resp.Error
+	}
+	return cancelOnClose{ReadCloser: resp.Output, cancel: cancel}, nil
 }
 
 func (i *IPFSShell) Remove(ctx context.Context, cid CID) error {
-	return i.sh.Unpin(string(cid))
+	ctx, cancel := i.withTimeout(ctx, "remove")
+	defer cancel()
+
+	return i.sh.Request("pin/rm", string(cid)).
+		Option("recursive", true).
+		Exec(ctx, nil)
 }
 
 func (i *IPFSShell) List(ctx context.Context) ([]CID, error) {
-	pins, err := i.sh.Pins()
-	if err != nil {
+	ctx, cancel := i.withTimeout(ctx, "list")
+	defer cancel()
+
+	var raw struct{ Keys map[string]shell.PinInfo }
+	if err := i.sh.Request("pin/ls").Exec(ctx, &raw); err != nil {
 		return nil, err
 	}
 	ret := make([]CID, 0)
-	for cid, pinInfo := range pins {
+	for cid, pinInfo := range raw.Keys {
 		fmt.Printf("CID:%s, Type=%s\n", cid, pinInfo.Type)
 		ret = append(ret, CID(cid))
 	}
 	return ret, nil
 }
 
+func (i *IPFSShell) PutBlock(ctx context.Context, codec uint64, data []byte, pin bool) (CID, error) {
+	ctx, cancel := i.withTimeout(ctx, "add")
+	defer cancel()
+
+	var out struct{ Key string }
+	err := i.sh.Request("block/put").
+		Option("cid-codec", multicodec.Code(codec).String()).
+		Option("mhtype", "sha2-256").
+		Body(multipartBody(bytes.NewReader(data))).
+		Exec(ctx, &out)
+	if err != nil || !pin {
+		return CID(out.Key), err
+	}
+
+	// block/put --pin pins recursively, which would hold on to every previous
+	// version a concept links to
+	err = i.sh.Request("pin/add", out.Key).
+		Option("recursive", false).
+		Exec(ctx, nil)
+	return CID(out.Key), err
+}
+
+func (i *IPFSShell) GetBlock(ctx context.Context, cid CID) ([]byte, error) {
+	ctx, cancel := i.withTimeout(ctx, "get")
+	defer cancel()
+
+	resp, err := i.sh.Request("block/get", string(cid)).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return io.ReadAll(resp.Output)
+}
+
+func (i *IPFSShell) PublishName(ctx context.Context, cid CID) error {
+	ctx, cancel := i.withTimeout(ctx, "name_publish")
+	defer cancel()
+
+	return i.sh.Request("name/publish", "/ipfs/"+string(cid)).
+		Option("key", "self").
+		Option("resolve", false).
+		Exec(ctx, nil)
+}
+
+func (i *IPFSShell) ResolveName(ctx context.Context, peerID PeerID) (CID, error) {
+	ctx, cancel := i.withTimeout(ctx, "name_resolve")
+	defer cancel()
+
+	var out struct{ Path string }
+	if err := i.sh.Request("name/resolve", "/ipns/"+string(peerID)).Exec(ctx, &out); err != nil {
+		return "", err
+	}
+	cid, ok := strings.CutPrefix(out.Path, "/ipfs/")
+	if !ok {
+		return "", fmt.Errorf("name of %s resolves to unexpected path %s", peerID, out.Path)
+	}
+	return CID(cid), nil
+}
+
 func (i *IPFSShell) Publish(ctx context.Context, topic string, data []byte) error {
-	return i.sh.PubSubPublish(topic, string(data))
+	ctx, cancel := i.withTimeout(ctx, "publish")
+	defer cancel()
+
+	resp, err := i.sh.Request("pubsub/pub", encodeTopic(topic)).
+		Body(multipartBody(bytes.NewReader(data))).
+		Send(ctx)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	if resp.Error != nil {
+		return resp.Error
+	}
+	return nil
+}
+
+func encodeTopic(topic string) string {
+	encoder, _ := mbase.EncoderByName("base64url")
+	return encoder.Encode([]byte(topic))
 }
 
-func (i *IPFSShell) Subscribe(ctx context.Context, topic string) (<-chan []byte, error) {
-	sub, err := i.sh.PubSubSubscribe(topic)
+// Subscribe streams messages until ctx is done or the daemon drops the
+// connection; either way the returned channel is closed.
+func (i *IPFSShell) Subscribe(ctx context.Context, topic string) (<-chan PubSubMessage, error) {
+	// Only establishing the subscription is bounded by a timeout, the stream
+	// itself lives as long as ctx
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	var connectTimer *time.Timer
+	if d := i.timeouts["subscribe"]; d > 0 {
+		connectTimer = time.AfterFunc(d, cancelStream)
+	}
+
+	resp, err := i.sh.Request("pubsub/sub", encodeTopic(topic)).Send(streamCtx)
+	if connectTimer != nil && !connectTimer.Stop() {
+		if err == nil {
+			resp.Close()
+		}
+		err = fmt.Errorf("timed out subscribing to %s", topic)
+	}
 	if err != nil {
+		cancelStream()
 		return nil, err
 	}
+	if resp.Error != nil {
+		resp.Close()
+		cancelStream()
+		return nil, resp.Error
+	}
 
-	ch := make(chan []byte)
+	ch := make(chan PubSubMessage)
 	go func() {
 		defer close(ch)
+		defer cancelStream()
+		defer resp.Close()
+
+		dec := json.NewDecoder(resp.Output)
 		for {
-			msg, err := sub.Next()
+			msg, err := decodePubSubMessage(dec)
 			if err != nil {
-				if err == context.Canceled {
-					return
+				if ctx.Err() == nil {
+					log.Printf("Subscription to %s ended: %v", topic, err)
 				}
-				log.Printf("Error receiving message: %v", err)
+				return
+			}
+			if msg == nil {
 				continue
 			}
-			ch <- msg.Data
+			select {
+			case ch <- *msg:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	return ch, nil
 }
 
+// decodePubSubMessage reads the next record of a pubsub/sub stream. Stream
+// errors are returned, while a single malformed record is logged and skipped
+// by returning a nil message.
+func decodePubSubMessage(dec *json.Decoder) (*PubSubMessage, error) {
+	var r struct {
+		From string `json:"from,omitempty"`
+		Data string `json:"data,omitempty"`
+	}
+	if err := dec.Decode(&r); err != nil {
+		return nil, err
+	}
+
+	// fields are wrapped in multibase when sent over HTTP RPC
+	from, err := peer.Decode(r.From)
+	if err != nil {
+		log.Printf("Skipping pubsub message with invalid sender: %v", err)
+		return nil, nil
+	}
+	_, data, err := mbase.Decode(r.Data)
+	if err != nil {
+		log.Printf("Skipping pubsub message with invalid data: %v", err)
+		return nil, nil
+	}
+	return &PubSubMessage{From: PeerID(from.String()), Data: data}, nil
+}
+
 func (i *IPFSShell) Connect(ctx context.Context, peerID PeerID) error {
+	ctx, cancel := i.withTimeout(ctx, "connect")
+	defer cancel()
+
 	return i.sh.SwarmConnect(ctx, string(peerID))
 }
 
 func (i *IPFSShell) ListPeers(ctx context.Context) ([]Peer_i, error) {
+	ctx, cancel := i.withTimeout(ctx, "list_peers")
+	defer cancel()
+
 	swarmPeers, err := i.sh.SwarmPeers(ctx)
 	if err != nil {
 		return nil, err
@@ -98,34 +305,72 @@ func (i *IPFSShell) ListPeers(ctx context.Context) ([]Peer_i, error) {
 }
 
 func (i *IPFSShell) Bootstrap(ctx context.Context) error {
-	bootstrapNodes := []string{
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
-	}
-
-	for _, addr := range bootstrapNodes {
-		if err := i.sh.SwarmConnect(ctx, addr); err != nil {
+	for _, addr := range i.bootstrapPeers {
+		connectCtx, cancel := i.withTimeout(ctx, "connect")
+		err := i.sh.SwarmConnect(connectCtx, addr)
+		cancel()
+		if err != nil {
 			log.Printf("Failed to connect to bootstrap node %s: %v", addr, err)
 		} else {
 			log.Printf("Connected to bootstrap node: %s", addr)
 		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 	}
 
 	return nil
 }
 
 func (i *IPFSShell) ID(ctx context.Context) (PeerID, error) {
-	info, err := i.sh.ID()
-	if err != nil {
+	ctx, cancel := i.withTimeout(ctx, "id")
+	defer cancel()
+
+	var info shell.IdOutput
+	if err := i.sh.Request("id").Exec(ctx, &info); err != nil {
 		return "", err
 	}
 	return PeerID(info.ID), nil
 }
 
+// Sign signs with the daemon's own key. The daemon prefixes data with
+// signedMessagePrefix before signing.
+func (i *IPFSShell) Sign(ctx context.Context, data []byte) ([]byte, []byte, error) {
+	ctx, cancel := i.withTimeout(ctx, "sign")
+	defer cancel()
+
+	var out struct{ Signature string }
+	if err := i.sh.Request("key/sign").
+		Option("key", "self").
+		Body(multipartBody(bytes.NewReader(data))).
+		Exec(ctx, &out); err != nil {
+		return nil, nil, err
+	}
+	_, signature, err := mbase.Decode(out.Signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid signature from daemon: %v", err)
+	}
+
+	var info shell.IdOutput
+	if err := i.sh.Request("id").Exec(ctx, &info); err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(info.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid public key from daemon: %v", err)
+	}
+	return signature, publicKey, nil
+}
+
 func (i *IPFSShell) Load(ctx context.Context, path string, target interface{}) error {
+	ctx, cancel := i.withTimeout(ctx, "load")
+	defer cancel()
+
 	data, err := i.sh.FilesRead(ctx, path)
+	var shellErr *shell.Error
+	if errors.As(err, &shellErr) && strings.Contains(shellErr.Message, "does not exist") {
+		return fmt.Errorf("%w: %s", errNotFound, path)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to read file from IPFS: %v", err)
 	}
@@ -140,6 +385,9 @@ func (i *IPFSShell) Load(ctx context.Context, path string, target interface{}) e
 }
 
 func (i *IPFSShell) Save(ctx context.Context, path string, data interface{}) error {
+	ctx, cancel := i.withTimeout(ctx, "save")
+	defer cancel()
+
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return fmt.Errorf("failed to marshal data: %v", err)
@@ -152,3 +400,21 @@ func (i *IPFSShell) Save(ctx context.Context, path string, data interface{}) err
 	log.Printf("Saved data to IPFS path: %s", path)
 	return nil
 }
+
+// Delete shares the timeout of save, as both only write to MFS
+func (i *IPFSShell) Delete(ctx context.Context, path string) error {
+	ctx, cancel := i.withTimeout(ctx, "save")
+	defer cancel()
+
+	err := i.sh.FilesRm(ctx, path, true)
+	var shellErr *shell.Error
+	if errors.As(err, &shellErr) && strings.Contains(shellErr.Message, "does not exist") {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete file from IPFS: %v", err)
+	}
+
+	log.Printf("Deleted IPFS path: %s", path)
+	return nil
+}
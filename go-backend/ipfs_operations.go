@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"log"
 	"time"
 
@@ -14,6 +13,7 @@ func initializeLists(ctx context.Context) {
 	GUID2CID = make(map[GUID]CID)
 	peerMap = make(PeerMap)
 	relationshipMap = make(RelationshipMap)
+	registerStateFiles()
 
 	if err := node.Bootstrap(ctx); err != nil {
 		log.Fatalf("Failed to bootstrap IPFS: %v", err)
@@ -24,16 +24,51 @@ func initializeLists(ctx context.Context) {
 	if err != nil {
 		log.Fatalf("Failed to get peer ID: %v", err)
 	}
+	if err := migrateSchema(ctx); err != nil {
+		log.Fatalf("Failed to migrate persisted state: %v", err)
+	}
 
 	if err := node.Load(ctx, GUID2CIDPath, &GUID2CID); err != nil {
 		log.Printf("Failed to load concept list: %v\n", err)
 	}
-	if err := node.Load(ctx, "/ccn/relationships.json", &relationshipMap); err != nil {
-		log.Printf("Failed to load relationships: %v", err)
+	if err := node.Load(ctx, relationshipIndexPath, &relationship2CID); err != nil {
+		log.Printf("Failed to load relationship index: %v", err)
 	}
 	if err := node.Load(ctx, peerListPath, &peerMap); err != nil {
 		log.Printf("Failed to load peer list: %v\n", err)
 	}
+	if err := node.Load(ctx, peerTrustPath, &peerTrust); err != nil {
+		log.Printf("Failed to load peer trust levels: %v", err)
+	}
+	if err := node.Load(ctx, quarantinePath, &quarantine); err != nil {
+		log.Printf("Failed to load quarantine: %v", err)
+	}
+	reindexQuarantine()
+	if err := node.Load(ctx, inboxPath, &inbox); err != nil {
+		log.Printf("Failed to load inbox: %v", err)
+	}
+	if err := node.Load(ctx, pinnedKeysPath, &pinnedKeys); err != nil {
+		log.Printf("Failed to load owner keys: %v", err)
+	}
+	if err := node.Load(ctx, pinsPath, &managedPins); err != nil {
+		log.Printf("Failed to load managed pins: %v", err)
+	}
+	if err := node.Load(ctx, historyPath, &conceptVersions); err != nil {
+		log.Printf("Failed to load concept history: %v", err)
+	}
+	indexVersionContent(ctx)
+	if err := node.Load(ctx, remoteConceptsPath, &remoteConcepts); err != nil {
+		log.Printf("Failed to load remote concepts: %v", err)
+	}
+	if err := node.Load(ctx, tombstonesPath, &tombstones); err != nil {
+		log.Printf("Failed to load tombstones: %v", err)
+	}
+	if err := node.Load(ctx, changeLogPath, &changeLog); err != nil {
+		log.Printf("Failed to load change log: %v", err)
+	}
+	if changeLog.Relationships == nil {
+		changeLog.Relationships = make(map[GUID]CID)
+	}
 	for id, peer := range peerMap {
 		if peer.GetOwnerGUID() == "" {
 			delete(peerMap, id)
@@ -44,22 +79,24 @@ func initializeLists(ctx context.Context) {
 		Timestamp: time.Now(),
 		CIDs:      make(map[CID]bool),
 	}
+	// GUID2CID only lists our own concepts, so it is the source of truth for
+	// what this peer announces
+	for _, cid := range GUID2CID {
+		peerMap[peerID].AddCID(cid)
+	}
 	loadOrCreateOwner(ctx)
+	loadOrCreateOwnerKey(ctx)
 	peerMap[peerID].(*Peer).OwnerGUID = ownerGUID
 	for _, cid := range peerMap[peerID].GetCIDs() {
-		conceptReader, err := node.Get(context.Background(), cid)
+		c, err := fetchConcept(ctx, cid)
 		if err != nil {
-			log.Fatalf("Unable to get Concept: %s: %v", cid, err)
+			log.Fatalf("Unable to load Concept: %s: %v", cid, err)
 		}
-		var c Concept
-		err = json.NewDecoder(conceptReader).Decode(&c)
-		if err != nil {
-			log.Fatalf("Unable to parse Concept: %s: %v", cid, err)
-		}
-		c.CID = cid
-		conceptMap[c.GUID] = &c
+		conceptMap[c.GUID] = c
 		GUID2CID[c.GUID] = cid
 	}
+	loadRelationships(ctx)
+	adoptLivePins()
 }
 
 func loadOrCreateOwner(ctx context.Context) {
@@ -89,36 +126,17 @@ func loadOrCreateOwner(ctx context.Context) {
 			Timestamp:     time.Now(),
 			Relationships: []GUID{},
 		}
-		addOrUpdateConcept(context.Background(), ownerConcept)
+		addOrUpdateConcept(ctx, ownerConcept)
 		cid = ownerConcept.CID
 	}
 	peerMap[peerID].AddCID(cid)
 }
 
-func saveRelationships(ctx context.Context) error {
-	if err := node.Save(ctx, "/ccn/relationships.json", relationshipMap); err != nil {
-		log.Printf("Failed to save relationships: %v", err)
-		return err
-	}
-	return nil
-}
-
 func saveConceptMap() {
-	if err := node.Save(context.Background(), "/ccn/concepts.json", conceptMap); err != nil {
-		log.Printf("Failed to save concept map: %v", err)
-	}
+	persister.MarkDirty(conceptsPath)
 }
 
 func publishPeerMessage(ctx context.Context) {
-	peerMapMu.RLock()
-	peer, exists := peerMap[peerID]
-	peerMapMu.RUnlock()
-
-	if !exists {
-		log.Printf("Peer information not set for this peer")
-		return
-	}
-
 	conceptMu.RLock()
 	cids := make([]CID, 0, len(conceptMap))
 	for _, concept := range conceptMap {
@@ -126,40 +144,19 @@ func publishPeerMessage(ctx context.Context) {
 	}
 	conceptMu.RUnlock()
 
-	message := PeerMessage{
-		PeerID:        peerID,
-		OwnerGUID:     peer.GetOwnerGUID(),
-		CIDs:          cids,
-		Relationships: relationshipMap,
-	}
-
-	data, err := json.Marshal(message)
-	if err != nil {
-		log.Printf("Error marshaling peer message: %v", err)
-		return
+	relationshipMu.RLock()
+	relationships := make(map[GUID]CID, len(relationship2CID))
+	for id, cid := range relationship2CID {
+		relationships[id] = cid
 	}
+	relationshipMu.RUnlock()
 
-	if err := node.Publish(ctx, pubsubTopic, data); err != nil {
+	var message Announcement
+	message.Seq, message.Changes = recordAnnouncement(cids, relationships)
+	if err := publishMessage(ctx, MessageAnnounce, message); err != nil {
 		log.Printf("Error publishing peer message: %v", err)
-	} else {
-		log.Printf("Published peer message with %d CIDs", len(cids))
-	}
-}
-
-func subscribeRoutine(ctx context.Context) {
-	ch, err := node.Subscribe(ctx, pubsubTopic)
-	if err != nil {
-		log.Fatalf("Error subscribing to topic: %v", err)
-	}
-
-	log.Printf("Subscribed to topic: %s", pubsubTopic)
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case msg := <-ch:
-			handleReceivedMessage(msg)
-		}
+	} else if message.Changes != nil {
+		log.Printf("Published announcement %d with %d added and %d removed CIDs and %d changed relationships",
+			message.Seq, len(message.Changes.Added), len(message.Changes.Removed), len(message.Changes.Relationships))
 	}
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Messages from the topic are checked against limits before they are
+// handled: their size, a token bucket per sender refilled at RateLimit
+// messages a minute, and the number of relationships a pushed message may
+// carry. Trusted peers are not rate limited. Every message dropped is
+// counted by reason and sender.
+//
+// The limiter tracks at most maxLimitedPeers senders, as the size check runs
+// for whatever sender the transport claims. Once full, the senders whose
+// bucket has refilled and that had nothing dropped are forgotten first, as
+// they would start over with a full bucket anyway, and then the one heard
+// from longest ago.
+
+type DropReason string
+
+const (
+	DropTooLarge             DropReason = "too-large"
+	DropRateLimited          DropReason = "rate-limited"
+	DropTooManyRelationships DropReason = "too-many-relationships"
+)
+
+var (
+	errMessageTooLarge      = errors.New("message too large")
+	errRateLimited          = errors.New("rate limit exceeded")
+	errTooManyRelationships = errors.New("too many relationships in message")
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket at rate tokens a second for the time passed and
+// takes a token if there is one
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket has refilled to burst by now
+func (b *tokenBucket) full(now time.Time, rate float64, burst int) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst)
+}
+
+// maxLimitedPeers is how many senders the limiter tracks
+var maxLimitedPeers = 10000
+
+type peerLimits struct {
+	bucket     tokenBucket
+	dropped    map[DropReason]int
+	lastDropAt time.Time
+}
+
+// Limiter enforces the inbound limits and counts what it drops
+type Limiter struct {
+	mu      sync.Mutex
+	peers   map[PeerID]*peerLimits
+	dropped map[DropReason]int
+}
+
+var limiter = NewLimiter()
+
+func NewLimiter() *Limiter {
+	return &Limiter{peers: make(map[PeerID]*peerLimits), dropped: make(map[DropReason]int)}
+}
+
+// peer returns the state of a peer, creating it with a full bucket. l.mu
+// must be held.
+func (l *Limiter) peer(id PeerID) *peerLimits {
+	p, ok := l.peers[id]
+	if !ok {
+		if len(l.peers) >= maxLimitedPeers {
+			l.expire(time.Now())
+		}
+		if len(l.peers) >= maxLimitedPeers {
+			l.evictOldest()
+		}
+		p = &peerLimits{bucket: tokenBucket{tokens: float64(config.RateBurst), last: time.Now()}, dropped: make(map[DropReason]int)}
+		l.peers[id] = p
+	}
+	return p
+}
+
+// expire forgets the senders that had nothing dropped and whose bucket has
+// refilled. l.mu must be held.
+func (l *Limiter) expire(now time.Time) {
+	rate := float64(config.RateLimit) / 60
+	for id, p := range l.peers {
+		if len(p.dropped) == 0 && p.bucket.full(now, rate, config.RateBurst) {
+			delete(l.peers, id)
+		}
+	}
+}
+
+// evictOldest forgets the sender heard from longest ago. l.mu must be held.
+func (l *Limiter) evictOldest() {
+	var oldest PeerID
+	var oldestAt time.Time
+	for id, p := range l.peers {
+		at := p.bucket.last
+		if p.lastDropAt.After(at) {
+			at = p.lastDropAt
+		}
+		if oldest == "" || at.Before(oldestAt) {
+			oldest, oldestAt = id, at
+		}
+	}
+	delete(l.peers, oldest)
+}
+
+func (l *Limiter) drop(id PeerID, reason DropReason) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dropped[reason]++
+	if id == "" {
+		return
+	}
+	p := l.peer(id)
+	p.dropped[reason]++
+	p.lastDropAt = time.Now()
+}
+
+// checkSize rejects a message larger than MaxMessageSize. It runs before the
+// message is verified, so from is only what the transport claims.
+func (l *Limiter) checkSize(from PeerID, size int) error {
+	if size <= config.MaxMessageSize {
+		return nil
+	}
+	l.drop(from, DropTooLarge)
+	return fmt.Errorf("%w: %d bytes", errMessageTooLarge, size)
+}
+
+// allow takes a token from the bucket of a sender
+func (l *Limiter) allow(id PeerID) error {
+	if config.RateLimit <= 0 || trustOf(id) == TrustTrusted {
+		return nil
+	}
+	l.mu.Lock()
+	ok := l.peer(id).bucket.take(time.Now(), float64(config.RateLimit)/60, config.RateBurst)
+	l.mu.Unlock()
+	if ok {
+		return nil
+	}
+	l.drop(id, DropRateLimited)
+	return fmt.Errorf("%w: %s", errRateLimited, id)
+}
+
+// relationshipCarrier is implemented by the bodies of pushed messages that
+// carry relationships, tombstones included. Answers to our own requests are
+// not limited, as a peer catching us up sends its whole state.
+type relationshipCarrier interface {
+	relationshipCount() int
+}
+
+func (a Announcement) relationshipCount() int {
+	if a.Changes == nil {
+		return 0
+	}
+	return len(a.Changes.Relationships)
+}
+
+func (u RelationshipUpdate) relationshipCount() int { return len(u.Relationships) }
+
+func (m TombstoneMessage) relationshipCount() int { return len(m.Tombstones) }
+
+func (l *Limiter) checkRelationships(from PeerID, body interface{}) error {
+	carrier, ok := body.(relationshipCarrier)
+	if !ok || carrier.relationshipCount() <= config.MaxMessageRelationships {
+		return nil
+	}
+	l.drop(from, DropTooManyRelationships)
+	return fmt.Errorf("%w: %d", errTooManyRelationships, carrier.relationshipCount())
+}
+
+func (l *Limiter) forget(id PeerID) {
+	l.mu.Lock()
+	delete(l.peers, id)
+	l.mu.Unlock()
+}
+
+// PeerLimitStatus reports the drops of one sender
+type PeerLimitStatus struct {
+	Peer       PeerID             `json:"peer"`
+	Tokens     float64            `json:"tokens"`
+	Dropped    map[DropReason]int `json:"dropped"`
+	LastDropAt *time.Time         `json:"lastDropAt,omitempty"`
+}
+
+// LimitStatus reports the limits in force and the messages dropped
+type LimitStatus struct {
+	MaxMessageSize          int                `json:"maxMessageSize"`
+	MaxMessageRelationships int                `json:"maxMessageRelationships"`
+	RateLimit               int                `json:"rateLimit"`
+	RateBurst               int                `json:"rateBurst"`
+	Dropped                 map[DropReason]int `json:"dropped"`
+	Peers                   []PeerLimitStatus  `json:"peers"`
+}
+
+func (l *Limiter) Status() LimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := LimitStatus{
+		MaxMessageSize:          config.MaxMessageSize,
+		MaxMessageRelationships: config.MaxMessageRelationships,
+		RateLimit:               config.RateLimit,
+		RateBurst:               config.RateBurst,
+		Dropped:                 make(map[DropReason]int, len(l.dropped)),
+		Peers:                   make([]PeerLimitStatus, 0, len(l.peers)),
+	}
+	for reason, n := range l.dropped {
+		st.Dropped[reason] = n
+	}
+	for id, p := range l.peers {
+		ps := PeerLimitStatus{Peer: id, Tokens: p.bucket.tokens, Dropped: make(map[DropReason]int, len(p.dropped))}
+		for reason, n := range p.dropped {
+			ps.Dropped[reason] = n
+		}
+		if !p.lastDropAt.IsZero() {
+			lastDropAt := p.lastDropAt
+			ps.LastDropAt = &lastDropAt
+		}
+		st.Peers = append(st.Peers, ps)
+	}
+	sort.Slice(st.Peers, func(i, j int) bool { return st.Peers[i].Peer < st.Peers[j].Peer })
+	return st
+}
+
+func getLimits(c *gin.Context) {
+	c.JSON(http.StatusOK, limiter.Status())
+}
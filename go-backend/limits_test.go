@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name       string
+		tokens     float64
+		elapsed    time.Duration
+		wantTaken  bool
+		wantTokens float64
+	}{
+		{name: "full bucket", tokens: 10, wantTaken: true, wantTokens: 9},
+		{name: "empty bucket", tokens: 0, wantTaken: false, wantTokens: 0},
+		{name: "less than a token", tokens: 0.5, wantTaken: false, wantTokens: 0.5},
+		{name: "refilled over time", tokens: 0, elapsed: 2 * time.Second, wantTaken: true, wantTokens: 1},
+		{name: "refill stops at the burst", tokens: 5, elapsed: time.Hour, wantTaken: true, wantTokens: 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One token a second with a burst of 10
+			b := tokenBucket{tokens: tt.tokens, last: start}
+			if got := b.take(start.Add(tt.elapsed), 1, 10); got != tt.wantTaken {
+				t.Errorf("took a token: %v, want %v", got, tt.wantTaken)
+			}
+			if b.tokens != tt.wantTokens {
+				t.Errorf("%v tokens left, want %v", b.tokens, tt.wantTokens)
+			}
+		})
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		trust TrustLevel
+		// wantAllowed is how many of 5 messages in a row pass with a burst
+		// of 3
+		wantAllowed int
+	}{
+		{name: "burst then limited", limit: 60, trust: TrustKnown, wantAllowed: 3},
+		{name: "trusted peers are not limited", limit: 60, trust: TrustTrusted, wantAllowed: 5},
+		{name: "limit disabled", limit: 0, trust: TrustKnown, wantAllowed: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState(t)
+			config.RateLimit, config.RateBurst = tt.limit, 3
+			peerTrust["peer"] = tt.trust
+			l := NewLimiter()
+
+			allowed := 0
+			for i := 0; i < 5; i++ {
+				err := l.allow("peer")
+				if err == nil {
+					allowed++
+				} else if !errors.Is(err, errRateLimited) {
+					t.Fatalf("got error %v", err)
+				}
+			}
+			if allowed != tt.wantAllowed {
+				t.Errorf("allowed %d messages, want %d", allowed, tt.wantAllowed)
+			}
+			if dropped := l.Status().Dropped[DropRateLimited]; dropped != 5-tt.wantAllowed {
+				t.Errorf("counted %d drops, want %d", dropped, 5-tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestLimiterForgetsSenders(t *testing.T) {
+	resetState(t)
+	config.RateLimit, config.RateBurst = 60, 3
+	defer func(n int) { maxLimitedPeers = n }(maxLimitedPeers)
+	maxLimitedPeers = 3
+	start := time.Now()
+
+	tests := []struct {
+		name string
+		// setup fills the limiter before a new sender is tracked
+		setup     func(l *Limiter)
+		wantPeers []PeerID
+	}{
+		{name: "room left keeps everyone", setup: func(l *Limiter) {
+			l.peers["idle"] = &peerLimits{bucket: tokenBucket{tokens: 3, last: start}, dropped: map[DropReason]int{}}
+		}, wantPeers: []PeerID{"idle", "new"}},
+		{name: "refilled buckets are forgotten when full", setup: func(l *Limiter) {
+			l.peers["idle"] = &peerLimits{bucket: tokenBucket{tokens: 1, last: start.Add(-time.Minute)}, dropped: map[DropReason]int{}}
+			l.peers["busy"] = &peerLimits{bucket: tokenBucket{tokens: 0, last: start}, dropped: map[DropReason]int{}}
+			l.peers["dropped"] = &peerLimits{bucket: tokenBucket{tokens: 3, last: start}, dropped: map[DropReason]int{DropTooLarge: 1}, lastDropAt: start}
+		}, wantPeers: []PeerID{"busy", "dropped", "new"}},
+		{name: "oldest sender is evicted when none is idle", setup: func(l *Limiter) {
+			l.peers["old"] = &peerLimits{bucket: tokenBucket{tokens: 0, last: start.Add(-2 * time.Second)}, dropped: map[DropReason]int{}}
+			l.peers["busy"] = &peerLimits{bucket: tokenBucket{tokens: 0, last: start}, dropped: map[DropReason]int{}}
+			l.peers["dropped"] = &peerLimits{bucket: tokenBucket{tokens: 0, last: start.Add(-time.Hour)}, dropped: map[DropReason]int{DropTooLarge: 1}, lastDropAt: start}
+		}, wantPeers: []PeerID{"busy", "dropped", "new"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter()
+			tt.setup(l)
+
+			if err := l.allow("new"); err != nil {
+				t.Fatalf("allow: %v", err)
+			}
+
+			var got []PeerID
+			for _, p := range l.Status().Peers {
+				got = append(got, p.Peer)
+			}
+			if !slices.Equal(got, tt.wantPeers) {
+				t.Errorf("tracking %v, want %v", got, tt.wantPeers)
+			}
+		})
+	}
+}
+
+func TestRouteLimitsSendersBeforeVerifying(t *testing.T) {
+	resetState(t)
+	config.RateBurst = 1
+	sender := NewMemoryNode(NewMemoryHub())
+
+	// Neither message is signed, so only the limit tells them apart
+	unsigned := PubSubMessage{From: sender.id, Data: encode(t, SignedMessage{Payload: []byte(`{}`)})}
+	tests := []struct {
+		name    string
+		wantErr error
+	}{
+		{name: "first message is verified", wantErr: errUnsigned},
+		{name: "second message is limited", wantErr: errRateLimited},
+	}
+	for _, tt := range tests {
+		if err := router.Route(context.Background(), unsigned); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -2,58 +2,167 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-const (
-	pubsubTopic       = "concept-list"
-	publishInterval   = 1 * time.Minute
-	peerCheckInterval = 5 * time.Minute
-)
+const shutdownTimeout = 10 * time.Second
 
 var (
 	node Node_i
 )
 
 func main() {
-	node = NewIPFSShell("localhost:5001")
+	var err error
+	var args []string
+	config, args, err = loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	config.Print(log.Writer())
+	setMFSRoot(config.MFSRoot)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	node, err = newNode(config)
+	if err != nil {
+		log.Fatalf("Failed to create node: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	initializeLists(ctx)
+	if len(args) > 0 {
+		err := runCommand(ctx, args)
+		if flushErr := persister.Flush(context.Background()); flushErr != nil {
+			log.Printf("Failed to flush state: %v", flushErr)
+		}
+		if err != nil {
+			log.Fatalf("%s failed: %v", args[0], err)
+		}
+		return
+	}
 	InitializeSystem(ctx)
+	go persister.Run(ctx, config.PersistInterval)
 
 	// Start IPFS routines
-	go runPeriodicTask(ctx, publishInterval, publishPeerMessage)
-	go runPeriodicTask(ctx, peerCheckInterval, discoverPeers)
-	go subscribeRoutine(ctx)
+	go runPeriodicTask(ctx, config.PublishInterval, publishPeerMessage)
+	go runPeriodicTask(ctx, config.PeerCheckInterval, discoverPeers)
+	if config.PeerEviction > 0 {
+		go runPeriodicTask(ctx, config.PeerCheckInterval, evictStalePeers)
+	}
+	if config.IndexInterval > 0 {
+		go func() {
+			publishPeerIndex(ctx)
+			runPeriodicTask(ctx, config.IndexInterval, publishPeerIndex)
+		}()
+	}
+	if config.ReplicationWorkers > 0 {
+		go replicator.Run(ctx, config.ReplicationWorkers)
+	}
+	go pullKnownPeerIndexes(ctx)
+	go runPeriodicTask(ctx, tombstoneGCInterval, expireTombstones)
+	if config.ReconcileInterval > 0 {
+		go runPeriodicTask(ctx, config.ReconcileInterval, reconcileWithNextPeer)
+	}
+	if config.GCInterval > 0 {
+		go runPeriodicTask(ctx, config.GCInterval, runPinGC)
+	}
+	startSubscription(ctx, config.PubsubTopic, router.Route)
+	subscribeDirectMessages(ctx)
 
 	// Set up Gin router
 	r := gin.Default()
 	setupRoutes(r)
 
 	// Start server
-	log.Fatal(r.Run(":9090"))
+	srv := &http.Server{Addr: config.ListenAddr, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("HTTP server failed: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down HTTP server: %v", err)
+	}
+	if err := persister.Flush(shutdownCtx); err != nil {
+		log.Printf("Failed to flush state on shutdown: %v", err)
+	}
+}
+
+func newNode(c Config) (Node_i, error) {
+	switch c.Backend {
+	case "ipfs":
+		return NewIPFSShell(c.IPFSAPI, c.BootstrapPeers, c.Timeouts), nil
+	case "memory":
+		return NewMemoryNode(NewMemoryHub()), nil
+	case "fs":
+		return NewFilesystemNode(c.DataDir)
+	default:
+		return nil, fmt.Errorf("unknown backend: %s", c.Backend)
+	}
 }
 
 func setupRoutes(r *gin.Engine) {
 	r.Use(corsMiddleware())
 	r.POST("/concept", addConcept)
 	r.GET("/concept/:guid", getConcept)
+	r.GET("/concept/:guid/content", getConceptContent)
+	r.GET("/concept/:guid/history", getConceptHistory)
+	r.GET("/concept/:guid/version/:cid", getConceptVersion)
+	r.POST("/concept/:guid/version/:cid/restore", restoreConceptVersion)
 	r.POST("/owner", updateOwner)
 	r.GET("/owner", getOwner)
 	r.DELETE("/concept/:guid", deleteConcept)
 	r.GET("/concepts", queryConcepts)
 	r.GET("/peers", listPeers)
+	r.GET("/peers/:id", getPeer)
+	r.GET("/peers/:id/index", getPeerIndex)
+	r.POST("/peers/:id/index", pullPeerIndexHandler)
+	r.PUT("/peers/:id/trust", updatePeerTrust)
+	r.GET("/trust", getTrust)
+	r.GET("/quarantine", getQuarantine)
+	r.POST("/quarantine/:id/approve", approveQuarantinedItem)
+	r.DELETE("/quarantine/:id", rejectQuarantinedItem)
+	r.GET("/subscriptions", getSubscriptions)
+	r.GET("/admin/limits", getLimits)
+	r.GET("/persistence", getPersistenceStatus)
+	r.POST("/persistence/flush", flushPersistence)
+	r.GET("/gc", getGCReport)
+	r.POST("/gc", runGC)
+	r.GET("/tombstones", getTombstones)
+	r.GET("/reconciliations", getReconciliations)
+	r.GET("/export.car", exportGraph)
+	r.POST("/import", importGraph)
 	r.GET("/ws", handleWebSocket)
 	r.GET("/ws/peers", handlePeerWebSocket)
+	r.GET("/ws/messages", handleDirectMessageWebSocket)
+	r.POST("/messages", sendDirectMessageHandler)
+	r.GET("/messages", listDirectMessages)
+	r.POST("/messages/:id/read", markDirectMessageRead)
+	r.GET("/owner-keys", getOwnerKeys)
+	r.PUT("/owner-keys/:guid", updateOwnerKey)
 	r.POST("/relationship", addRelationship)
 	r.PUT("/relationship/:id/deepen", deepenRelationship)
 	r.GET("/relationship/:id", getRelationship)
+	r.DELETE("/relationship/:id", deleteRelationship)
 	r.GET("/relationship-types", getRelationshipTypes)
 	r.GET("/relationship-type/:type", getRelationshipsByType)
 	r.GET("/interact/:id", interactWithRelationship)
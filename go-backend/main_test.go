@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// resetState points the node at a fresh in-memory backend and clears the
+// state the tests touch. The replicator and the limiter are swapped for
+// fresh ones until the test ends.
+func resetState(t *testing.T) *MemoryNode {
+	t.Helper()
+	n := NewMemoryNode(NewMemoryHub())
+	node = n
+	peerID = n.id
+	config = defaultConfig()
+	ownerMu.Lock()
+	ownerGUID = ""
+	ownerMu.Unlock()
+
+	prevReplicator, prevLimiter := replicator, limiter
+	replicator = newTestReplicator()
+	limiter = NewLimiter()
+	t.Cleanup(func() {
+		replicator = prevReplicator
+		limiter = prevLimiter
+	})
+
+	conceptMap = make(map[GUID]*Concept)
+	GUID2CID = make(map[GUID]CID)
+	relationshipMap = make(RelationshipMap)
+	relationship2CID = make(map[GUID]CID)
+	conceptVersions = make(map[GUID][]CID)
+	versionContent = make(map[CID]CID)
+	managedPins = make(map[CID]time.Time)
+	remoteConcepts = make(RemoteConceptMap)
+	peerMap = PeerMap{peerID: &Peer{ID: peerID, Timestamp: time.Now(), CIDs: make(map[CID]bool)}}
+
+	tombstones = make(map[string]Tombstone)
+	peerTrust = make(map[PeerID]TrustLevel)
+	quarantine = make(map[string]*QuarantinedItem)
+	reindexQuarantine()
+	changeLog = ChangeLog{Relationships: make(map[GUID]CID)}
+	peerSyncStates = make(map[PeerID]*peerSyncState)
+	mergedRelationships = make(map[PeerID]map[GUID]CID)
+	reconciliations = make(map[PeerID]*Reconciliation)
+	inbox = make(map[string]*InboxMessage)
+	pinnedKeys = make(map[GUID][]byte)
+	keyChanges = make(map[GUID]KeyChange)
+	return n
+}
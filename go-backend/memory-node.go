@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	gocid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const memorySubscriptionBuffer = 64
+
+// MemoryHub connects MemoryNode instances living in the same process so they
+// can discover each other and exchange pubsub messages without a daemon
+type MemoryHub struct {
+	mu     sync.RWMutex
+	nodes  map[PeerID]*MemoryNode
+	topics map[string]map[*memorySubscription]struct{}
+	names  map[PeerID]CID
+}
+
+type memorySubscription struct {
+	ch chan PubSubMessage
+}
+
+func NewMemoryHub() *MemoryHub {
+	return &MemoryHub{
+		nodes:  make(map[PeerID]*MemoryNode),
+		topics: make(map[string]map[*memorySubscription]struct{}),
+		names:  make(map[PeerID]CID),
+	}
+}
+
+func (h *MemoryHub) register(n *MemoryNode) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nodes[n.id] = n
+}
+
+func (h *MemoryHub) lookup(peerID PeerID) (*MemoryNode, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n, ok := h.nodes[peerID]
+	return n, ok
+}
+
+func (h *MemoryHub) publishName(peerID PeerID, cid CID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.names[peerID] = cid
+}
+
+func (h *MemoryHub) resolveName(peerID PeerID) (CID, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	cid, ok := h.names[peerID]
+	if !ok {
+		return "", fmt.Errorf("no name published by %s", peerID)
+	}
+	return cid, nil
+}
+
+func (h *MemoryHub) peerIDs() []PeerID {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ids := make([]PeerID, 0, len(h.nodes))
+	for id := range h.nodes {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (h *MemoryHub) subscribe(topic string) *memorySubscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub := &memorySubscription{ch: make(chan PubSubMessage, memorySubscriptionBuffer)}
+	if h.topics[topic] == nil {
+		h.topics[topic] = make(map[*memorySubscription]struct{})
+	}
+	h.topics[topic][sub] = struct{}{}
+	return sub
+}
+
+func (h *MemoryHub) unsubscribe(topic string, sub *memorySubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.topics[topic], sub)
+	if len(h.topics[topic]) == 0 {
+		delete(h.topics, topic)
+	}
+	close(sub.ch)
+}
+
+// listen forwards messages published on topic until ctx is done
+func (h *MemoryHub) listen(ctx context.Context, topic string) <-chan PubSubMessage {
+	sub := h.subscribe(topic)
+
+	ch := make(chan PubSubMessage)
+	go func() {
+		defer close(ch)
+		defer h.unsubscribe(topic, sub)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-sub.ch:
+				select {
+				case ch <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func (h *MemoryHub) publish(from PeerID, topic string, data []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.topics[topic] {
+		msg := PubSubMessage{From: from, Data: make([]byte, len(data))}
+		copy(msg.Data, data)
+		select {
+		case sub.ch <- msg:
+		default:
+			log.Printf("Dropping message on topic %s: subscriber is not keeping up", topic)
+		}
+	}
+}
+
+// MemoryNode implements the Node_i interface entirely in memory. Content is
+// addressed by real CIDs and pubsub is shared through a MemoryHub.
+type MemoryNode struct {
+	id  PeerID
+	key crypto.PrivKey
+	hub *MemoryHub
+
+	mu        sync.RWMutex
+	blocks    map[CID][]byte
+	pins      map[CID]bool
+	files     map[string][]byte
+	connected map[PeerID]time.Time
+}
+
+func NewMemoryNode(hub *MemoryHub) *MemoryNode {
+	key, id := newNodeKey()
+	n := &MemoryNode{
+		id:        id,
+		key:       key,
+		hub:       hub,
+		blocks:    make(map[CID][]byte),
+		pins:      make(map[CID]bool),
+		files:     make(map[string][]byte),
+		connected: make(map[PeerID]time.Time),
+	}
+	hub.register(n)
+	return n
+}
+
+// newNodeKey generates the key of a node and the PeerID derived from it
+func newNodeKey() (crypto.PrivKey, PeerID) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate node key: %v", err))
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		panic(fmt.Sprintf("failed to derive peer ID: %v", err))
+	}
+	return key, PeerID(id.String())
+}
+
+func (m *MemoryNode) Add(ctx context.Context, content io.Reader) (CID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to read content: %v", err)
+	}
+	root, blocks, err := buildUnixFSFile(data)
+	if err != nil {
+		return "", err
+	}
+
+	cid := CID(root.String())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, block := range blocks {
+		m.blocks[CID(block.CID.String())] = block.Data
+	}
+	m.pins[cid] = true
+	return cid, nil
+}
+
+func (m *MemoryNode) Get(ctx context.Context, cid CID) (io.ReadCloser, error) {
+	root, err := gocid.Decode(string(cid))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CID %s: %v", cid, err)
+	}
+
+	var buf bytes.Buffer
+	if err := readUnixFSFile(ctx, root, m.getBlock, &buf); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&buf), nil
+}
+
+func (m *MemoryNode) getBlock(c gocid.Cid) ([]byte, error) {
+	cid := CID(c.String())
+	m.mu.RLock()
+	data, ok := m.blocks[cid]
+	m.mu.RUnlock()
+	if ok {
+		return data, nil
+	}
+
+	// Fall back to connected peers, the way bitswap would
+	for _, id := range m.connectedPeers() {
+		peer, ok := m.hub.lookup(id)
+		if !ok {
+			continue
+		}
+		peer.mu.RLock()
+		data, ok := peer.blocks[cid]
+		peer.mu.RUnlock()
+		if ok {
+			m.mu.Lock()
+			m.blocks[cid] = data
+			m.mu.Unlock()
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("content not found: %s", cid)
+}
+
+func (m *MemoryNode) Remove(ctx context.Context, cid CID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.pins[cid] {
+		return fmt.Errorf("not pinned: %s", cid)
+	}
+	delete(m.pins, cid)
+	delete(m.blocks, cid)
+	return nil
+}
+
+func (m *MemoryNode) List(ctx context.Context) ([]CID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ret := make([]CID, 0, len(m.pins))
+	for cid := range m.pins {
+		ret = append(ret, cid)
+	}
+	return ret, nil
+}
+
+func (m *MemoryNode) PutBlock(ctx context.Context, codec uint64, data []byte, pin bool) (CID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	c, err := newCID(codec, data)
+	if err != nil {
+		return "", err
+	}
+	cid := CID(c.String())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blocks[cid] = bytes.Clone(data)
+	if pin {
+		m.pins[cid] = true
+	}
+	return cid, nil
+}
+
+func (m *MemoryNode) GetBlock(ctx context.Context, cid CID) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c, err := gocid.Decode(string(cid))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CID %s: %v", cid, err)
+	}
+	return m.getBlock(c)
+}
+
+func (m *MemoryNode) Load(ctx context.Context, path string, target interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.RLock()
+	data, ok := m.files[path]
+	m.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", errNotFound, path)
+	}
+
+	if err := json.Unmarshal(data, target); err != nil {
+		return fmt.Errorf("failed to decode data: %v", err)
+	}
+	return nil
+}
+
+func (m *MemoryNode) Save(ctx context.Context, path string, data interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal data: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[path] = jsonData
+	return nil
+}
+
+func (m *MemoryNode) Delete(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, path)
+	return nil
+}
+
+func (m *MemoryNode) PublishName(ctx context.Context, cid CID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.hub.publishName(m.id, cid)
+	return nil
+}
+
+func (m *MemoryNode) ResolveName(ctx context.Context, peerID PeerID) (CID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return m.hub.resolveName(peerID)
+}
+
+func (m *MemoryNode) Publish(ctx context.Context, topic string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.hub.publish(m.id, topic, data)
+	return nil
+}
+
+func (m *MemoryNode) Subscribe(ctx context.Context, topic string) (<-chan PubSubMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.hub.listen(ctx, topic), nil
+}
+
+func (m *MemoryNode) Connect(ctx context.Context, peerID PeerID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if peerID == m.id {
+		return fmt.Errorf("cannot connect to self")
+	}
+	peer, ok := m.hub.lookup(peerID)
+	if !ok {
+		return fmt.Errorf("peer not found: %s", peerID)
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	m.connected[peerID] = now
+	m.mu.Unlock()
+
+	peer.mu.Lock()
+	peer.connected[m.id] = now
+	peer.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryNode) connectedPeers() []PeerID {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]PeerID, 0, len(m.connected))
+	for id := range m.connected {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (m *MemoryNode) ListPeers(ctx context.Context) ([]Peer_i, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ids := m.connectedPeers()
+	peers := make([]Peer_i, len(ids))
+	for j, id := range ids {
+		peers[j] = &Peer{
+			ID:        id,
+			Timestamp: time.Now(),
+		}
+	}
+	return peers, nil
+}
+
+func (m *MemoryNode) Bootstrap(ctx context.Context) error {
+	for _, id := range m.hub.peerIDs() {
+		if id == m.id {
+			continue
+		}
+		if err := m.Connect(ctx, id); err != nil {
+			log.Printf("Failed to connect to bootstrap node %s: %v", id, err)
+		} else {
+			log.Printf("Connected to bootstrap node: %s", id)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryNode) ID(ctx context.Context) (PeerID, error) {
+	return m.id, nil
+}
+
+func (m *MemoryNode) Sign(ctx context.Context, data []byte) ([]byte, []byte, error) {
+	return signWithKey(m.key, data)
+}
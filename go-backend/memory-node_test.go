@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gocid "github.com/ipfs/go-cid"
+)
+
+func receive(t *testing.T, ch <-chan PubSubMessage) (PubSubMessage, bool) {
+	t.Helper()
+	select {
+	case msg, ok := <-ch:
+		return msg, ok
+	case <-time.After(time.Second):
+		return PubSubMessage{}, false
+	}
+}
+
+func TestMemoryHubPubSub(t *testing.T) {
+	tests := []struct {
+		name string
+		// subscribed lists the nodes subscribed to the topic, by index
+		subscribed []int
+		publisher  int
+		topic      string
+		// want lists the nodes expected to receive the message
+		want []int
+	}{
+		{name: "every subscriber receives", subscribed: []int{0, 1, 2}, publisher: 0, topic: "ccn", want: []int{0, 1, 2}},
+		{name: "publisher need not subscribe", subscribed: []int{1, 2}, publisher: 0, topic: "ccn", want: []int{1, 2}},
+		{name: "only subscribers receive", subscribed: []int{0, 2}, publisher: 1, topic: "ccn", want: []int{0, 2}},
+		{name: "other topics are not delivered", subscribed: []int{0, 1, 2}, publisher: 0, topic: "other", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			hub := NewMemoryHub()
+			nodes := []*MemoryNode{NewMemoryNode(hub), NewMemoryNode(hub), NewMemoryNode(hub)}
+			subs := make(map[int]<-chan PubSubMessage)
+			for _, i := range tt.subscribed {
+				ch, err := nodes[i].Subscribe(ctx, "ccn")
+				if err != nil {
+					t.Fatalf("Subscribe: %v", err)
+				}
+				subs[i] = ch
+			}
+
+			if err := nodes[tt.publisher].Publish(ctx, tt.topic, []byte("hello")); err != nil {
+				t.Fatalf("Publish: %v", err)
+			}
+
+			for _, i := range tt.want {
+				msg, ok := receive(t, subs[i])
+				if !ok {
+					t.Fatalf("node %d received nothing", i)
+				}
+				if msg.From != nodes[tt.publisher].id || string(msg.Data) != "hello" {
+					t.Errorf("node %d received %q from %s, want %q from %s", i, msg.Data, msg.From, "hello", nodes[tt.publisher].id)
+				}
+			}
+			for i, ch := range subs {
+				select {
+				case msg := <-ch:
+					if len(tt.want) == 0 {
+						t.Errorf("node %d received %q on another topic", i, msg.Data)
+					} else {
+						t.Errorf("node %d received a second message %q", i, msg.Data)
+					}
+				default:
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryHubUnsubscribeOnCancel(t *testing.T) {
+	hub := NewMemoryHub()
+	a, b := NewMemoryNode(hub), NewMemoryNode(hub)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := a.Subscribe(ctx, "ccn")
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	cancel()
+	if _, ok := receive(t, ch); ok {
+		t.Fatal("channel still open after cancel")
+	}
+
+	if err := b.Publish(context.Background(), "ccn", []byte("hello")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	if n := len(hub.topics["ccn"]); n != 0 {
+		t.Errorf("%d subscriptions left on the topic", n)
+	}
+}
+
+func TestMemoryNodeFetchesBlocksFromConnectedPeers(t *testing.T) {
+	ctx := context.Background()
+	hub := NewMemoryHub()
+	a, b := NewMemoryNode(hub), NewMemoryNode(hub)
+
+	cid, err := a.PutBlock(ctx, gocid.DagJSON, []byte(`{"hello":"world"}`), true)
+	if err != nil {
+		t.Fatalf("PutBlock: %v", err)
+	}
+	if _, err := b.GetBlock(ctx, cid); err == nil {
+		t.Fatal("block found on an unconnected node")
+	}
+	if err := b.Connect(ctx, a.id); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	data, err := b.GetBlock(ctx, cid)
+	if err != nil {
+		t.Fatalf("GetBlock: %v", err)
+	}
+	if string(data) != `{"hello":"world"}` {
+		t.Errorf("got %s", data)
+	}
+}
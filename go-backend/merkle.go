@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// A merkleTree hashes a set of items into ranges keyed by the hex prefix of
+// the hash of their keys. The tree is merkleDepth digits deep and only holds
+// the ranges that have items, so two peers can compare the root, then the
+// children of every range that differs, down to the items themselves. Every
+// item is hashed with a value, so two peers holding the same key with
+// different values differ.
+const (
+	merkleDepth = 4
+	// merkleLeafSize is the number of items below which a range is sent
+	// whole instead of split into its children
+	merkleLeafSize = 16
+)
+
+const hexDigits = "0123456789abcdef"
+
+type merkleTree struct {
+	items map[string]string
+	// paths holds the leaf range of every item
+	paths  map[string]string
+	hashes map[string]string
+}
+
+func newMerkleTree(items map[string]string) *merkleTree {
+	t := &merkleTree{items: items, paths: make(map[string]string, len(items)), hashes: make(map[string]string)}
+
+	leaves := make(map[string][]string)
+	for key := range items {
+		path := merklePath(key)
+		t.paths[key] = path
+		leaves[path] = append(leaves[path], key)
+	}
+	level := make(map[string]string, len(leaves))
+	for path, keys := range leaves {
+		slices.Sort(keys)
+		h := sha256.New()
+		for _, key := range keys {
+			fmt.Fprintf(h, "%s %s\n", key, items[key])
+		}
+		level[path] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	for depth := merkleDepth; ; depth-- {
+		maps.Copy(t.hashes, level)
+		if depth == 0 {
+			return t
+		}
+		children := make(map[string][]string)
+		for path := range level {
+			children[path[:depth-1]] = append(children[path[:depth-1]], path)
+		}
+		parents := make(map[string]string, len(children))
+		for parent, paths := range children {
+			slices.Sort(paths)
+			h := sha256.New()
+			for _, path := range paths {
+				fmt.Fprintf(h, "%s %s\n", path, level[path])
+			}
+			parents[parent] = hex.EncodeToString(h.Sum(nil))
+		}
+		level = parents
+	}
+}
+
+func merklePath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:merkleDepth]
+}
+
+// hash returns the hash of a range, empty if the range holds no items
+func (t *merkleTree) hash(prefix string) string {
+	return t.hashes[prefix]
+}
+
+// children returns the hashes of the non-empty subranges of a range
+func (t *merkleTree) children(prefix string) map[string]string {
+	children := make(map[string]string)
+	for _, digit := range hexDigits {
+		if h, ok := t.hashes[prefix+string(digit)]; ok {
+			children[prefix+string(digit)] = h
+		}
+	}
+	return children
+}
+
+// itemsIn returns the items of a range
+func (t *merkleTree) itemsIn(prefix string) map[string]string {
+	items := make(map[string]string)
+	for key, path := range t.paths {
+		if strings.HasPrefix(path, prefix) {
+			items[key] = t.items[key]
+		}
+	}
+	return items
+}
+
+// splits reports whether a range is compared by its children rather than
+// sent whole
+func (t *merkleTree) splits(prefix string) bool {
+	if len(prefix) >= merkleDepth {
+		return false
+	}
+	n := 0
+	for _, path := range t.paths {
+		if strings.HasPrefix(path, prefix) {
+			if n++; n > merkleLeafSize {
+				return true
+			}
+		}
+	}
+	return false
+}
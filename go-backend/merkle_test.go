@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func merkleItems(n int) map[string]string {
+	items := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		items[fmt.Sprintf("item-%d", i)] = fmt.Sprintf("value-%d", i)
+	}
+	return items
+}
+
+// reconcileTrees runs the exchange of anti_entropy.go between the tree we
+// hold and the tree of a peer. It returns the keys whose items differ, the
+// number of requests sent and the number of items the peer sent.
+func reconcileTrees(ours, theirs *merkleTree) (diff []string, rounds, sent int) {
+	differ := make(map[string]bool)
+	ranges := []MerkleRange{{Prefix: "", Hash: ours.hash("")}}
+	for len(ranges) > 0 {
+		rounds++
+		var next []MerkleRange
+		for _, r := range ranges {
+			if theirs.hash(r.Prefix) == r.Hash {
+				continue
+			}
+			if theirs.splits(r.Prefix) {
+				children := theirs.children(r.Prefix)
+				for child, h := range ours.children(r.Prefix) {
+					if children[child] != h {
+						next = append(next, MerkleRange{Prefix: child, Hash: h})
+					}
+				}
+				for child := range children {
+					if _, ok := ours.hashes[child]; !ok {
+						next = append(next, MerkleRange{Prefix: child})
+					}
+				}
+				continue
+			}
+			items, own := theirs.itemsIn(r.Prefix), ours.itemsIn(r.Prefix)
+			sent += len(items)
+			for key, cid := range items {
+				if own[key] != cid {
+					differ[key] = true
+				}
+			}
+			for key := range own {
+				if _, ok := items[key]; !ok {
+					differ[key] = true
+				}
+			}
+		}
+		ranges = next
+	}
+	return sortedKeys(differ), rounds, sent
+}
+
+func TestMerkleTreeHash(t *testing.T) {
+	items := merkleItems(100)
+	changed := maps.Clone(items)
+	changed["item-7"] = "other"
+
+	tests := []struct {
+		name     string
+		a, b     map[string]string
+		wantSame bool
+	}{
+		{name: "same items", a: items, b: maps.Clone(items), wantSame: true},
+		{name: "no items", a: map[string]string{}, b: nil, wantSame: true},
+		{name: "item changed", a: items, b: changed},
+		{name: "item missing", a: items, b: merkleItems(99)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newMerkleTree(tt.a), newMerkleTree(tt.b)
+			if same := a.hash("") == b.hash(""); same != tt.wantSame {
+				t.Errorf("roots %q and %q, want same: %v", a.hash(""), b.hash(""), tt.wantSame)
+			}
+		})
+	}
+	if h := newMerkleTree(nil).hash(""); h != "" {
+		t.Errorf("empty tree hashes to %q", h)
+	}
+}
+
+func TestMerkleDiff(t *testing.T) {
+	base := merkleItems(2000)
+	with := func(change func(items map[string]string)) map[string]string {
+		items := maps.Clone(base)
+		change(items)
+		return items
+	}
+
+	tests := []struct {
+		name         string
+		ours, theirs map[string]string
+		want         []string
+		// maxSent bounds the items the peer sends, 0 for all of them
+		maxSent int
+	}{
+		{name: "in sync", ours: base, theirs: base},
+		{name: "item changed", ours: base, theirs: with(func(m map[string]string) { m["item-42"] = "new" }), want: []string{"item-42"}, maxSent: merkleLeafSize},
+		{name: "item added", ours: base, theirs: with(func(m map[string]string) { m["item-new"] = "new" }), want: []string{"item-new"}, maxSent: merkleLeafSize},
+		{name: "item removed", ours: base, theirs: with(func(m map[string]string) { delete(m, "item-1999") }), want: []string{"item-1999"}, maxSent: merkleLeafSize},
+		{name: "several changes", ours: base, theirs: with(func(m map[string]string) {
+			m["item-1"], m["item-500"] = "new", "new"
+			delete(m, "item-1000")
+		}), want: []string{"item-1", "item-1000", "item-500"}, maxSent: 3 * merkleLeafSize},
+		{name: "nothing on our side", ours: nil, theirs: merkleItems(50), want: sortedKeys(merkleItems(50))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff, rounds, sent := reconcileTrees(newMerkleTree(tt.ours), newMerkleTree(tt.theirs))
+			if !slices.Equal(diff, tt.want) {
+				t.Errorf("got %v, want %v", diff, tt.want)
+			}
+			if rounds > merkleDepth+1 {
+				t.Errorf("took %d rounds, want at most %d", rounds, merkleDepth+1)
+			}
+			if tt.maxSent > 0 && sent > tt.maxSent {
+				t.Errorf("peer sent %d items, want at most %d", sent, tt.maxSent)
+			}
+		})
+	}
+}
+
+func TestMerkleTreeSplits(t *testing.T) {
+	tests := []struct {
+		name   string
+		items  int
+		prefix string
+		want   bool
+	}{
+		{name: "small range is sent whole", items: merkleLeafSize, prefix: "", want: false},
+		{name: "large range is split", items: merkleLeafSize + 1, prefix: "", want: true},
+		{name: "deepest range is never split", items: 1000, prefix: "0000", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newMerkleTree(merkleItems(tt.items)).splits(tt.prefix); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelationshipTree(t *testing.T) {
+	resetState(t)
+	r := CreateRelationship("source", "target", "type")
+	r.Deepen()
+	deepened := r.clone()
+	deepened.Deepen()
+	block, err := relationshipBlock(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeRelationship(block.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		theirs   *Relationship
+		cid      CID
+		wantSame bool
+	}{
+		{name: "same state stored in another block", theirs: r.clone(), cid: "their-block", wantSame: true},
+		{name: "same state decoded from its block", theirs: decoded, cid: CID(block.CID.String()), wantSame: true},
+		{name: "same state merged back", theirs: mergeRelationship(r, r.clone()), cid: "merged-block", wantSame: true},
+		{name: "state changed", theirs: deepened, cid: "their-block"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relationshipMap = RelationshipMap{r.ID: r}
+			relationship2CID = map[GUID]CID{r.ID: "our-block"}
+			ours := relationshipTree()
+
+			relationshipMap = RelationshipMap{r.ID: tt.theirs}
+			relationship2CID = map[GUID]CID{r.ID: tt.cid}
+			theirs := relationshipTree()
+			if same := ours.hash("") == theirs.hash(""); same != tt.wantSame {
+				t.Errorf("roots %q and %q, want same: %v", ours.hash(""), theirs.hash(""), tt.wantSame)
+			}
+
+			leaf := leafRange(MerkleRelationships, "", theirs)
+			if leaf.Items[string(r.ID)] != tt.cid || leaf.Digests[string(r.ID)] != tt.theirs.digest() {
+				t.Errorf("leaf holds %v with digests %v, want the block and digest of the relationship", leaf.Items, leaf.Digests)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	gocid "github.com/ipfs/go-cid"
+)
+
+// The files under the MFS root carry a layout version in schema.json. Nodes
+// created before it existed are at version 0. Each migration moves the
+// persisted files one version up and works on the files directly, before
+// anything is loaded into memory. Changing how Concept, Relationship or Peer
+// are persisted means adding a migration at the end of the list.
+
+type migration struct {
+	description string
+	run         func(ctx context.Context) error
+}
+
+var migrations = []migration{
+	{"store relationships as individual nodes", migrateRelationshipIndex},
+}
+
+// schemaVersion is the layout version this build reads and writes
+var schemaVersion = len(migrations)
+
+type schemaInfo struct {
+	Version int
+}
+
+// migrateSchema brings the persisted files up to schemaVersion
+func migrateSchema(ctx context.Context) error {
+	var info schemaInfo
+	err := node.Load(ctx, schemaPath, &info)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+	if err != nil {
+		var owner GUID
+		err := node.Load(ctx, ownerGUIDPath, &owner)
+		if errors.Is(err, errNotFound) {
+			// Nothing was ever written, start at the current layout
+			log.Printf("Initializing schema version %d", schemaVersion)
+			return node.Save(ctx, schemaPath, schemaInfo{Version: schemaVersion})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read owner GUID: %v", err)
+		}
+		// Written before the schema version existed, so at version 0
+	}
+
+	if info.Version > schemaVersion {
+		return fmt.Errorf("data was written with schema version %d, this build only supports up to %d", info.Version, schemaVersion)
+	}
+	for info.Version < schemaVersion {
+		m := migrations[info.Version]
+		log.Printf("Migrating schema to version %d: %s", info.Version+1, m.description)
+		if err := m.run(ctx); err != nil {
+			return fmt.Errorf("migration to version %d failed: %v", info.Version+1, err)
+		}
+		info.Version++
+		// Saved after every step, so an interrupted run resumes where it
+		// stopped
+		if err := node.Save(ctx, schemaPath, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateRelationshipIndex stores every relationship of the old single
+// relationships file as its own node and writes the relationship index.
+// Pins are adopted once the state is loaded. The old file is deleted once
+// the index is saved, so it cannot be mistaken for current data. A run that
+// was interrupted before skips the relationships already in the index.
+func migrateRelationshipIndex(ctx context.Context) error {
+	var legacy RelationshipMap
+	if err := node.Load(ctx, relationshipsPath, &legacy); errors.Is(err, errNotFound) {
+		log.Println("No relationships to migrate")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	concepts := make(map[GUID]CID)
+	if err := node.Load(ctx, GUID2CIDPath, &concepts); errors.Is(err, errNotFound) {
+		log.Println("Migrating relationships without concept links")
+	} else if err != nil {
+		return err
+	}
+	index := make(map[GUID]CID)
+	if err := node.Load(ctx, relationshipIndexPath, &index); errors.Is(err, errNotFound) {
+		log.Println("Creating relationship index")
+	} else if err != nil {
+		return err
+	}
+
+	ref := func(guid GUID) dagRef { return dagRef{GUID: guid, CID: concepts[guid]} }
+	for id, r := range legacy {
+		if _, ok := index[id]; ok {
+			continue
+		}
+		if r.ID == "" {
+			r.ID = id
+		}
+		data, err := encodeRelationship(r, ref(r.SourceID), ref(r.TargetID), ref(r.Type))
+		if err != nil {
+			return fmt.Errorf("relationship %s: %v", id, err)
+		}
+		cid, err := node.PutBlock(ctx, gocid.DagJSON, data, true)
+		if err != nil {
+			return fmt.Errorf("relationship %s: %v", id, err)
+		}
+		index[id] = cid
+	}
+	log.Printf("Stored %d relationships from the relationships file", len(legacy))
+	if err := node.Save(ctx, relationshipIndexPath, index); err != nil {
+		return err
+	}
+	return node.Delete(ctx, relationshipsPath)
+}
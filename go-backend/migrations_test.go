@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	gocid "github.com/ipfs/go-cid"
+)
+
+func TestMigrateSchema(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       map[string]string
+		wantErr     bool
+		wantVersion int
+	}{
+		{name: "new node starts at the current version", wantVersion: schemaVersion},
+		{name: "node from before schema versions is migrated", files: map[string]string{ownerGUIDPath: `"owner"`}, wantVersion: schemaVersion},
+		{name: "current node is left alone", files: map[string]string{schemaPath: `{"Version":1}`}, wantVersion: schemaVersion},
+		{name: "unreadable schema fails", files: map[string]string{schemaPath: `{"Version":`, ownerGUIDPath: `"owner"`}, wantErr: true},
+		{name: "unreadable owner fails", files: map[string]string{ownerGUIDPath: `"owner`}, wantErr: true},
+		{name: "newer schema fails", files: map[string]string{schemaPath: `{"Version":99}`}, wantErr: true},
+		{name: "unreadable relationships fail the migration", files: map[string]string{ownerGUIDPath: `"owner"`, relationshipsPath: `{`}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			n := resetState(t)
+			for path, data := range tt.files {
+				n.files[path] = []byte(data)
+			}
+
+			err := migrateSchema(ctx)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("migration succeeded")
+				}
+				if data, ok := tt.files[schemaPath]; ok && string(n.files[schemaPath]) != data {
+					t.Errorf("schema was overwritten with %s", n.files[schemaPath])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("migrateSchema: %v", err)
+			}
+			var info schemaInfo
+			if err := n.Load(ctx, schemaPath, &info); err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if info.Version != tt.wantVersion {
+				t.Errorf("schema version is %d, want %d", info.Version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestMigrateRelationshipIndex(t *testing.T) {
+	const legacy = `{"r1":{"ID":"r1","SourceID":"s","TargetID":"t","Interactions":2},"r2":{"SourceID":"t","TargetID":"s"}}`
+
+	tests := []struct {
+		name string
+		// index is the relationship index an earlier, interrupted run saved
+		index map[GUID]CID
+		// legacy is whether the old relationships file is still there
+		legacy bool
+		// wantKept lists the relationships whose node from the earlier run
+		// is kept
+		wantKept []GUID
+		want     []GUID
+	}{
+		{name: "relationships file is split into nodes", legacy: true, want: []GUID{"r1", "r2"}},
+		{name: "run interrupted before the file was deleted resumes", index: map[GUID]CID{"r1": ""}, legacy: true,
+			wantKept: []GUID{"r1"}, want: []GUID{"r1", "r2"}},
+		{name: "run interrupted after the file was deleted finishes", index: map[GUID]CID{"r1": "", "r2": ""},
+			wantKept: []GUID{"r1", "r2"}, want: []GUID{"r1", "r2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			n := resetState(t)
+			n.files[ownerGUIDPath] = []byte(`"owner"`)
+			n.files[GUID2CIDPath] = []byte(`{"s":"` + string(dagJSONCID(t, `{"GUID":"s"}`)) + `"}`)
+			if tt.legacy {
+				n.files[relationshipsPath] = []byte(legacy)
+			}
+			if tt.index != nil {
+				for id := range tt.index {
+					tt.index[id] = dagJSONCID(t, `{"ID":"`+string(id)+`","earlier":true}`)
+				}
+				if err := n.Save(ctx, relationshipIndexPath, tt.index); err != nil {
+					t.Fatalf("Save: %v", err)
+				}
+			}
+
+			if err := migrateSchema(ctx); err != nil {
+				t.Fatalf("migrateSchema: %v", err)
+			}
+
+			var info schemaInfo
+			if err := n.Load(ctx, schemaPath, &info); err != nil || info.Version != schemaVersion {
+				t.Errorf("schema version is %d (%v), want %d", info.Version, err, schemaVersion)
+			}
+			if _, ok := n.files[relationshipsPath]; ok {
+				t.Error("relationships file was not deleted")
+			}
+			index := make(map[GUID]CID)
+			if err := n.Load(ctx, relationshipIndexPath, &index); err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if got := sortedKeys(index); !slices.Equal(got, tt.want) {
+				t.Fatalf("index holds %v, want %v", got, tt.want)
+			}
+			for _, id := range tt.want {
+				if slices.Contains(tt.wantKept, id) {
+					if index[id] != tt.index[id] {
+						t.Errorf("%s points at %s, want the node %s stored before", id, index[id], tt.index[id])
+					}
+					continue
+				}
+				r, _, err := fetchRelationship(ctx, id, index[id])
+				if err != nil {
+					t.Errorf("fetchRelationship %s: %v", id, err)
+				}
+				if id == "r1" && (r == nil || r.Interactions != 2 || r.SourceID != "s") {
+					t.Errorf("r1 migrated as %+v", r)
+				}
+			}
+		})
+	}
+}
+
+// dagJSONCID stores a DAG-JSON block on the node and returns its CID
+func dagJSONCID(t *testing.T, data string) CID {
+	t.Helper()
+	cid, err := node.PutBlock(context.Background(), gocid.DagJSON, []byte(data), true)
+	if err != nil {
+		t.Fatalf("PutBlock: %v", err)
+	}
+	return cid
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -23,42 +24,42 @@ func listPeers(c *gin.Context) {
 	c.JSON(http.StatusOK, filteredPeerMap)
 }
 
-func addOrUpdatePeer(peerID PeerID, ownerGUID GUID) {
+// addOrUpdatePeer records a message received from a peer. Every peer
+// announces itself each publish interval, so the messages double as
+// heartbeats.
+func addOrUpdatePeer(ctx context.Context, peerID PeerID, ownerGUID GUID, ownerKey []byte) {
 	peerMapMu.Lock()
 	defer peerMapMu.Unlock()
 
-	peerMap[peerID] = &Peer{
-		ID:        peerID,
-		OwnerGUID: ownerGUID,
-		Timestamp: time.Now(),
+	now := time.Now()
+	p, ok := peerMap[peerID].(*Peer)
+	if !ok {
+		p = &Peer{ID: peerID, CIDs: make(map[CID]bool)}
+		peerMap[peerID] = p
+		log.Printf("Added peer: %s", peerID)
 	}
-	log.Printf("Updated peer: %s", peerID)
-
-	if err := node.Save(context.Background(), peerListPath, peerMap); err != nil {
-		log.Printf("Failed to save peerMap: %v", err)
+	p.OwnerGUID = ownerGUID
+	if len(ownerKey) > 0 {
+		p.OwnerKey = ownerKey
+		pinOwnerKey(ownerGUID, ownerKey, peerID)
 	}
+	p.Timestamp = now
+	p.LastSeen = now
+	p.Messages++
+
+	persister.MarkDirty(peerListPath)
 }
 
+// updatePeerCIDs hands the CIDs a peer announced to the replicator
 func updatePeerCIDs(peerID PeerID, cids []CID) {
-	conceptMu.Lock()
-	defer conceptMu.Unlock()
-
-	for _, cid := range cids {
-		found := false
-		for _, concept := range conceptMap {
-			if concept.GetCID() == cid {
-				found = true
-				break
-			}
-		}
-		if !found {
-			// If the concept is not in our list, we might want to fetch it
-			// This is left as an exercise, as it depends on how you want to handle this case
-			log.Printf("Found new CID from peer %s: %s", peerID, cid)
-		}
+	if config.ReplicationWorkers == 0 {
+		return
 	}
+	replicator.Announce(peerID, cids)
 }
 
+// discoverPeers adds the peers of the swarm to the peer list and drops the
+// ones without an owner that left it, as we only know them from the swarm
 func discoverPeers(ctx context.Context) {
 	peers, err := node.ListPeers(ctx)
 	if err != nil {
@@ -69,17 +70,171 @@ func discoverPeers(ctx context.Context) {
 	peerMapMu.Lock()
 	defer peerMapMu.Unlock()
 
+	connected := make(map[PeerID]bool, len(peers))
 	for _, peer := range peers {
 		peerID := peer.GetID()
+		connected[peerID] = true
 		if _, exists := peerMap[peerID]; !exists {
 			peerMap[peerID] = peer
 			log.Printf("Discovered new peer: %s", peerID)
 		}
 	}
+	for id, peer := range peerMap {
+		if id != peerID && !connected[id] && peer.GetOwnerGUID() == "" {
+			delete(peerMap, id)
+		}
+	}
 
 	log.Printf("Discovered %d peers", len(peerMap))
 
-	if err := node.Save(context.Background(), peerListPath, peerMap); err != nil {
-		log.Printf("Failed to save peerMap: %v", err)
+	persister.MarkDirty(peerListPath)
+}
+
+type PeerState string
+
+const (
+	PeerOnline  PeerState = "online"
+	PeerIdle    PeerState = "idle"
+	PeerOffline PeerState = "offline"
+)
+
+// A peer is online as long as it misses at most one heartbeat, and idle
+// until it misses peerOfflineHeartbeats of them
+const (
+	peerIdleHeartbeats    = 2
+	peerOfflineHeartbeats = 10
+)
+
+// peerState derives the liveness of a peer from when it was last seen,
+// assuming it announces itself as often as we do
+func peerState(id PeerID, lastSeen time.Time) PeerState {
+	if id == peerID {
+		return PeerOnline
+	}
+	since := time.Since(lastSeen)
+	switch {
+	case lastSeen.IsZero():
+		return PeerOffline
+	case since <= peerIdleHeartbeats*config.PublishInterval:
+		return PeerOnline
+	case since <= peerOfflineHeartbeats*config.PublishInterval:
+		return PeerIdle
+	default:
+		return PeerOffline
+	}
+}
+
+// lastActive is when we last heard of a peer, through a message or the swarm
+func lastActive(p Peer_i) time.Time {
+	if peer, ok := p.(*Peer); ok && peer.LastSeen.After(peer.Timestamp) {
+		return peer.LastSeen
+	}
+	return p.GetTimestamp()
+}
+
+// evictStalePeers forgets the peers we have not heard of for longer than
+// the eviction period, along with what we replicated from them
+func evictStalePeers(ctx context.Context) {
+	var evicted []PeerID
+	peerMapMu.Lock()
+	for id, peer := range peerMap {
+		if id != peerID && time.Since(lastActive(peer)) > config.PeerEviction {
+			delete(peerMap, id)
+			evicted = append(evicted, id)
+		}
+	}
+	peerMapMu.Unlock()
+	if len(evicted) == 0 {
+		return
 	}
+	persister.MarkDirty(peerListPath)
+
+	for _, id := range evicted {
+		forgetPeer(id)
+		log.Printf("Evicted peer %s", id)
+	}
+}
+
+// forgetPeer drops the state kept for a peer that left the peer list
+func forgetPeer(id PeerID) {
+	replicator.Forget(id)
+	limiter.forget(id)
+
+	remoteConceptsMu.Lock()
+	_, replicated := remoteConcepts[id]
+	delete(remoteConcepts, id)
+	remoteConceptsMu.Unlock()
+	if replicated {
+		persister.MarkDirty(remoteConceptsPath)
+	}
+
+	peerSyncMu.Lock()
+	delete(peerSyncStates, id)
+	peerSyncMu.Unlock()
+
+	mergedRelationshipsMu.Lock()
+	delete(mergedRelationships, id)
+	mergedRelationshipsMu.Unlock()
+
+	reconciliationsMu.Lock()
+	delete(reconciliations, id)
+	reconciliationsMu.Unlock()
+
+	discardQuarantined(id)
+}
+
+// PeerDetail is the liveness and replication state of a peer
+type PeerDetail struct {
+	ID        PeerID     `json:"id"`
+	OwnerGUID GUID       `json:"ownerGuid,omitempty"`
+	State     PeerState  `json:"state"`
+	Trust     TrustLevel `json:"trust"`
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
+	Messages  int        `json:"messages"`
+	CIDs      []CID      `json:"cids"`
+	// Seq is the last announcement of the peer we applied
+	Seq        uint64 `json:"seq"`
+	Replicated int    `json:"replicated"`
+}
+
+func getPeer(c *gin.Context) {
+	id := PeerID(c.Param("id"))
+
+	peerMapMu.RLock()
+	peer, ok := peerMap[id]
+	var detail PeerDetail
+	if ok {
+		detail = PeerDetail{ID: id, OwnerGUID: peer.GetOwnerGUID(), CIDs: peer.GetCIDs()}
+		if p, ok := peer.(*Peer); ok {
+			detail.Messages = p.Messages
+			detail.State = peerState(id, p.LastSeen)
+			if !p.LastSeen.IsZero() {
+				lastSeen := p.LastSeen
+				detail.LastSeen = &lastSeen
+			}
+		} else {
+			detail.State = peerState(id, time.Time{})
+		}
+	}
+	peerMapMu.RUnlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Peer not found"})
+		return
+	}
+
+	peerSyncMu.Lock()
+	if st, ok := peerSyncStates[id]; ok {
+		detail.Seq = st.seq
+		if len(detail.CIDs) == 0 {
+			detail.CIDs = sortedKeys(st.concepts)
+		}
+	}
+	peerSyncMu.Unlock()
+	detail.Trust = trustOf(id)
+	remoteConceptsMu.RLock()
+	detail.Replicated = len(remoteConcepts[id])
+	remoteConceptsMu.RUnlock()
+
+	slices.Sort(detail.CIDs)
+	c.JSON(http.StatusOK, detail)
 }
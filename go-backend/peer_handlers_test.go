@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPeerState(t *testing.T) {
+	resetState(t)
+	config.PublishInterval = time.Minute
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		id       PeerID
+		lastSeen time.Time
+		want     PeerState
+	}{
+		{name: "this node is always online", id: peerID, want: PeerOnline},
+		{name: "never seen", id: "peer", want: PeerOffline},
+		{name: "seen this heartbeat", id: "peer", lastSeen: now.Add(-30 * time.Second), want: PeerOnline},
+		{name: "missed one heartbeat", id: "peer", lastSeen: now.Add(-2*time.Minute + time.Second), want: PeerOnline},
+		{name: "missed two heartbeats", id: "peer", lastSeen: now.Add(-3 * time.Minute), want: PeerIdle},
+		{name: "just short of offline", id: "peer", lastSeen: now.Add(-10*time.Minute + time.Second), want: PeerIdle},
+		{name: "missed ten heartbeats", id: "peer", lastSeen: now.Add(-11 * time.Minute), want: PeerOffline},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := peerState(tt.id, tt.lastSeen); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvictStalePeers(t *testing.T) {
+	resetState(t)
+	config.PeerEviction = time.Hour
+
+	long := time.Now().Add(-2 * time.Hour)
+	peerMap[peerID].(*Peer).Timestamp = long
+	peerMap["stale"] = &Peer{ID: "stale", Timestamp: long, LastSeen: long}
+	// Known for long, but heard from recently
+	peerMap["fresh"] = &Peer{ID: "fresh", Timestamp: long, LastSeen: time.Now()}
+	for _, id := range []PeerID{"stale", "fresh"} {
+		remoteConcepts[id] = map[GUID]*Concept{"concept": {GUID: "concept"}}
+		peerSyncStates[id] = &peerSyncState{concepts: map[CID]bool{}}
+		mergedRelationships[id] = map[GUID]CID{"relationship": "cid"}
+		reconciliations[id] = &Reconciliation{}
+		quarantineItem(QuarantinedItem{Kind: QuarantineRelationship, Peer: id, ItemID: "relationship", CID: "cid"})
+		replicator.announced[id] = map[CID]bool{"cid": true}
+		if err := limiter.allow(id); err != nil {
+			t.Fatalf("allow: %v", err)
+		}
+	}
+
+	evictStalePeers(context.Background())
+
+	tracked := func(id PeerID) map[string]bool {
+		_, limited := limiter.peers[id]
+		_, listed := peerMap[id]
+		_, replicated := remoteConcepts[id]
+		_, synced := peerSyncStates[id]
+		_, merged := mergedRelationships[id]
+		_, reconciled := reconciliations[id]
+		_, announced := replicator.announced[id]
+		return map[string]bool{
+			"peer list":           listed,
+			"remote concepts":     replicated,
+			"sync state":          synced,
+			"merged relationship": merged,
+			"reconciliation":      reconciled,
+			"quarantine":          quarantinedCID(QuarantineRelationship, id, "relationship") != "",
+			"announcements":       announced,
+			"rate limit":          limited,
+		}
+	}
+	for what, ok := range tracked("stale") {
+		if ok {
+			t.Errorf("%s of the stale peer was kept", what)
+		}
+	}
+	for what, ok := range tracked("fresh") {
+		if !ok {
+			t.Errorf("%s of the fresh peer was dropped", what)
+		}
+	}
+	if _, ok := peerMap[peerID]; !ok {
+		t.Error("this node was evicted")
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gocid "github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+)
+
+// PeerIndex is published under a node's name, its IPNS name on IPFS, so
+// others can pull the node's state from its PeerID instead of waiting for
+// the next pubsub announcement
+type PeerIndex struct {
+	PeerID    PeerID
+	OwnerGUID GUID
+	Concepts  []CID
+	// Relationships links a node mapping relationship GUIDs to the CIDs of
+	// their stored versions
+	Relationships CID
+}
+
+// publishedIndex is the index our name currently points at. Its blocks stay
+// pinned until a newer index replaces it.
+var (
+	publishedIndex    PeerIndex
+	publishedIndexCID CID
+	publishedIndexMu  sync.RWMutex
+
+	// indexPublishMu serializes publications
+	indexPublishMu sync.Mutex
+)
+
+var errOwnIndex = errors.New("cannot pull our own index")
+
+func encodePeerIndex(idx *PeerIndex) ([]byte, error) {
+	concepts := make([]datamodel.Link, len(idx.Concepts))
+	for i, cid := range idx.Concepts {
+		l, err := cidLink(cid)
+		if err != nil {
+			return nil, err
+		}
+		concepts[i] = l
+	}
+	relationships, err := cidLink(idx.Relationships)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeDAG(func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "PeerID", qp.String(string(idx.PeerID)))
+		qp.MapEntry(ma, "OwnerGUID", qp.String(string(idx.OwnerGUID)))
+		qp.MapEntry(ma, "Concepts", qp.List(int64(len(concepts)), func(la datamodel.ListAssembler) {
+			for _, l := range concepts {
+				qp.ListEntry(la, qp.Link(l))
+			}
+		}))
+		qp.MapEntry(ma, "Relationships", qp.Link(relationships))
+	})
+}
+
+func decodePeerIndex(data []byte) (*PeerIndex, error) {
+	n, err := decodeDAG(data)
+	if err != nil {
+		return nil, err
+	}
+	f := dagFields{n: n}
+	idx := &PeerIndex{
+		PeerID:        PeerID(f.String("PeerID")),
+		OwnerGUID:     GUID(f.String("OwnerGUID")),
+		Concepts:      f.Links("Concepts"),
+		Relationships: f.Link("Relationships"),
+	}
+	if f.err == nil && idx.Relationships == "" {
+		f.err = fmt.Errorf("missing field Relationships")
+	}
+	if f.err != nil {
+		return nil, fmt.Errorf("invalid peer index: %v", f.err)
+	}
+	return idx, nil
+}
+
+func encodeRelationshipIndex(index map[GUID]CID) ([]byte, error) {
+	links := make(map[GUID]datamodel.Link, len(index))
+	for id, cid := range index {
+		l, err := cidLink(cid)
+		if err != nil {
+			return nil, err
+		}
+		links[id] = l
+	}
+	return encodeDAG(func(ma datamodel.MapAssembler) {
+		for _, id := range sortedKeys(links) {
+			qp.MapEntry(ma, string(id), qp.Link(links[id]))
+		}
+	})
+}
+
+func decodeRelationshipIndex(data []byte) (map[GUID]CID, error) {
+	n, err := decodeDAG(data)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[GUID]CID, n.Length())
+	it := n.MapIterator()
+	if it == nil {
+		return nil, fmt.Errorf("invalid relationship index: not a map")
+	}
+	for !it.Done() {
+		k, v, err := it.Next()
+		if err != nil {
+			return nil, fmt.Errorf("invalid relationship index: %v", err)
+		}
+		id, err := k.AsString()
+		if err != nil {
+			return nil, fmt.Errorf("invalid relationship index: %v", err)
+		}
+		l, err := v.AsLink()
+		if err != nil {
+			return nil, fmt.Errorf("invalid relationship index entry %s: %v", id, err)
+		}
+		index[GUID(id)] = CID(l.String())
+	}
+	return index, nil
+}
+
+// updatePeerIndex stores the current index and points our name at it if it
+// changed since the last publication
+func updatePeerIndex(ctx context.Context) (CID, error) {
+	indexPublishMu.Lock()
+	defer indexPublishMu.Unlock()
+
+	conceptMu.RLock()
+	concepts := make([]CID, 0, len(GUID2CID))
+	for _, cid := range GUID2CID {
+		concepts = append(concepts, cid)
+	}
+	conceptMu.RUnlock()
+	slices.Sort(concepts)
+
+	relationshipMu.RLock()
+	relationships := make(map[GUID]CID, len(relationship2CID))
+	for id, cid := range relationship2CID {
+		relationships[id] = cid
+	}
+	relationshipMu.RUnlock()
+
+	ownerMu.RLock()
+	owner := ownerGUID
+	ownerMu.RUnlock()
+
+	data, err := encodeRelationshipIndex(relationships)
+	if err != nil {
+		return "", err
+	}
+	relationshipsCID, err := node.PutBlock(ctx, gocid.DagJSON, data, true)
+	if err != nil {
+		return "", fmt.Errorf("failed to store relationship index: %v", err)
+	}
+	trackPin(relationshipsCID)
+
+	idx := PeerIndex{PeerID: peerID, OwnerGUID: owner, Concepts: concepts, Relationships: relationshipsCID}
+	if data, err = encodePeerIndex(&idx); err != nil {
+		return "", err
+	}
+	cid, err := node.PutBlock(ctx, gocid.DagJSON, data, true)
+	if err != nil {
+		return "", fmt.Errorf("failed to store peer index: %v", err)
+	}
+	trackPin(cid)
+
+	publishedIndexMu.RLock()
+	prev, prevCID := publishedIndex, publishedIndexCID
+	publishedIndexMu.RUnlock()
+	if cid == prevCID {
+		return cid, nil
+	}
+
+	if err := node.PublishName(ctx, cid); err != nil {
+		return "", fmt.Errorf("failed to publish name: %v", err)
+	}
+	publishedIndexMu.Lock()
+	publishedIndex, publishedIndexCID = idx, cid
+	publishedIndexMu.Unlock()
+	log.Printf("Published peer index %s with %d concepts and %d relationships", cid, len(concepts), len(relationships))
+
+	releasePin(ctx, prevCID)
+	if prev.Relationships != relationshipsCID {
+		releasePin(ctx, prev.Relationships)
+	}
+	return cid, nil
+}
+
+func publishPeerIndex(ctx context.Context) {
+	if _, err := updatePeerIndex(ctx); err != nil {
+		log.Printf("Failed to publish peer index: %v", err)
+	}
+}
+
+// resolvePeerIndex fetches the index a peer published under its name
+func resolvePeerIndex(ctx context.Context, id PeerID) (*PeerIndex, CID, error) {
+	cid, err := node.ResolveName(ctx, id)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve name of %s: %v", id, err)
+	}
+	data, err := node.GetBlock(ctx, cid)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch index %s: %v", cid, err)
+	}
+	idx, err := decodePeerIndex(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if idx.PeerID != id {
+		return nil, "", fmt.Errorf("index %s belongs to %s, not %s", cid, idx.PeerID, id)
+	}
+	return idx, cid, nil
+}
+
+// pullPeerIndex resolves the index of a peer and takes in its concepts and
+// relationships the way a pubsub announcement would
+func pullPeerIndex(ctx context.Context, id PeerID) (*PeerIndex, CID, error) {
+	if id == peerID {
+		return nil, "", errOwnIndex
+	}
+	if trustOf(id) == TrustBlocked {
+		return nil, "", fmt.Errorf("%w: %s", errPeerBlocked, id)
+	}
+	idx, cid, err := resolvePeerIndex(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := node.GetBlock(ctx, idx.Relationships)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch relationship index %s: %v", idx.Relationships, err)
+	}
+	relationships, err := decodeRelationshipIndex(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The entry is updated in place, so what we learned from the peer's
+	// messages, like the key of its owner, is kept
+	peerMapMu.Lock()
+	peer, ok := peerMap[id].(*Peer)
+	if !ok {
+		peer = &Peer{ID: id}
+		peerMap[id] = peer
+	}
+	if peer.OwnerGUID != idx.OwnerGUID {
+		peer.OwnerKey = nil
+	}
+	peer.OwnerGUID = idx.OwnerGUID
+	peer.CIDs = make(map[CID]bool, len(idx.Concepts))
+	for _, cid := range idx.Concepts {
+		peer.AddCID(cid)
+	}
+	peer.Timestamp = time.Now()
+	peerMapMu.Unlock()
+	persister.MarkDirty(peerListPath)
+
+	updatePeerCIDs(id, idx.Concepts)
+	replicator.AnnounceRelationships(id, relationships)
+	log.Printf("Pulled index %s of peer %s", cid, id)
+	return idx, cid, nil
+}
+
+// pullKnownPeerIndexes catches up with the peers we knew before a restart
+func pullKnownPeerIndexes(ctx context.Context) {
+	peerMapMu.RLock()
+	var ids []PeerID
+	for id, peer := range peerMap {
+		if id != peerID && peer.GetOwnerGUID() != "" {
+			ids = append(ids, id)
+		}
+	}
+	peerMapMu.RUnlock()
+
+	for _, id := range ids {
+		if _, _, err := pullPeerIndex(ctx, id); err != nil {
+			log.Printf("Failed to pull index of peer %s: %v", id, err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// getPeerIndex returns the index a peer published without taking anything
+// in from it
+func getPeerIndex(c *gin.Context) {
+	idx, cid, err := resolvePeerIndex(c.Request.Context(), PeerID(c.Param("id")))
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"cid": cid, "index": idx})
+}
+
+// pullPeerIndexHandler takes in the concepts and relationships of the index
+// a peer published
+func pullPeerIndexHandler(c *gin.Context) {
+	idx, cid, err := pullPeerIndex(c.Request.Context(), PeerID(c.Param("id")))
+	if errors.Is(err, errOwnIndex) || errors.Is(err, errPeerBlocked) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"cid": cid, "index": idx})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	gocid "github.com/ipfs/go-cid"
+)
+
+// publishIndex stores an index with its relationship index on n and points
+// the name of n at it
+func publishIndex(t *testing.T, n *MemoryNode, idx PeerIndex, relationships map[GUID]CID) CID {
+	t.Helper()
+	ctx := context.Background()
+	data, err := encodeRelationshipIndex(relationships)
+	if err != nil {
+		t.Fatalf("encodeRelationshipIndex: %v", err)
+	}
+	if idx.Relationships, err = n.PutBlock(ctx, gocid.DagJSON, data, true); err != nil {
+		t.Fatalf("PutBlock: %v", err)
+	}
+	if data, err = encodePeerIndex(&idx); err != nil {
+		t.Fatalf("encodePeerIndex: %v", err)
+	}
+	cid, err := n.PutBlock(ctx, gocid.DagJSON, data, true)
+	if err != nil {
+		t.Fatalf("PutBlock: %v", err)
+	}
+	if err := n.PublishName(ctx, cid); err != nil {
+		t.Fatalf("PublishName: %v", err)
+	}
+	return cid
+}
+
+// newRemoteNode returns a node on the hub of local that local is connected to
+func newRemoteNode(t *testing.T, local *MemoryNode) *MemoryNode {
+	t.Helper()
+	remote := NewMemoryNode(local.hub)
+	if err := local.Connect(context.Background(), remote.id); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	return remote
+}
+
+func TestPublishPeerIndex(t *testing.T) {
+	ctx := context.Background()
+	resetState(t)
+
+	if err := addOrUpdateConcept(ctx, &Concept{GUID: "concept", Name: "concept", Timestamp: time.Now()}); err != nil {
+		t.Fatalf("addOrUpdateConcept: %v", err)
+	}
+	relationshipMap["relationship"] = &Relationship{ID: "relationship", SourceID: "concept", TargetID: "other", Timestamp: time.Now()}
+	if _, err := saveRelationship(ctx, "relationship"); err != nil {
+		t.Fatalf("saveRelationship: %v", err)
+	}
+
+	cid, err := updatePeerIndex(ctx)
+	if err != nil {
+		t.Fatalf("updatePeerIndex: %v", err)
+	}
+	idx, resolved, err := resolvePeerIndex(ctx, peerID)
+	if err != nil {
+		t.Fatalf("resolvePeerIndex: %v", err)
+	}
+	if resolved != cid {
+		t.Errorf("name resolves to %s, want %s", resolved, cid)
+	}
+	if !slices.Equal(idx.Concepts, []CID{GUID2CID["concept"]}) {
+		t.Errorf("index lists concepts %v, want %v", idx.Concepts, []CID{GUID2CID["concept"]})
+	}
+	data, err := node.GetBlock(ctx, idx.Relationships)
+	if err != nil {
+		t.Fatalf("GetBlock: %v", err)
+	}
+	relationships, err := decodeRelationshipIndex(data)
+	if err != nil {
+		t.Fatalf("decodeRelationshipIndex: %v", err)
+	}
+	if relationships["relationship"] != relationship2CID["relationship"] {
+		t.Errorf("relationship index holds %v, want %v", relationships, relationship2CID)
+	}
+
+	if again, err := updatePeerIndex(ctx); err != nil || again != cid {
+		t.Errorf("publishing unchanged state gave %s, %v, want %s", again, err, cid)
+	}
+}
+
+func TestResolvePeerIndex(t *testing.T) {
+	local := resetState(t)
+	remote := newRemoteNode(t, local)
+	other := NewMemoryNode(local.hub)
+
+	tests := []struct {
+		name    string
+		claimed PeerID
+		wantErr bool
+	}{
+		{name: "index of the peer", claimed: remote.id},
+		{name: "index claiming another peer", claimed: other.id, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cid := publishIndex(t, remote, PeerIndex{PeerID: tt.claimed, OwnerGUID: "them"}, nil)
+			idx, resolved, err := resolvePeerIndex(context.Background(), remote.id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if err == nil && (resolved != cid || idx.OwnerGUID != "them") {
+				t.Errorf("resolved %s owned by %s, want %s owned by them", resolved, idx.OwnerGUID, cid)
+			}
+		})
+	}
+}
+
+func TestPullPeerIndex(t *testing.T) {
+	ctx := context.Background()
+	local := resetState(t)
+	config.ReplicationWorkers = 1
+	remote := newRemoteNode(t, local)
+
+	concept, err := remote.PutBlock(ctx, gocid.DagJSON, []byte(`{"GUID":"concept"}`), true)
+	if err != nil {
+		t.Fatalf("PutBlock: %v", err)
+	}
+	relationship, err := remote.PutBlock(ctx, gocid.DagJSON, []byte(`{"ID":"relationship"}`), true)
+	if err != nil {
+		t.Fatalf("PutBlock: %v", err)
+	}
+	publishIndex(t, remote, PeerIndex{PeerID: remote.id, OwnerGUID: "them", Concepts: []CID{concept}},
+		map[GUID]CID{"relationship": relationship})
+
+	tests := []struct {
+		name    string
+		peer    PeerID
+		trust   TrustLevel
+		wantErr error
+	}{
+		{name: "our own index", peer: local.id, wantErr: errOwnIndex},
+		{name: "blocked peer", peer: remote.id, trust: TrustBlocked, wantErr: errPeerBlocked},
+		{name: "known peer", peer: remote.id, trust: TrustKnown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replicator = newTestReplicator()
+			if tt.trust != "" {
+				peerTrust[tt.peer] = tt.trust
+			}
+			_, _, err := pullPeerIndex(ctx, tt.peer)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			peerMapMu.RLock()
+			p := peerMap[tt.peer]
+			peerMapMu.RUnlock()
+			if p == nil || p.GetOwnerGUID() != "them" || !slices.Equal(p.GetCIDs(), []CID{concept}) {
+				t.Errorf("peer entry is %+v, want owner them with concept %s", p, concept)
+			}
+			if !replicator.announced[tt.peer][concept] {
+				t.Errorf("concept %s was not handed to the replicator", concept)
+			}
+			job := replicationJob{peer: tt.peer, cid: relationship, relationship: "relationship"}
+			if !replicator.pending[job] {
+				t.Errorf("relationship %s was not queued", relationship)
+			}
+		})
+	}
+}
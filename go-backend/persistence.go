@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PersistenceStatus reports the write-behind state of one persisted file
+type PersistenceStatus struct {
+	Path        string     `json:"path"`
+	Dirty       bool       `json:"dirty"`
+	Writes      int        `json:"writes"`
+	LastSavedAt *time.Time `json:"lastSavedAt,omitempty"`
+	Failures    int        `json:"failures"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+type persistedFile struct {
+	snapshot func() (json.RawMessage, error)
+	status   PersistenceStatus
+}
+
+// Persister coalesces writes of the state files. Mutations only mark a path
+// dirty; a background loop saves each dirty path at most once per interval
+// and Flush writes everything still pending on shutdown.
+type Persister struct {
+	mu    sync.Mutex
+	files map[string]*persistedFile
+
+	// flushMu keeps concurrent flushes from writing an older snapshot last
+	flushMu sync.Mutex
+}
+
+var persister = NewPersister()
+
+func NewPersister() *Persister {
+	return &Persister{files: make(map[string]*persistedFile)}
+}
+
+// Register adds a file to the persister. snapshot must take whatever locks
+// protect the data and return its serialized form.
+func (p *Persister) Register(path string, snapshot func() (json.RawMessage, error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.files[path] = &persistedFile{
+		snapshot: snapshot,
+		status:   PersistenceStatus{Path: path},
+	}
+}
+
+// MarkDirty schedules path to be written on the next flush
+func (p *Persister) MarkDirty(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, ok := p.files[path]
+	if !ok {
+		log.Printf("Persister: marking unregistered path %s dirty", path)
+		return
+	}
+	f.status.Dirty = true
+}
+
+func (p *Persister) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Flush(ctx)
+		}
+	}
+}
+
+// Flush writes every dirty file and returns the combined error of the
+// writes that failed. Failed files stay dirty and are retried later.
+func (p *Persister) Flush(ctx context.Context) error {
+	p.flushMu.Lock()
+	defer p.flushMu.Unlock()
+
+	p.mu.Lock()
+	var pending []string
+	for path, f := range p.files {
+		if f.status.Dirty {
+			f.status.Dirty = false
+			pending = append(pending, path)
+		}
+	}
+	p.mu.Unlock()
+	sort.Strings(pending)
+
+	var failed []string
+	for _, path := range pending {
+		if err := p.save(ctx, path); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", path, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to persist %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (p *Persister) save(ctx context.Context, path string) error {
+	p.mu.Lock()
+	f := p.files[path]
+	p.mu.Unlock()
+
+	data, err := f.snapshot()
+	if err == nil {
+		err = node.Save(ctx, path, data)
+	}
+
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		f.status.Dirty = true
+		f.status.Failures++
+		f.status.LastError = err.Error()
+		f.status.LastErrorAt = &now
+		log.Printf("Failed to persist %s: %v", path, err)
+		return err
+	}
+	f.status.Writes++
+	f.status.LastSavedAt = &now
+	return nil
+}
+
+func (p *Persister) Status() []PersistenceStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	statuses := make([]PersistenceStatus, 0, len(p.files))
+	for _, f := range p.files {
+		statuses = append(statuses, f.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Path < statuses[j].Path })
+	return statuses
+}
+
+// lockedSnapshot serializes data while holding mu for reading
+func lockedSnapshot(mu *sync.RWMutex, data func() interface{}) func() (json.RawMessage, error) {
+	return func() (json.RawMessage, error) {
+		mu.RLock()
+		defer mu.RUnlock()
+		return json.Marshal(data())
+	}
+}
+
+func registerStateFiles() {
+	persister.Register(GUID2CIDPath, lockedSnapshot(&conceptMu, func() interface{} { return GUID2CID }))
+	persister.Register(conceptsPath, lockedSnapshot(&conceptMu, func() interface{} { return conceptMap }))
+	persister.Register(peerListPath, lockedSnapshot(&peerMapMu, func() interface{} { return peerMap }))
+	persister.Register(peerTrustPath, lockedSnapshot(&peerTrustMu, func() interface{} { return peerTrust }))
+	persister.Register(quarantinePath, lockedSnapshot(&quarantineMu, func() interface{} { return quarantine }))
+	persister.Register(inboxPath, lockedSnapshot(&inboxMu, func() interface{} { return inbox }))
+	persister.Register(pinnedKeysPath, lockedSnapshot(&pinnedKeysMu, func() interface{} { return pinnedKeys }))
+	persister.Register(relationshipIndexPath, lockedSnapshot(&relationshipMu, func() interface{} { return relationship2CID }))
+	persister.Register(pinsPath, lockedSnapshot(&managedPinsMu, func() interface{} { return managedPins }))
+	persister.Register(remoteConceptsPath, lockedSnapshot(&remoteConceptsMu, func() interface{} { return remoteConcepts }))
+	persister.Register(tombstonesPath, lockedSnapshot(&tombstonesMu, func() interface{} { return tombstones }))
+	persister.Register(changeLogPath, lockedSnapshot(&changeLogMu, func() interface{} { return changeLog }))
+	persister.Register(historyPath, lockedSnapshot(&conceptVersionsMu, func() interface{} { return conceptVersions }))
+}
+
+func getPersistenceStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, persister.Status())
+}
+
+func flushPersistence(c *gin.Context) {
+	if err := persister.Flush(c.Request.Context()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "files": persister.Status()})
+		return
+	}
+	c.JSON(http.StatusOK, persister.Status())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPersisterFlush(t *testing.T) {
+	ctx := context.Background()
+	n := resetState(t)
+	p := NewPersister()
+
+	snapshots := make(map[string]int)
+	failing := true
+	p.Register("/coalesced", func() (json.RawMessage, error) {
+		snapshots["/coalesced"]++
+		return json.RawMessage(`"coalesced"`), nil
+	})
+	p.Register("/failing", func() (json.RawMessage, error) {
+		snapshots["/failing"]++
+		if failing {
+			return nil, errors.New("snapshot failed")
+		}
+		return json.RawMessage(`"recovered"`), nil
+	})
+
+	for i := 0; i < 3; i++ {
+		p.MarkDirty("/coalesced")
+	}
+	p.MarkDirty("/failing")
+	p.MarkDirty("/unregistered")
+
+	status := func(path string) PersistenceStatus {
+		for _, st := range p.Status() {
+			if st.Path == path {
+				return st
+			}
+		}
+		t.Fatalf("no status for %s", path)
+		return PersistenceStatus{}
+	}
+
+	steps := []struct {
+		name string
+		// fail is whether the snapshot of /failing fails in this flush
+		fail          bool
+		wantErr       bool
+		wantSnapshots map[string]int
+		wantFailing   PersistenceStatus
+	}{
+		{name: "dirty paths are written once and failures reported", fail: true, wantErr: true,
+			wantSnapshots: map[string]int{"/coalesced": 1, "/failing": 1},
+			wantFailing:   PersistenceStatus{Dirty: true, Failures: 1, LastError: "snapshot failed"}},
+		{name: "failed path is retried, clean paths are not", fail: false,
+			wantSnapshots: map[string]int{"/coalesced": 1, "/failing": 2},
+			wantFailing:   PersistenceStatus{Writes: 1, Failures: 1, LastError: "snapshot failed"}},
+		{name: "nothing left to write",
+			wantSnapshots: map[string]int{"/coalesced": 1, "/failing": 2},
+			wantFailing:   PersistenceStatus{Writes: 1, Failures: 1, LastError: "snapshot failed"}},
+	}
+	for _, step := range steps {
+		failing = step.fail
+		err := p.Flush(ctx)
+		if (err != nil) != step.wantErr {
+			t.Fatalf("%s: got error %v, want one: %v", step.name, err, step.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), "/failing") {
+			t.Errorf("%s: error %v does not name the failed path", step.name, err)
+		}
+		for path, want := range step.wantSnapshots {
+			if snapshots[path] != want {
+				t.Errorf("%s: %s was snapshotted %d times, want %d", step.name, path, snapshots[path], want)
+			}
+		}
+		st := status("/failing")
+		if st.Dirty != step.wantFailing.Dirty || st.Writes != step.wantFailing.Writes ||
+			st.Failures != step.wantFailing.Failures || st.LastError != step.wantFailing.LastError {
+			t.Errorf("%s: /failing is %+v, want %+v", step.name, st, step.wantFailing)
+		}
+	}
+
+	if st := status("/coalesced"); st.Dirty || st.Writes != 1 || st.LastSavedAt == nil {
+		t.Errorf("/coalesced is %+v, want written once", st)
+	}
+	for path, want := range map[string]string{"/coalesced": `"coalesced"`, "/failing": `"recovered"`} {
+		if got := string(n.files[path]); got != want {
+			t.Errorf("%s holds %s, want %s", path, got, want)
+		}
+	}
+}
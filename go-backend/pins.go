@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pinGracePeriod protects freshly added content that is not referenced yet
+// from a concurrently running garbage collection
+const pinGracePeriod = 1 * time.Minute
+
+// managedPins holds every CID this node pinned itself, with the time it was
+// pinned. Pins made by anyone else on the daemon are never touched.
+var (
+	managedPins   = make(map[CID]time.Time)
+	managedPinsMu sync.RWMutex
+)
+
+// GCReport describes what a pin garbage collection found or did
+type GCReport struct {
+	DryRun     bool           `json:"dryRun"`
+	Live       int            `json:"live"`
+	Managed    int            `json:"managed"`
+	Unmanaged  int            `json:"unmanaged"`
+	Candidates []CID          `json:"candidates"`
+	Removed    []CID          `json:"removed,omitempty"`
+	Errors     map[CID]string `json:"errors,omitempty"`
+}
+
+func trackPin(cid CID) {
+	managedPinsMu.Lock()
+	managedPins[cid] = time.Now()
+	managedPinsMu.Unlock()
+	persister.MarkDirty(pinsPath)
+}
+
+// adoptLivePins takes over pins of live CIDs that were made before pins were
+// tracked, so they are released once superseded
+func adoptLivePins() {
+	adopted := 0
+	managedPinsMu.Lock()
+	for cid := range liveCIDs() {
+		if _, ok := managedPins[cid]; !ok {
+			managedPins[cid] = time.Now()
+			adopted++
+		}
+	}
+	managedPinsMu.Unlock()
+	if adopted > 0 {
+		log.Printf("Adopted %d existing pins", adopted)
+		persister.MarkDirty(pinsPath)
+	}
+}
+
+func untrackPin(cid CID) {
+	managedPinsMu.Lock()
+	delete(managedPins, cid)
+	managedPinsMu.Unlock()
+	persister.MarkDirty(pinsPath)
+}
+
+func isManagedPin(cid CID) bool {
+	managedPinsMu.RLock()
+	defer managedPinsMu.RUnlock()
+	_, ok := managedPins[cid]
+	return ok
+}
+
+// liveCIDs returns every CID that is still referenced, mapped to the reason
+// it is kept
+func liveCIDs() map[CID]string {
+	live := make(map[CID]string)
+
+	peerMapMu.RLock()
+	if self, ok := peerMap[peerID]; ok {
+		for _, cid := range self.GetCIDs() {
+			live[cid] = "peer"
+		}
+	}
+	peerMapMu.RUnlock()
+
+	conceptMu.RLock()
+	for _, cid := range GUID2CID {
+		live[cid] = "concept"
+	}
+	for _, concept := range conceptMap {
+		if cid := concept.contentCID(); cid != "" {
+			live[cid] = "content"
+		}
+		// A concept node links the versions of its relationships that were
+		// current when it was stored. They stay pinned while the node is
+		// current, so the DAG can be walked from it.
+		for _, cid := range concept.links {
+			if _, ok := live[cid]; !ok {
+				live[cid] = "link"
+			}
+		}
+	}
+	conceptMu.RUnlock()
+
+	publishedIndexMu.RLock()
+	if publishedIndexCID != "" {
+		live[publishedIndexCID] = "index"
+		live[publishedIndex.Relationships] = "index"
+	}
+	publishedIndexMu.RUnlock()
+
+	relationshipMu.RLock()
+	for _, cid := range relationship2CID {
+		live[cid] = "relationship"
+	}
+	relationshipMu.RUnlock()
+
+	conceptVersionsMu.RLock()
+	for _, versions := range conceptVersions {
+		for _, cid := range versions {
+			live[cid] = "history"
+			if content, ok := versionContent[cid]; ok {
+				live[content] = "history content"
+			}
+		}
+	}
+	conceptVersionsMu.RUnlock()
+
+	return live
+}
+
+// releasePin unpins a CID that was superseded or deleted, unless something
+// still references it
+func releasePin(ctx context.Context, cid CID) {
+	if cid == "" {
+		return
+	}
+	if reason, ok := liveCIDs()[cid]; ok {
+		log.Printf("Keeping pin %s, still referenced by %s", cid, reason)
+		return
+	}
+
+	if !isManagedPin(cid) {
+		return
+	}
+
+	if err := node.Remove(ctx, cid); err != nil {
+		log.Printf("Failed to unpin %s: %v", cid, err)
+		return
+	}
+	untrackPin(cid)
+	log.Printf("Unpinned unreferenced CID %s", cid)
+}
+
+// collectGarbage unpins every managed CID that is no longer live. With dryRun
+// it only reports what would be removed.
+func collectGarbage(ctx context.Context, dryRun bool) (GCReport, error) {
+	report := GCReport{DryRun: dryRun, Candidates: []CID{}}
+
+	pinned, err := node.List(ctx)
+	if err != nil {
+		return report, err
+	}
+	live := liveCIDs()
+	report.Live = len(live)
+
+	cutoff := time.Now().Add(-pinGracePeriod)
+	managedPinsMu.RLock()
+	report.Managed = len(managedPins)
+	for _, cid := range pinned {
+		pinnedAt, managed := managedPins[cid]
+		if !managed {
+			report.Unmanaged++
+			continue
+		}
+		if _, ok := live[cid]; !ok && pinnedAt.Before(cutoff) {
+			report.Candidates = append(report.Candidates, cid)
+		}
+	}
+	managedPinsMu.RUnlock()
+	sort.Slice(report.Candidates, func(i, j int) bool { return report.Candidates[i] < report.Candidates[j] })
+
+	if dryRun {
+		return report, nil
+	}
+
+	for _, cid := range report.Candidates {
+		if err := node.Remove(ctx, cid); err != nil {
+			if report.Errors == nil {
+				report.Errors = make(map[CID]string)
+			}
+			report.Errors[cid] = err.Error()
+			continue
+		}
+		untrackPin(cid)
+		report.Removed = append(report.Removed, cid)
+	}
+	log.Printf("Pin GC removed %d of %d unreferenced pins", len(report.Removed), len(report.Candidates))
+	return report, nil
+}
+
+func runPinGC(ctx context.Context) {
+	if _, err := collectGarbage(ctx, false); err != nil {
+		log.Printf("Pin GC failed: %v", err)
+	}
+}
+
+func getGCReport(c *gin.Context) {
+	report, err := collectGarbage(c.Request.Context(), true)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func runGC(c *gin.Context) {
+	dryRun := c.Query("dry-run") == "true"
+	report, err := collectGarbage(c.Request.Context(), dryRun)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// replaceOwnCID swaps a superseded CID for its successor in this node's
+// announced CID set
+func replaceOwnCID(prev, next CID) {
+	peerMapMu.Lock()
+	self, ok := peerMap[peerID]
+	if ok && slices.Contains(self.GetCIDs(), prev) {
+		self.RemoveCID(prev)
+		self.AddCID(next)
+	}
+	peerMapMu.Unlock()
+	if ok {
+		persister.MarkDirty(peerListPath)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLinkedRelationshipVersionsStayPinned(t *testing.T) {
+	ctx := context.Background()
+	n := resetState(t)
+
+	source, target, id := GUID("source"), GUID("target"), GUID("relationship")
+	relationshipMap[id] = &Relationship{ID: id, SourceID: source, TargetID: target, EnergyFlow: 1, Timestamp: time.Now()}
+	linked, err := saveRelationship(ctx, id)
+	if err != nil {
+		t.Fatalf("saveRelationship: %v", err)
+	}
+	concept := &Concept{GUID: source, Name: "source", Relationships: []GUID{id}, Timestamp: time.Now()}
+	if err := addOrUpdateConcept(ctx, concept); err != nil {
+		t.Fatalf("addOrUpdateConcept: %v", err)
+	}
+
+	relationshipMap[id].EnergyFlow = 2
+	relationshipMap[id].Timestamp = time.Now()
+	current, err := saveRelationship(ctx, id)
+	if err != nil {
+		t.Fatalf("saveRelationship: %v", err)
+	}
+	if current == linked {
+		t.Fatal("relationship version did not change")
+	}
+
+	pinned, _ := n.List(ctx)
+	if !slices.Contains(pinned, linked) {
+		t.Errorf("version %s linked from the current concept was unpinned", linked)
+	}
+	if reason := liveCIDs()[linked]; reason != "link" {
+		t.Errorf("linked version is live as %q, want %q", reason, "link")
+	}
+
+	// Once the concept is stored again it links the current version and the
+	// old one may go
+	if err := unlinkRelationship(ctx, source, id); err != nil {
+		t.Fatalf("unlinkRelationship: %v", err)
+	}
+	if _, ok := liveCIDs()[linked]; ok {
+		t.Errorf("version %s is still live after the concept dropped its link", linked)
+	}
+}
+
+func TestHistoryContentStaysPinned(t *testing.T) {
+	ctx := context.Background()
+	n := resetState(t)
+	config.HistoryDepth = 1
+
+	var contents []CID
+	for _, text := range []string{"first", "second", "third"} {
+		content, err := storeContent(ctx, strings.NewReader(text), "")
+		if err != nil {
+			t.Fatalf("storeContent: %v", err)
+		}
+		contents = append(contents, content.CID)
+		concept := &Concept{GUID: "concept", Name: "concept", Content: content, Timestamp: time.Now()}
+		if err := addOrUpdateConcept(ctx, concept); err != nil {
+			t.Fatalf("addOrUpdateConcept: %v", err)
+		}
+		if text == "second" {
+			// Let GC run past the grace period of every pin
+			for cid := range managedPins {
+				managedPins[cid] = time.Now().Add(-time.Hour)
+			}
+			if _, err := collectGarbage(ctx, false); err != nil {
+				t.Fatalf("collectGarbage: %v", err)
+			}
+			pinned, _ := n.List(ctx)
+			if !slices.Contains(pinned, contents[0]) {
+				t.Fatalf("GC unpinned the content %s of the retained version", contents[0])
+			}
+			if reason := liveCIDs()[contents[0]]; reason != "history content" {
+				t.Errorf("content of the retained version is live as %q, want %q", reason, "history content")
+			}
+			if _, err := exportCAR(ctx, io.Discard); err != nil {
+				t.Errorf("exportCAR after GC: %v", err)
+			}
+		}
+	}
+
+	// The first version fell out of the history depth with its content
+	pinned, _ := n.List(ctx)
+	if slices.Contains(pinned, contents[0]) {
+		t.Errorf("content %s of a dropped version is still pinned", contents[0])
+	}
+	if !slices.Contains(pinned, contents[1]) {
+		t.Errorf("content %s of the retained version was unpinned", contents[1])
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	tests := []struct {
+		name        string
+		dryRun      bool
+		wantRemoved bool
+	}{
+		{name: "dry run only reports", dryRun: true},
+		{name: "real run unpins", wantRemoved: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			n := resetState(t)
+
+			if err := addOrUpdateConcept(ctx, &Concept{GUID: "concept", Name: "concept", Timestamp: time.Now()}); err != nil {
+				t.Fatalf("addOrUpdateConcept: %v", err)
+			}
+			live := GUID2CID["concept"]
+			pin := func(data string) CID {
+				cid, err := n.Add(ctx, strings.NewReader(data))
+				if err != nil {
+					t.Fatalf("Add: %v", err)
+				}
+				return cid
+			}
+			orphan, fresh, foreign := pin("orphan"), pin("fresh"), pin("foreign")
+			managedPins[live] = time.Now().Add(-time.Hour)
+			managedPins[orphan] = time.Now().Add(-time.Hour)
+			// Within the grace period, so not collected yet
+			managedPins[fresh] = time.Now()
+
+			report, err := collectGarbage(ctx, tt.dryRun)
+			if err != nil {
+				t.Fatalf("collectGarbage: %v", err)
+			}
+			if report.DryRun != tt.dryRun || !slices.Equal(report.Candidates, []CID{orphan}) {
+				t.Errorf("got dry run %v with candidates %v, want %v with %v", report.DryRun, report.Candidates, tt.dryRun, []CID{orphan})
+			}
+			if report.Unmanaged != 1 {
+				t.Errorf("counted %d unmanaged pins, want the one of %s", report.Unmanaged, foreign)
+			}
+
+			var wantRemoved []CID
+			if tt.wantRemoved {
+				wantRemoved = []CID{orphan}
+			}
+			if !slices.Equal(report.Removed, wantRemoved) {
+				t.Errorf("removed %v, want %v", report.Removed, wantRemoved)
+			}
+			pinned, _ := n.List(ctx)
+			if slices.Contains(pinned, orphan) == tt.wantRemoved || isManagedPin(orphan) == tt.wantRemoved {
+				t.Errorf("orphan pinned: %v, managed: %v, want both %v", slices.Contains(pinned, orphan), isManagedPin(orphan), !tt.wantRemoved)
+			}
+			for _, cid := range []CID{live, fresh, foreign} {
+				if !slices.Contains(pinned, cid) {
+					t.Errorf("%s was unpinned", cid)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The state of a relationship is a CRDT, so peers that deepen and interact
+// with the same relationship converge on the same values whatever order
+// they see each other's updates in:
+//
+//   - Interactions is a grow-only counter with one slot per peer
+//   - EnergyFlow, Amplitude and Volume are last-writer-wins registers
+//   - FrequencySpec entries form a grow-only set, every add carrying a unique
+//     tag prefixed with the peer that added it
+//   - LastInteraction and Timestamp only move forward
+//
+// The exported fields of Relationship are derived from State by apply.
+//
+// A peer only grows its own slot and its own entries, and a copy received
+// from a peer is limited to that before it is merged, so one peer cannot
+// count interactions for another. Times written ahead of our clock by more
+// than maxClockSkew are moved back, as a write dated ahead would win over
+// every later one.
+
+// basePeer owns the values a relationship starts with. Relationships stored
+// before they carried a state get theirs from their fields the same way on
+// every peer, so merging two copies does not count anything twice.
+const basePeer PeerID = "base"
+
+// maxClockSkew is how far ahead of our clock a peer may date its writes
+const maxClockSkew = time.Minute
+
+// RelationshipState holds the replicated state of a relationship
+type RelationshipState struct {
+	Interactions map[PeerID]int
+	EnergyFlow   lwwRegister
+	Amplitude    lwwRegister
+	Volume       lwwRegister
+	// Frequencies are the FrequencySpec entries by tag
+	Frequencies map[string]frequencyEntry
+}
+
+type lwwRegister struct {
+	Value float64
+	Time  time.Time
+	Peer  PeerID
+}
+
+// after reports whether r wins over o. Writes at the same time are ordered
+// by peer and then value, so every peer picks the same one.
+func (r lwwRegister) after(o lwwRegister) bool {
+	if !r.Time.Equal(o.Time) {
+		return r.Time.After(o.Time)
+	}
+	if r.Peer != o.Peer {
+		return r.Peer > o.Peer
+	}
+	return r.Value > o.Value
+}
+
+func (r lwwRegister) equal(o lwwRegister) bool {
+	return r.Value == o.Value && r.Time.Equal(o.Time) && r.Peer == o.Peer
+}
+
+// set writes a local value. The write is stamped after the current one even
+// if the clock of the peer that wrote it runs ahead of ours.
+func (r *lwwRegister) set(v float64) {
+	t := time.Now().UTC()
+	if !t.After(r.Time) {
+		t = r.Time.Add(time.Nanosecond)
+	}
+	*r = lwwRegister{Value: v, Time: t, Peer: peerID}
+}
+
+type frequencyEntry struct {
+	Value float64
+	Added time.Time
+}
+
+// after orders two entries that were given the same tag, which only happens
+// for base entries of relationships that diverged before carrying a state
+func (e frequencyEntry) after(o frequencyEntry) bool {
+	if !e.Added.Equal(o.Added) {
+		return e.Added.After(o.Added)
+	}
+	return e.Value > o.Value
+}
+
+// baseState derives a state from the fields of a relationship without one
+func (r *Relationship) baseState() RelationshipState {
+	register := func(v float64) lwwRegister {
+		return lwwRegister{Value: v, Time: r.Timestamp.UTC(), Peer: basePeer}
+	}
+	s := RelationshipState{
+		Interactions: map[PeerID]int{basePeer: r.Interactions},
+		EnergyFlow:   register(r.EnergyFlow),
+		Amplitude:    register(r.Amplitude),
+		Volume:       register(r.Volume),
+		Frequencies:  make(map[string]frequencyEntry, len(r.FrequencySpec)),
+	}
+	for i, v := range r.FrequencySpec {
+		s.Frequencies[baseFrequencyTag(i)] = frequencyEntry{Value: v, Added: r.Timestamp.UTC()}
+	}
+	return s
+}
+
+func baseFrequencyTag(i int) string {
+	// Padded so base tags sort in the order of the fields they came from
+	return fmt.Sprintf("%s/%06d", basePeer, i)
+}
+
+// ensureState gives a relationship that has none its base state
+func (r *Relationship) ensureState() {
+	if r.State.Interactions == nil {
+		r.State = r.baseState()
+	}
+}
+
+// apply derives the exported fields from the state
+func (r *Relationship) apply() {
+	total := 0
+	for _, n := range r.State.Interactions {
+		total += n
+	}
+	r.Interactions = total
+	if total > 0 {
+		r.Depth = int(math.Log2(float64(total))) + 1
+	}
+	r.EnergyFlow = r.State.EnergyFlow.Value
+	r.Amplitude = r.State.Amplitude.Value
+	r.Volume = r.State.Volume.Value
+
+	tags := sortedKeys(r.State.Frequencies)
+	sort.SliceStable(tags, func(i, j int) bool {
+		a, b := r.State.Frequencies[tags[i]], r.State.Frequencies[tags[j]]
+		return a.Added.Before(b.Added)
+	})
+	r.FrequencySpec = make([]float64, len(tags))
+	for i, tag := range tags {
+		r.FrequencySpec[i] = r.State.Frequencies[tag].Value
+	}
+}
+
+func (r *Relationship) addFrequency(v float64) {
+	r.State.Frequencies[string(peerID)+"/"+uuid.New().String()] = frequencyEntry{Value: v, Added: time.Now().UTC()}
+}
+
+// limitTo drops from a copy of a relationship received from a peer whatever
+// the peer may not change: growth of the counter slots and frequency entries
+// of other peers beyond what local, our copy, holds, and times dated too far
+// ahead. The base values are taken from the first copy we see, so local is
+// nil for a relationship we do not know yet. It reports whether anything
+// was dropped.
+func (r *Relationship) limitTo(from PeerID, local *Relationship) bool {
+	r.ensureState()
+	var ours RelationshipState
+	if local != nil {
+		ours = local.State
+		if ours.Interactions == nil {
+			ours = local.baseState()
+		}
+	}
+	owns := func(p PeerID) bool {
+		return p == from || (local == nil && p == basePeer)
+	}
+
+	changed := false
+	for p, n := range r.State.Interactions {
+		if owns(p) {
+			continue
+		}
+		if limit, ok := ours.Interactions[p]; !ok {
+			delete(r.State.Interactions, p)
+			changed = true
+		} else if n > limit {
+			r.State.Interactions[p] = limit
+			changed = true
+		}
+	}
+	for tag := range r.State.Frequencies {
+		if _, ok := ours.Frequencies[tag]; ok {
+			continue
+		}
+		if adder, _, _ := strings.Cut(tag, "/"); !owns(PeerID(adder)) {
+			delete(r.State.Frequencies, tag)
+			changed = true
+		}
+	}
+
+	latest := time.Now().UTC().Add(maxClockSkew)
+	clamp := func(t *time.Time) {
+		if t.After(latest) {
+			*t = latest
+			changed = true
+		}
+	}
+	clamp(&r.State.EnergyFlow.Time)
+	clamp(&r.State.Amplitude.Time)
+	clamp(&r.State.Volume.Time)
+	for tag, e := range r.State.Frequencies {
+		if e.Added.After(latest) {
+			e.Added = latest
+			r.State.Frequencies[tag] = e
+			changed = true
+		}
+	}
+	clamp(&r.LastInteraction)
+	clamp(&r.Timestamp)
+
+	if changed {
+		r.apply()
+	}
+	return changed
+}
+
+func (r *Relationship) countInteraction() {
+	r.State.Interactions[peerID]++
+}
+
+// clone returns a copy that shares no state with r
+func (r *Relationship) clone() *Relationship {
+	c := *r
+	c.FrequencySpec = append([]float64(nil), r.FrequencySpec...)
+	if r.State.Interactions != nil {
+		c.State.Interactions = make(map[PeerID]int, len(r.State.Interactions))
+		for p, n := range r.State.Interactions {
+			c.State.Interactions[p] = n
+		}
+	}
+	if r.State.Frequencies != nil {
+		c.State.Frequencies = make(map[string]frequencyEntry, len(r.State.Frequencies))
+		for tag, e := range r.State.Frequencies {
+			c.State.Frequencies[tag] = e
+		}
+	}
+	return &c
+}
+
+// mergeRelationship returns the join of two copies of a relationship. It is
+// commutative, associative and idempotent.
+func mergeRelationship(a, b *Relationship) *Relationship {
+	m, o := a.clone(), b.clone()
+	m.ensureState()
+	o.ensureState()
+
+	for p, n := range o.State.Interactions {
+		if n > m.State.Interactions[p] {
+			m.State.Interactions[p] = n
+		}
+	}
+	for _, reg := range []struct{ dst, src *lwwRegister }{
+		{&m.State.EnergyFlow, &o.State.EnergyFlow},
+		{&m.State.Amplitude, &o.State.Amplitude},
+		{&m.State.Volume, &o.State.Volume},
+	} {
+		if reg.src.after(*reg.dst) {
+			*reg.dst = *reg.src
+		}
+	}
+	for tag, e := range o.State.Frequencies {
+		if cur, ok := m.State.Frequencies[tag]; !ok || e.after(cur) {
+			m.State.Frequencies[tag] = e
+		}
+	}
+	if o.LastInteraction.After(m.LastInteraction) {
+		m.LastInteraction = o.LastInteraction
+	}
+	if o.Timestamp.After(m.Timestamp) {
+		m.Timestamp = o.Timestamp
+	}
+	if o.Depth > m.Depth {
+		m.Depth = o.Depth
+	}
+	m.apply()
+	return m
+}
+
+// digest hashes what peers merge of a relationship, so two peers that
+// converged on the same state get the same digest
+func (r *Relationship) digest() string {
+	s := r.State
+	if s.Interactions == nil {
+		s = r.baseState()
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s %s %s\n", r.ID, r.SourceID, r.TargetID, r.Type)
+	for _, p := range sortedKeys(s.Interactions) {
+		fmt.Fprintf(h, "interactions %s %d\n", p, s.Interactions[p])
+	}
+	for _, reg := range []struct {
+		name string
+		lwwRegister
+	}{{"energyFlow", s.EnergyFlow}, {"amplitude", s.Amplitude}, {"volume", s.Volume}} {
+		fmt.Fprintf(h, "%s %v %s %s\n", reg.name, reg.Value, reg.Time.UTC().Format(time.RFC3339Nano), reg.Peer)
+	}
+	for _, tag := range sortedKeys(s.Frequencies) {
+		e := s.Frequencies[tag]
+		fmt.Fprintf(h, "frequency %s %v %s\n", tag, e.Value, e.Added.UTC().Format(time.RFC3339Nano))
+	}
+	fmt.Fprintf(h, "%s %s\n", r.LastInteraction.UTC().Format(time.RFC3339Nano), r.Timestamp.UTC().Format(time.RFC3339Nano))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s RelationshipState) equal(o RelationshipState) bool {
+	if len(s.Interactions) != len(o.Interactions) || len(s.Frequencies) != len(o.Frequencies) {
+		return false
+	}
+	for p, n := range s.Interactions {
+		if on, ok := o.Interactions[p]; !ok || on != n {
+			return false
+		}
+	}
+	for tag, e := range s.Frequencies {
+		oe, ok := o.Frequencies[tag]
+		if !ok || oe.Value != e.Value || !oe.Added.Equal(e.Added) {
+			return false
+		}
+	}
+	return s.EnergyFlow.equal(o.EnergyFlow) && s.Amplitude.equal(o.Amplitude) && s.Volume.equal(o.Volume)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// replica returns a copy of base edited by peer
+func replica(base *Relationship, peer PeerID, edit func(r *Relationship)) *Relationship {
+	prev := peerID
+	peerID = peer
+	defer func() { peerID = prev }()
+
+	r := base.clone()
+	r.ensureState()
+	edit(r)
+	r.apply()
+	return r
+}
+
+func sameRelationship(a, b *Relationship) bool {
+	return a.State.equal(b.State) &&
+		a.Interactions == b.Interactions &&
+		a.Depth == b.Depth &&
+		a.EnergyFlow == b.EnergyFlow &&
+		a.Amplitude == b.Amplitude &&
+		a.Volume == b.Volume &&
+		slices.Equal(a.FrequencySpec, b.FrequencySpec) &&
+		a.Timestamp.Equal(b.Timestamp) &&
+		a.LastInteraction.Equal(b.LastInteraction)
+}
+
+func testReplicas() map[string]*Relationship {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	base := &Relationship{
+		ID: "relationship", SourceID: "a", TargetID: "b",
+		EnergyFlow: 1, Amplitude: 1, Volume: 1, FrequencySpec: []float64{1},
+		Timestamp: start, LastInteraction: start,
+	}
+	return map[string]*Relationship{
+		"base": replica(base, "p1", func(r *Relationship) {}),
+		"interactions": replica(base, "p1", func(r *Relationship) {
+			r.countInteraction()
+			r.countInteraction()
+			r.LastInteraction = start.Add(time.Hour)
+		}),
+		"energy": replica(base, "p2", func(r *Relationship) {
+			r.State.EnergyFlow.set(5)
+			r.addFrequency(2)
+			r.Timestamp = start.Add(2 * time.Hour)
+		}),
+		"volume": replica(base, "p3", func(r *Relationship) {
+			r.State.Volume.set(3)
+			r.State.EnergyFlow.set(7)
+			r.countInteraction()
+		}),
+		// Written without a state, the way relationships stored before the
+		// CRDT were
+		"legacy": {
+			ID: "relationship", SourceID: "a", TargetID: "b",
+			EnergyFlow: 1, Amplitude: 1, Volume: 1, FrequencySpec: []float64{1},
+			Timestamp: start, LastInteraction: start,
+		},
+	}
+}
+
+func TestMergeRelationshipLaws(t *testing.T) {
+	replicas := testReplicas()
+	names := sortedKeys(replicas)
+
+	for _, a := range names {
+		t.Run("idempotent/"+a, func(t *testing.T) {
+			r := replicas[a]
+			if m := mergeRelationship(r, r); !sameRelationship(mergeRelationship(m, r), m) {
+				t.Errorf("merging %s with itself changed it", a)
+			}
+		})
+		for _, b := range names {
+			t.Run("commutative/"+a+"+"+b, func(t *testing.T) {
+				ab := mergeRelationship(replicas[a], replicas[b])
+				ba := mergeRelationship(replicas[b], replicas[a])
+				if !sameRelationship(ab, ba) {
+					t.Errorf("%s+%s = %+v, %s+%s = %+v", a, b, ab, b, a, ba)
+				}
+			})
+			for _, c := range names {
+				t.Run("associative/"+a+"+"+b+"+"+c, func(t *testing.T) {
+					left := mergeRelationship(mergeRelationship(replicas[a], replicas[b]), replicas[c])
+					right := mergeRelationship(replicas[a], mergeRelationship(replicas[b], replicas[c]))
+					if !sameRelationship(left, right) {
+						t.Errorf("(%s+%s)+%s differs from %s+(%s+%s)", a, b, c, a, b, c)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestMergeRelationshipDoesNotModifyInputs(t *testing.T) {
+	replicas := testReplicas()
+	a, b := replicas["interactions"], replicas["energy"]
+	before := a.clone()
+	mergeRelationship(a, b)
+	if !sameRelationship(a, before) {
+		t.Error("merge modified its first argument")
+	}
+}
+
+func permutations(items []string) [][]string {
+	if len(items) <= 1 {
+		return [][]string{items}
+	}
+	var all [][]string
+	for i := range items {
+		rest := append(slices.Clone(items[:i]), items[i+1:]...)
+		for _, p := range permutations(rest) {
+			all = append(all, append([]string{items[i]}, p...))
+		}
+	}
+	return all
+}
+
+func TestMergeRelationshipConvergesInAnyOrder(t *testing.T) {
+	replicas := testReplicas()
+	var want *Relationship
+	for _, order := range permutations(sortedKeys(replicas)) {
+		// Every update is delivered twice, as a lost acknowledgement would
+		got := replicas[order[0]]
+		for _, name := range append(order[1:], order...) {
+			got = mergeRelationship(got, replicas[name])
+		}
+		if want == nil {
+			want = got
+			continue
+		}
+		if !sameRelationship(got, want) {
+			t.Fatalf("order %v converged on %+v, want %+v", order, got, want)
+		}
+	}
+
+	if want.Interactions != 3 {
+		t.Errorf("got %d interactions, want 3", want.Interactions)
+	}
+	if want.EnergyFlow != 7 || want.Volume != 3 {
+		t.Errorf("got energy flow %v and volume %v, want the latest writes 7 and 3", want.EnergyFlow, want.Volume)
+	}
+	if !slices.Equal(want.FrequencySpec, []float64{1, 2}) {
+		t.Errorf("got frequencies %v, want [1 2]", want.FrequencySpec)
+	}
+}
+
+func TestLimitTo(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	local := replica(&Relationship{
+		ID: "relationship", SourceID: "a", TargetID: "b",
+		EnergyFlow: 1, Amplitude: 1, Volume: 1, FrequencySpec: []float64{1},
+		Interactions: 2, Timestamp: start, LastInteraction: start,
+	}, "us", func(r *Relationship) { r.countInteraction() })
+	future := time.Now().UTC().Add(24 * time.Hour)
+
+	tests := []struct {
+		name string
+		// local is our copy, nil if we do not know the relationship
+		local       *Relationship
+		edit        func(r *Relationship)
+		wantChanged bool
+		check       func(t *testing.T, r *Relationship)
+	}{
+		{name: "sender counts its own interactions",
+			local: local,
+			edit:  func(r *Relationship) { r.State.Interactions["sender"] = 5 },
+			check: func(t *testing.T, r *Relationship) {
+				if n := r.State.Interactions["sender"]; n != 5 {
+					t.Errorf("sender slot is %d, want 5", n)
+				}
+			}},
+		{name: "sender raises our slot and the base slot",
+			local: local, wantChanged: true,
+			edit: func(r *Relationship) {
+				r.State.Interactions["us"] = 100
+				r.State.Interactions[basePeer] = 100
+			},
+			check: func(t *testing.T, r *Relationship) {
+				if n := r.State.Interactions["us"]; n != 1 {
+					t.Errorf("our slot is %d, want 1", n)
+				}
+				if n := r.State.Interactions[basePeer]; n != 2 {
+					t.Errorf("base slot is %d, want 2", n)
+				}
+			}},
+		{name: "sender adds a slot of another peer",
+			local: local, wantChanged: true,
+			edit: func(r *Relationship) { r.State.Interactions["other"] = 3 },
+			check: func(t *testing.T, r *Relationship) {
+				if _, ok := r.State.Interactions["other"]; ok {
+					t.Error("slot of another peer was kept")
+				}
+			}},
+		{name: "first copy of a relationship keeps its base",
+			edit: func(r *Relationship) { r.State.Interactions["other"] = 3 }, wantChanged: true,
+			check: func(t *testing.T, r *Relationship) {
+				if n := r.State.Interactions[basePeer]; n != 2 {
+					t.Errorf("base slot is %d, want 2", n)
+				}
+				if _, ok := r.State.Interactions["other"]; ok {
+					t.Error("slot of another peer was kept")
+				}
+			}},
+		{name: "frequencies of the sender and of another peer",
+			local: local, wantChanged: true,
+			edit: func(r *Relationship) {
+				r.State.Frequencies["sender/1"] = frequencyEntry{Value: 2, Added: start}
+				r.State.Frequencies["other/1"] = frequencyEntry{Value: 3, Added: start}
+			},
+			check: func(t *testing.T, r *Relationship) {
+				if _, ok := r.State.Frequencies["sender/1"]; !ok {
+					t.Error("frequency of the sender was dropped")
+				}
+				if _, ok := r.State.Frequencies["other/1"]; ok {
+					t.Error("frequency of another peer was kept")
+				}
+			}},
+		{name: "writes dated ahead",
+			local: local, wantChanged: true,
+			edit: func(r *Relationship) {
+				r.State.EnergyFlow = lwwRegister{Value: 9, Time: future, Peer: "sender"}
+				r.Timestamp = future
+			},
+			check: func(t *testing.T, r *Relationship) {
+				latest := time.Now().UTC().Add(maxClockSkew)
+				if r.State.EnergyFlow.Time.After(latest) || r.Timestamp.After(latest) {
+					t.Errorf("kept times %v and %v, want at most %v", r.State.EnergyFlow.Time, r.Timestamp, latest)
+				}
+				if r.EnergyFlow != 9 {
+					t.Errorf("energy flow is %v, want the write 9", r.EnergyFlow)
+				}
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := local.clone()
+			tt.edit(remote)
+			remote.apply()
+			if changed := remote.limitTo("sender", tt.local); changed != tt.wantChanged {
+				t.Errorf("reported changed %v, want %v", changed, tt.wantChanged)
+			}
+			tt.check(t, remote)
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -18,20 +20,22 @@ func addRelationship(c *gin.Context) {
 	}
 
 	relationship := CreateRelationship(req.SourceID, req.TargetID, req.TypeID)
+	relationshipMu.Lock()
 	relationshipMap[relationship.ID] = relationship
+	relationshipMu.Unlock()
 
-	// Update the concepts
-	conceptMu.Lock()
-	if concept, ok := conceptMap[req.SourceID]; ok {
-		concept.Relationships = append(concept.Relationships, relationship.ID)
-	}
-	if concept, ok := conceptMap[req.TargetID]; ok {
-		concept.Relationships = append(concept.Relationships, relationship.ID)
+	if cid, err := saveRelationship(c.Request.Context(), relationship.ID); err != nil {
+		log.Printf("Failed to store relationship %s: %v", relationship.ID, err)
+	} else {
+		go publishRelationshipUpdate(context.Background(), relationship.ID, cid)
 	}
-	conceptMu.Unlock()
 
-	// Save updated data
-	saveRelationships(c.Request.Context())
+	// Store new versions of the local concepts that link to the relationship
+	for _, guid := range []GUID{req.SourceID, req.TargetID} {
+		if err := appendRelationship(c.Request.Context(), guid, relationship.ID); err != nil {
+			log.Printf("Failed to link relationship %s: %v", relationship.ID, err)
+		}
+	}
 	saveConceptMap()
 
 	c.JSON(http.StatusOK, relationship)
@@ -39,18 +43,31 @@ func addRelationship(c *gin.Context) {
 
 func deepenRelationship(c *gin.Context) {
 	id := GUID(c.Param("id"))
-	if relationship, ok := relationshipMap[id]; ok {
+	relationshipMu.Lock()
+	relationship, ok := relationshipMap[id]
+	var updated Relationship
+	if ok {
 		relationship.Deepen()
-		relationshipMap[id] = relationship
-		saveRelationships(c.Request.Context())
-		c.JSON(http.StatusOK, relationship)
-	} else {
+		updated = *relationship
+	}
+	relationshipMu.Unlock()
+	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Relationship not found"})
+		return
+	}
+
+	if cid, err := saveRelationship(c.Request.Context(), id); err != nil {
+		log.Printf("Failed to store relationship %s: %v", id, err)
+	} else {
+		go publishRelationshipUpdate(context.Background(), id, cid)
 	}
+	c.JSON(http.StatusOK, updated)
 }
 
 func getRelationship(c *gin.Context) {
 	id := GUID(c.Param("id"))
+	relationshipMu.RLock()
+	defer relationshipMu.RUnlock()
 	if relationship, ok := relationshipMap[id]; ok {
 		c.JSON(http.StatusOK, relationship)
 	} else {
@@ -58,6 +75,32 @@ func getRelationship(c *gin.Context) {
 	}
 }
 
+func deleteRelationship(c *gin.Context) {
+	id := GUID(c.Param("id"))
+	relationshipMu.RLock()
+	_, ok := relationshipMap[id]
+	cid := relationship2CID[id]
+	relationshipMu.RUnlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Relationship not found"})
+		return
+	}
+	ownerMu.RLock()
+	owner := ownerGUID
+	ownerMu.RUnlock()
+	if !mayDeleteRelationship(owner, id) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner of its source or target can delete a relationship"})
+		return
+	}
+
+	t := newTombstone(TombstoneRelationship, id, cid)
+	addTombstone(t)
+	forgetRelationship(c.Request.Context(), id)
+	go publishTombstones(context.Background(), t)
+
+	c.Status(http.StatusNoContent)
+}
+
 func getRelationshipTypes(c *gin.Context) {
 	conceptMu.RLock()
 	defer conceptMu.RUnlock()
@@ -75,6 +118,8 @@ func getRelationshipTypes(c *gin.Context) {
 func getRelationshipsByType(c *gin.Context) {
 	typeGUID := GUID(c.Query("type"))
 	var filteredRelationships []*Relationship
+	relationshipMu.RLock()
+	defer relationshipMu.RUnlock()
 	for _, rel := range relationshipMap {
 		if rel.Type == typeGUID {
 			filteredRelationships = append(filteredRelationships, rel)
@@ -93,11 +138,23 @@ func interactWithRelationship(c *gin.Context) {
 		return
 	}
 
-	if relationship, ok := relationshipMap[id]; ok {
+	relationshipMu.Lock()
+	relationship, ok := relationshipMap[id]
+	var updated Relationship
+	if ok {
 		relationship.Interact(req.InteractionTypeGUID)
-		saveRelationships(c.Request.Context())
-		c.JSON(http.StatusOK, relationship)
-	} else {
+		updated = *relationship
+	}
+	relationshipMu.Unlock()
+	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Relationship not found"})
+		return
+	}
+
+	if cid, err := saveRelationship(c.Request.Context(), id); err != nil {
+		log.Printf("Failed to store relationship %s: %v", id, err)
+	} else {
+		go publishRelationshipUpdate(context.Background(), id, cid)
 	}
+	c.JSON(http.StatusOK, updated)
 }
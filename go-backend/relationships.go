@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	gocid "github.com/ipfs/go-cid"
+)
+
+// relationship2CID maps every known relationship to the CID of its stored
+// version, the way GUID2CID does for concepts. It is guarded by
+// relationshipMu and persisted on its own, so a change to one relationship
+// only stores that relationship.
+var relationship2CID = make(map[GUID]CID)
+
+// relationshipSaveMu keeps concurrent saves of one relationship from
+// pointing the index at an older version
+var relationshipSaveMu sync.Mutex
+
+// saveRelationship stores the current state of a relationship as its own
+// pinned DAG-JSON node and points the index at it. The version it replaces
+// is unpinned.
+func saveRelationship(ctx context.Context, id GUID) (CID, error) {
+	relationshipSaveMu.Lock()
+	defer relationshipSaveMu.Unlock()
+
+	relationshipMu.RLock()
+	r, ok := relationshipMap[id]
+	var rel *Relationship
+	if ok {
+		rel = r.clone()
+	}
+	prev := relationship2CID[id]
+	relationshipMu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("relationship %s not found", id)
+	}
+
+	block, err := relationshipBlock(rel)
+	if err != nil {
+		return "", err
+	}
+	cid, err := storeRelationshipBlock(ctx, block.Data)
+	if err != nil {
+		return "", err
+	}
+	indexRelationship(id, cid)
+
+	if prev != "" && prev != cid {
+		releasePin(ctx, prev)
+	}
+	return cid, nil
+}
+
+// storeRelationshipBlock stores and pins an encoded relationship
+func storeRelationshipBlock(ctx context.Context, data []byte) (CID, error) {
+	cid, err := node.PutBlock(ctx, gocid.DagJSON, data, true)
+	if err != nil {
+		return "", fmt.Errorf("failed to store relationship: %v", err)
+	}
+	trackPin(cid)
+	return cid, nil
+}
+
+func indexRelationship(id GUID, cid CID) {
+	relationshipMu.Lock()
+	relationship2CID[id] = cid
+	relationshipMu.Unlock()
+	persister.MarkDirty(relationshipIndexPath)
+}
+
+// relationshipCID returns the CID of the stored version of a relationship
+func relationshipCID(id GUID) (CID, bool) {
+	relationshipMu.RLock()
+	defer relationshipMu.RUnlock()
+	cid, ok := relationship2CID[id]
+	return cid, ok
+}
+
+// fetchRelationship loads a stored relationship and checks it is the one
+// the index names
+func fetchRelationship(ctx context.Context, id GUID, cid CID) (*Relationship, []byte, error) {
+	data, err := node.GetBlock(ctx, cid)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := decodeRelationship(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.ID != id {
+		return nil, nil, fmt.Errorf("%s holds relationship %s, not %s", cid, r.ID, id)
+	}
+	return r, data, nil
+}
+
+// loadRelationships fills relationshipMap from the index
+func loadRelationships(ctx context.Context) {
+	relationshipMu.RLock()
+	index := make(map[GUID]CID, len(relationship2CID))
+	for id, cid := range relationship2CID {
+		index[id] = cid
+	}
+	relationshipMu.RUnlock()
+
+	for id, cid := range index {
+		r, _, err := fetchRelationship(ctx, id, cid)
+		if err != nil {
+			log.Printf("Unable to load relationship %s: %s: %v", id, cid, err)
+			continue
+		}
+		relationshipMu.Lock()
+		relationshipMap[id] = r
+		relationshipMu.Unlock()
+	}
+}
+
+// mergedRelationships remembers the last version of each relationship we
+// merged from every peer, so an unchanged announcement is not fetched again
+var (
+	mergedRelationships   = make(map[PeerID]map[GUID]CID)
+	mergedRelationshipsMu sync.Mutex
+)
+
+func lastMerged(from PeerID, id GUID) CID {
+	mergedRelationshipsMu.Lock()
+	defer mergedRelationshipsMu.Unlock()
+	return mergedRelationships[from][id]
+}
+
+func setLastMerged(from PeerID, id GUID, cid CID) {
+	mergedRelationshipsMu.Lock()
+	defer mergedRelationshipsMu.Unlock()
+	if mergedRelationships[from] == nil {
+		mergedRelationships[from] = make(map[GUID]CID)
+	}
+	mergedRelationships[from][id] = cid
+}
+
+// relationshipMerged reports whether there is nothing left to do for a
+// version of a relationship a peer announced
+func relationshipMerged(from PeerID, id GUID, cid CID) bool {
+	local, _ := relationshipCID(id)
+	return local == cid || lastMerged(from, id) == cid || relationshipDeleted(id)
+}
+
+// replicateRelationship merges a version of a relationship a peer announced
+// into ours, or quarantines it if the peer is untrusted
+func replicateRelationship(ctx context.Context, from PeerID, id GUID, cid CID) error {
+	if relationshipMerged(from, id, cid) {
+		return nil
+	}
+	switch trustOf(from) {
+	case TrustBlocked:
+		return nil
+	case TrustUntrusted:
+		return quarantineRelationship(ctx, from, id, cid)
+	}
+	if err := mergeAnnouncedRelationship(ctx, from, id, cid); err != nil {
+		return fmt.Errorf("failed to merge relationship %s: %v", id, err)
+	}
+	return nil
+}
+
+// mergeAnnouncedRelationship fetches a version of a relationship a peer
+// announced and merges it into ours. A relationship we do not know yet is
+// kept as the peer stored it, unless it holds more than the peer may write.
+func mergeAnnouncedRelationship(ctx context.Context, from PeerID, id GUID, cid CID) error {
+	r, data, err := fetchRelationship(ctx, id, cid)
+	if err != nil {
+		return err
+	}
+
+	if _, known := relationshipCID(id); !known && !r.clone().limitTo(from, nil) {
+		if _, err := storeRelationshipBlock(ctx, data); err != nil {
+			return err
+		}
+		relationshipMu.Lock()
+		_, exists := relationshipMap[id]
+		if !exists {
+			relationshipMap[id] = r
+			relationship2CID[id] = cid
+		}
+		relationshipMu.Unlock()
+		if !exists {
+			persister.MarkDirty(relationshipIndexPath)
+			setLastMerged(from, id, cid)
+			return nil
+		}
+	}
+
+	if err := mergeReceivedRelationship(ctx, from, r); err != nil {
+		return err
+	}
+	setLastMerged(from, id, cid)
+	return nil
+}
+
+// quarantineRelationship holds a relationship an untrusted peer announced
+// until it is approved
+func quarantineRelationship(ctx context.Context, from PeerID, id GUID, cid CID) error {
+	if quarantinedCID(QuarantineRelationship, from, id) == cid {
+		return nil
+	}
+	r, _, err := fetchRelationship(ctx, id, cid)
+	if err != nil {
+		return fmt.Errorf("failed to fetch relationship %s: %v", id, err)
+	}
+	quarantineItem(QuarantinedItem{Kind: QuarantineRelationship, Peer: from, ItemID: id, CID: cid, Relationship: r})
+	return nil
+}
+
+// mergeReceivedRelationship merges a copy of a relationship received from a
+// peer into ours and stores the result if the copy changed anything. What
+// the peer may not write is dropped from the copy first.
+func mergeReceivedRelationship(ctx context.Context, from PeerID, remote *Relationship) error {
+	if relationshipDeleted(remote.ID) {
+		return nil
+	}
+	relationshipMu.Lock()
+	local, ok := relationshipMap[remote.ID]
+	remote.limitTo(from, local)
+	changed := true
+	if !ok {
+		remote.ensureState()
+		relationshipMap[remote.ID] = remote
+	} else {
+		merged := mergeRelationship(local, remote)
+		changed = !merged.State.equal(local.State) ||
+			!merged.Timestamp.Equal(local.Timestamp) ||
+			!merged.LastInteraction.Equal(local.LastInteraction)
+		if changed {
+			*local = *merged
+		}
+	}
+	relationshipMu.Unlock()
+
+	if !changed {
+		return nil
+	}
+	if _, err := saveRelationship(ctx, remote.ID); err != nil {
+		return err
+	}
+	log.Printf("Merged relationship %s", remote.ID)
+	return nil
+}
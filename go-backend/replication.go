@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	gocid "github.com/ipfs/go-cid"
+)
+
+const (
+	replicationQueueSize = 1024
+	replicationBackoff   = 2 * time.Second
+)
+
+// remoteConcepts holds the concepts other peers announced, by peer and GUID.
+// They are kept apart from conceptMap, which only holds our own concepts.
+var (
+	remoteConcepts   = make(RemoteConceptMap)
+	remoteConceptsMu sync.RWMutex
+)
+
+// RemoteConceptMap persists every concept with the CID it was replicated
+// from, which Concept leaves out
+type RemoteConceptMap map[PeerID]map[GUID]*Concept
+
+type remoteConceptRecord struct {
+	*Concept
+	CID CID
+}
+
+func (m RemoteConceptMap) MarshalJSON() ([]byte, error) {
+	records := make(map[PeerID]map[GUID]remoteConceptRecord, len(m))
+	for peer, concepts := range m {
+		records[peer] = make(map[GUID]remoteConceptRecord, len(concepts))
+		for guid, c := range concepts {
+			records[peer][guid] = remoteConceptRecord{Concept: c, CID: c.CID}
+		}
+	}
+	return json.Marshal(records)
+}
+
+func (m *RemoteConceptMap) UnmarshalJSON(data []byte) error {
+	var records map[PeerID]map[GUID]remoteConceptRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+	*m = make(RemoteConceptMap, len(records))
+	for peer, concepts := range records {
+		(*m)[peer] = make(map[GUID]*Concept, len(concepts))
+		for guid, r := range concepts {
+			if r.Concept == nil {
+				continue
+			}
+			r.Concept.CID = r.CID
+			(*m)[peer][guid] = r.Concept
+		}
+	}
+	return nil
+}
+
+type replicationJob struct {
+	peer PeerID
+	cid  CID
+	// relationship is set when cid is a version of a relationship rather
+	// than a concept
+	relationship GUID
+}
+
+// Replicator fetches the concepts and relationships announced by peers in
+// the background
+type Replicator struct {
+	jobs chan replicationJob
+
+	mu      sync.Mutex
+	pending map[replicationJob]bool
+	// announced holds the latest set of CIDs each peer announced, so a fetch
+	// that finishes after the peer moved on is not stored
+	announced map[PeerID]map[CID]bool
+}
+
+var replicator = &Replicator{
+	jobs:      make(chan replicationJob, replicationQueueSize),
+	pending:   make(map[replicationJob]bool),
+	announced: make(map[PeerID]map[CID]bool),
+}
+
+// Run starts the workers and returns once ctx is done
+func (r *Replicator) Run(ctx context.Context, workers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-r.jobs:
+					r.replicate(ctx, job)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Announce records the CIDs a peer currently announces, queues the ones we
+// have not replicated yet and forgets the ones it no longer announces
+func (r *Replicator) Announce(peer PeerID, cids []CID) {
+	if trustOf(peer) == TrustBlocked {
+		return
+	}
+	current := make(map[CID]bool, len(cids))
+	for _, cid := range cids {
+		current[cid] = true
+	}
+	r.mu.Lock()
+	r.announced[peer] = current
+	r.mu.Unlock()
+
+	known := make(map[CID]bool)
+	pruned := 0
+	remoteConceptsMu.Lock()
+	for guid, c := range remoteConcepts[peer] {
+		if current[c.CID] {
+			known[c.CID] = true
+		} else {
+			delete(remoteConcepts[peer], guid)
+			pruned++
+		}
+	}
+	remoteConceptsMu.Unlock()
+	if pruned > 0 {
+		persister.MarkDirty(remoteConceptsPath)
+	}
+
+	for _, cid := range cids {
+		if !known[cid] && !conceptDeleted(peer, "", cid) && !quarantinedConceptCID(peer, cid) {
+			log.Printf("Found new CID from peer %s: %s", peer, cid)
+			r.enqueue(replicationJob{peer: peer, cid: cid})
+		}
+	}
+}
+
+// AnnounceRelationships queues the versions of relationships a peer
+// announced that we have not merged yet
+func (r *Replicator) AnnounceRelationships(peer PeerID, announced map[GUID]CID) {
+	if trustOf(peer) == TrustBlocked {
+		return
+	}
+	for id, cid := range announced {
+		if !relationshipMerged(peer, id, cid) {
+			r.enqueue(replicationJob{peer: peer, cid: cid, relationship: id})
+		}
+	}
+}
+
+// Forget drops what a peer announced, so fetches still queued for it are not
+// stored
+func (r *Replicator) Forget(peer PeerID) {
+	r.mu.Lock()
+	delete(r.announced, peer)
+	r.mu.Unlock()
+}
+
+func (r *Replicator) enqueue(job replicationJob) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending[job] {
+		return
+	}
+	select {
+	case r.jobs <- job:
+		r.pending[job] = true
+	default:
+		// The peer announces concepts again, relationships are picked up
+		// by the next reconciliation with it
+		log.Printf("Replication queue full, skipping %s from peer %s", job.cid, job.peer)
+	}
+}
+
+func (r *Replicator) done(job replicationJob) {
+	r.mu.Lock()
+	delete(r.pending, job)
+	r.mu.Unlock()
+}
+
+// stillAnnounced reports whether a job is still worth retrying. Peers
+// announce relationships as changes rather than sets, so a relationship
+// version stays wanted until it is merged or the peer is blocked.
+func (r *Replicator) stillAnnounced(job replicationJob) bool {
+	if job.relationship != "" {
+		return trustOf(job.peer) != TrustBlocked && !relationshipMerged(job.peer, job.relationship, job.cid)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.announced[job.peer][job.cid]
+}
+
+func (r *Replicator) replicate(ctx context.Context, job replicationJob) {
+	defer r.done(job)
+
+	backoff := replicationBackoff
+	for attempt := 0; ; attempt++ {
+		err := r.attempt(ctx, job)
+		if err == nil {
+			return
+		}
+		if attempt >= config.ReplicationRetries || !r.stillAnnounced(job) {
+			log.Printf("Failed to replicate %s from peer %s: %v", job.cid, job.peer, err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (r *Replicator) attempt(ctx context.Context, job replicationJob) error {
+	if job.relationship != "" {
+		return replicateRelationship(ctx, job.peer, job.relationship, job.cid)
+	}
+	concept, err := fetchConcept(ctx, job.cid)
+	if err == nil {
+		err = validateRemoteConcept(job.peer, job.cid, concept)
+	}
+	if err == nil {
+		concept.CID = job.cid
+		r.store(job, concept)
+	}
+	return err
+}
+
+var errNotConceptNode = errors.New("not a concept node")
+
+// validateRemoteConcept checks that a peer announced a concept node of its
+// own. A concept belongs to this node or to the owner of the peer that
+// announced it first.
+func validateRemoteConcept(peer PeerID, cid CID, c *Concept) error {
+	if parsed, err := gocid.Decode(string(cid)); err != nil || parsed.Type() != gocid.DagJSON {
+		return fmt.Errorf("%w: %s", errNotConceptNode, cid)
+	}
+	if c.GUID == "" {
+		return fmt.Errorf("concept has no GUID")
+	}
+	if c.Name == "" {
+		return fmt.Errorf("concept %s has no name", c.GUID)
+	}
+	if c.Timestamp.IsZero() {
+		return fmt.Errorf("concept %s has no timestamp", c.GUID)
+	}
+
+	conceptMu.RLock()
+	_, ours := conceptMap[c.GUID]
+	conceptMu.RUnlock()
+	if ours {
+		return fmt.Errorf("concept %s belongs to this node", c.GUID)
+	}
+
+	var owner GUID
+	peerMapMu.RLock()
+	if p, ok := peerMap[peer]; ok {
+		owner = p.GetOwnerGUID()
+	}
+	peerMapMu.RUnlock()
+	if owner == "" {
+		return fmt.Errorf("peer %s has no owner", peer)
+	}
+	if other, ok := conceptClaimedBy(c.GUID, owner); ok {
+		return fmt.Errorf("concept %s belongs to peer %s", c.GUID, other)
+	}
+	return nil
+}
+
+// conceptClaimedBy returns a peer of another owner that we replicated a
+// concept from
+func conceptClaimedBy(guid, owner GUID) (PeerID, bool) {
+	remoteConceptsMu.RLock()
+	var claimants []PeerID
+	for peer, concepts := range remoteConcepts {
+		if _, ok := concepts[guid]; ok {
+			claimants = append(claimants, peer)
+		}
+	}
+	remoteConceptsMu.RUnlock()
+
+	peerMapMu.RLock()
+	defer peerMapMu.RUnlock()
+	for _, peer := range claimants {
+		if p, ok := peerMap[peer]; ok && p.GetOwnerGUID() != owner {
+			return peer, true
+		}
+	}
+	return "", false
+}
+
+func (r *Replicator) store(job replicationJob, concept *Concept) {
+	if !r.stillAnnounced(job) || conceptDeleted(job.peer, concept.GUID, "") {
+		return
+	}
+	switch trustOf(job.peer) {
+	case TrustBlocked:
+		return
+	case TrustUntrusted:
+		quarantineItem(QuarantinedItem{Kind: QuarantineConcept, Peer: job.peer, ItemID: concept.GUID, CID: job.cid, Concept: concept})
+		return
+	}
+	keepRemoteConcept(job.peer, concept)
+	log.Printf("Replicated concept %s (%s) from peer %s", concept.GUID, job.cid, job.peer)
+}
+
+func keepRemoteConcept(peer PeerID, concept *Concept) {
+	remoteConceptsMu.Lock()
+	concepts, ok := remoteConcepts[peer]
+	if !ok {
+		concepts = make(map[GUID]*Concept)
+		remoteConcepts[peer] = concepts
+	}
+	concepts[concept.GUID] = concept
+	remoteConceptsMu.Unlock()
+	persister.MarkDirty(remoteConceptsPath)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	gocid "github.com/ipfs/go-cid"
+)
+
+func newTestReplicator() *Replicator {
+	return &Replicator{
+		jobs:      make(chan replicationJob, replicationQueueSize),
+		pending:   make(map[replicationJob]bool),
+		announced: make(map[PeerID]map[CID]bool),
+	}
+}
+
+func TestAnnouncedRelationshipsAreFetchedByWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	local := resetState(t)
+	remote := NewMemoryNode(local.hub)
+	if err := local.Connect(ctx, remote.id); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	id := GUID("relationship")
+	block, err := relationshipBlock(&Relationship{ID: id, SourceID: "a", TargetID: "b", EnergyFlow: 1, Timestamp: time.Now()})
+	if err != nil {
+		t.Fatalf("relationshipBlock: %v", err)
+	}
+	cid, err := remote.PutBlock(ctx, gocid.DagJSON, block.Data, true)
+	if err != nil {
+		t.Fatalf("PutBlock: %v", err)
+	}
+
+	replicator.AnnounceRelationships(remote.id, map[GUID]CID{id: cid})
+	if _, ok := relationshipCID(id); ok {
+		t.Fatal("relationship merged in the announcing goroutine")
+	}
+	// Announcing the same version again while it is queued adds no job
+	replicator.AnnounceRelationships(remote.id, map[GUID]CID{id: cid})
+	if n := len(replicator.jobs); n != 1 {
+		t.Fatalf("%d jobs queued, want 1", n)
+	}
+
+	// The worker is stopped before the next test resets the state
+	stopped := make(chan struct{})
+	go func() {
+		replicator.Run(ctx, 1)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	deadline := time.Now().Add(time.Second)
+	for {
+		if got, ok := relationshipCID(id); ok {
+			if got != cid {
+				t.Errorf("relationship stored as %s, want %s", got, cid)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("relationship was not merged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestValidateRemoteConcept(t *testing.T) {
+	ctx := context.Background()
+	resetState(t)
+	conceptNode, err := node.PutBlock(ctx, gocid.DagJSON, []byte(`{}`), false)
+	if err != nil {
+		t.Fatalf("PutBlock: %v", err)
+	}
+	fileNode, err := node.Add(ctx, strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	peerMap["alice-node"] = &Peer{ID: "alice-node", OwnerGUID: "alice"}
+	peerMap["alice-laptop"] = &Peer{ID: "alice-laptop", OwnerGUID: "alice"}
+	peerMap["bob-node"] = &Peer{ID: "bob-node", OwnerGUID: "bob"}
+	peerMap["anonymous"] = &Peer{ID: "anonymous"}
+	conceptMap["ours"] = &Concept{GUID: "ours"}
+	remoteConcepts = RemoteConceptMap{"alice-node": {"alice's": &Concept{GUID: "alice's"}}}
+
+	concept := func(guid GUID) *Concept { return &Concept{GUID: guid, Name: "name", Timestamp: time.Now()} }
+	tests := []struct {
+		name    string
+		peer    PeerID
+		cid     CID
+		concept *Concept
+		wantErr bool
+	}{
+		{name: "new concept", peer: "bob-node", cid: conceptNode, concept: concept("bob's")},
+		{name: "concept of a node of the same owner", peer: "alice-laptop", cid: conceptNode, concept: concept("alice's")},
+		{name: "not a DAG node", peer: "bob-node", cid: fileNode, concept: concept("bob's"), wantErr: true},
+		{name: "no name", peer: "bob-node", cid: conceptNode, concept: &Concept{GUID: "bob's", Timestamp: time.Now()}, wantErr: true},
+		{name: "no timestamp", peer: "bob-node", cid: conceptNode, concept: &Concept{GUID: "bob's", Name: "name"}, wantErr: true},
+		{name: "one of our concepts", peer: "bob-node", cid: conceptNode, concept: concept("ours"), wantErr: true},
+		{name: "concept of another owner", peer: "bob-node", cid: conceptNode, concept: concept("alice's"), wantErr: true},
+		{name: "peer without an owner", peer: "anonymous", cid: conceptNode, concept: concept("new"), wantErr: true},
+		{name: "unknown peer", peer: "stranger", cid: conceptNode, concept: concept("new"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRemoteConcept(tt.peer, tt.cid, tt.concept)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRemoteConceptsKeepTheirCID(t *testing.T) {
+	in := RemoteConceptMap{"peer": {"guid": &Concept{GUID: "guid", Name: "name", CID: "bafy"}}}
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var out RemoteConceptMap
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if c := out["peer"]["guid"]; c == nil || c.CID != "bafy" || c.Name != "name" {
+		t.Errorf("got %+v from %s", c, data)
+	}
+}
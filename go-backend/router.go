@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Every message on the topic is an Envelope naming the type of its body.
+// Nodes skip the types they do not know, so a new kind of message can be
+// added without breaking older nodes. The version only changes when the
+// envelope itself does.
+const envelopeVersion = 1
+
+type MessageType string
+
+const (
+	MessageAnnounce           MessageType = "announce"
+	MessageRelationshipUpdate MessageType = "relationship-update"
+	MessageTombstone          MessageType = "tombstone"
+	MessageKudos              MessageType = "kudos"
+	MessageSyncRequest        MessageType = "sync-request"
+	MessageSyncResponse       MessageType = "sync-response"
+	MessageReconcileRequest   MessageType = "reconcile-request"
+	MessageReconcileResponse  MessageType = "reconcile-response"
+	MessageDirect             MessageType = "direct-message"
+)
+
+var errUnsupportedVersion = errors.New("unsupported envelope version")
+
+type Envelope struct {
+	Version   int         `json:"version"`
+	Type      MessageType `json:"type"`
+	PeerID    PeerID      `json:"peerId"`
+	OwnerGUID GUID        `json:"ownerGuid"`
+	// OwnerKey is the key direct messages to the owner are sealed with
+	OwnerKey []byte          `json:"ownerKey,omitempty"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// Announcement tells peers what changed since the previous one, see sync.go
+type Announcement struct {
+	Seq     uint64     `json:"seq"`
+	Changes *ChangeSet `json:"changes,omitempty"`
+}
+
+// RelationshipUpdate pushes new versions of relationships as soon as they
+// are stored, ahead of the next announcement
+type RelationshipUpdate struct {
+	Relationships map[GUID]CID `json:"relationships"`
+}
+
+// MessageRouter verifies the messages received on the topic and passes them
+// to the handler registered for their type
+type MessageRouter struct {
+	mu       sync.RWMutex
+	handlers map[MessageType]MessageHandler
+}
+
+func NewMessageRouter() *MessageRouter {
+	return &MessageRouter{handlers: make(map[MessageType]MessageHandler)}
+}
+
+// Handle registers the handler of a message type
+func (r *MessageRouter) Handle(t MessageType, h MessageHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[t] = h
+}
+
+// handleBody adapts a function taking the decoded body of a message to a
+// MessageHandler
+func handleBody[T any](fn func(ctx context.Context, from PeerID, body T)) MessageHandler {
+	return func(ctx context.Context, msg PubSubMessage) error {
+		var body T
+		if err := json.Unmarshal(msg.Data, &body); err != nil {
+			return fmt.Errorf("invalid message body: %v", err)
+		}
+		if err := limiter.checkRelationships(msg.From, body); err != nil {
+			return err
+		}
+		fn(ctx, msg.From, body)
+		return nil
+	}
+}
+
+// Route is the handler of the topic subscription. Handlers get the body of
+// the envelope as the message data and its verified sender as From.
+func (r *MessageRouter) Route(ctx context.Context, msg PubSubMessage) error {
+	if err := limiter.checkSize(msg.From, len(msg.Data)); err != nil {
+		return err
+	}
+	// Senders the transport names are limited before we spend time on
+	// their signature, the others once we know who signed
+	if msg.From != "" {
+		if err := limiter.allow(msg.From); err != nil {
+			return err
+		}
+	}
+	payload, signer, err := verifyMessage(msg)
+	if err != nil {
+		return err
+	}
+	var env Envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return fmt.Errorf("invalid envelope: %v", err)
+	}
+	if env.Version != envelopeVersion {
+		return fmt.Errorf("%w %d", errUnsupportedVersion, env.Version)
+	}
+	if env.PeerID != signer {
+		return fmt.Errorf("%w: claims to be %s, signed by %s", errSenderMismatch, env.PeerID, signer)
+	}
+
+	// Pubsub delivers our own messages back to us
+	if env.PeerID == peerID {
+		return nil
+	}
+	if trustOf(env.PeerID) == TrustBlocked {
+		return fmt.Errorf("%w: %s", errPeerBlocked, env.PeerID)
+	}
+	if msg.From == "" {
+		if err := limiter.allow(env.PeerID); err != nil {
+			return err
+		}
+	}
+
+	// Add or update the sender in the peer list
+	addOrUpdatePeer(ctx, env.PeerID, env.OwnerGUID, env.OwnerKey)
+
+	r.mu.RLock()
+	h, ok := r.handlers[env.Type]
+	r.mu.RUnlock()
+	if !ok {
+		log.Printf("Ignoring %s message from peer %s", env.Type, env.PeerID)
+		return nil
+	}
+	return h(ctx, PubSubMessage{From: env.PeerID, Data: env.Body})
+}
+
+var router = newPeerMessageRouter()
+
+func newPeerMessageRouter() *MessageRouter {
+	r := NewMessageRouter()
+	r.Handle(MessageAnnounce, handleBody(handleAnnouncement))
+	r.Handle(MessageRelationshipUpdate, handleBody(handleRelationshipUpdate))
+	r.Handle(MessageTombstone, handleBody(handleTombstones))
+	r.Handle(MessageKudos, handleBody(handleKudos))
+	r.Handle(MessageSyncRequest, handleBody(answerSyncRequest))
+	r.Handle(MessageSyncResponse, handleBody(handleSyncResponse))
+	r.Handle(MessageReconcileRequest, handleBody(answerReconcileRequest))
+	r.Handle(MessageReconcileResponse, handleBody(handleReconcileResponse))
+	r.Handle(MessageDirect, handleBody(handleDirectMessage))
+	return r
+}
+
+// publishMessage wraps a body in a signed envelope and publishes it on the
+// topic
+func publishMessage(ctx context.Context, t MessageType, body interface{}) error {
+	return publishMessageTo(ctx, config.PubsubTopic, t, body)
+}
+
+func publishMessageTo(ctx context.Context, topic string, t MessageType, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s message: %v", t, err)
+	}
+	ownerMu.RLock()
+	env := Envelope{Version: envelopeVersion, Type: t, PeerID: peerID, OwnerGUID: ownerGUID, Body: data}
+	if ownerPublicKey != nil {
+		env.OwnerKey = ownerPublicKey[:]
+	}
+	ownerMu.RUnlock()
+
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("failed to marshal envelope: %v", err)
+	}
+	signed, err := signMessage(ctx, payload)
+	if err != nil {
+		return err
+	}
+	return node.Publish(ctx, topic, signed)
+}
+
+func handleRelationshipUpdate(ctx context.Context, from PeerID, update RelationshipUpdate) {
+	replicator.AnnounceRelationships(from, update.Relationships)
+}
+
+// handleKudos takes in kudos without acting on them. Nothing sends them yet,
+// the type is reserved so that the nodes which start to are not logged as
+// sending an unknown type.
+func handleKudos(ctx context.Context, from PeerID, body json.RawMessage) {}
+
+// publishRelationshipUpdate pushes a stored relationship to peers
+func publishRelationshipUpdate(ctx context.Context, id GUID, cid CID) {
+	update := RelationshipUpdate{Relationships: map[GUID]CID{id: cid}}
+	if err := publishMessage(ctx, MessageRelationshipUpdate, update); err != nil {
+		log.Printf("Failed to publish update of relationship %s: %v", id, err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func signedBy(t *testing.T, n *MemoryNode, payload []byte) SignedMessage {
+	t.Helper()
+	signature, publicKey, err := n.Sign(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return SignedMessage{Payload: payload, PublicKey: publicKey, Signature: signature}
+}
+
+func encode(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	return data
+}
+
+func TestVerifyMessage(t *testing.T) {
+	hub := NewMemoryHub()
+	alice, mallory := NewMemoryNode(hub), NewMemoryNode(hub)
+	payload := []byte(`{"hello":"world"}`)
+
+	tests := []struct {
+		name    string
+		from    PeerID
+		msg     func() SignedMessage
+		wantErr error
+	}{
+		{name: "signed by the sender", from: alice.id, msg: func() SignedMessage { return signedBy(t, alice, payload) }},
+		{name: "sender unknown to the transport", from: "", msg: func() SignedMessage { return signedBy(t, alice, payload) }},
+		{name: "unsigned", from: alice.id, msg: func() SignedMessage { return SignedMessage{Payload: payload} }, wantErr: errUnsigned},
+		{name: "tampered payload", from: alice.id, msg: func() SignedMessage {
+			m := signedBy(t, alice, payload)
+			m.Payload = []byte(`{"hello":"mallory"}`)
+			return m
+		}, wantErr: errBadSignature},
+		{name: "signature of another key", from: alice.id, msg: func() SignedMessage {
+			m := signedBy(t, alice, payload)
+			m.Signature = signedBy(t, mallory, payload).Signature
+			return m
+		}, wantErr: errBadSignature},
+		{name: "garbage public key", from: alice.id, msg: func() SignedMessage {
+			m := signedBy(t, alice, payload)
+			m.PublicKey = []byte("not a key")
+			return m
+		}, wantErr: errBadSignature},
+		{name: "published by someone else", from: mallory.id, msg: func() SignedMessage { return signedBy(t, alice, payload) }, wantErr: errSenderMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, signer, err := verifyMessage(PubSubMessage{From: tt.from, Data: encode(t, tt.msg())})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if signer != alice.id || string(got) != string(payload) {
+				t.Errorf("got %q signed by %s", got, signer)
+			}
+		})
+	}
+}
+
+func TestRouteRejectsEnvelopeOfAnotherPeer(t *testing.T) {
+	resetState(t)
+	hub := NewMemoryHub()
+	alice, mallory := NewMemoryNode(hub), NewMemoryNode(hub)
+
+	handled := 0
+	r := NewMessageRouter()
+	r.Handle(MessageAnnounce, func(ctx context.Context, msg PubSubMessage) error {
+		handled++
+		return nil
+	})
+
+	tests := []struct {
+		name    string
+		signer  *MemoryNode
+		claims  PeerID
+		wantErr error
+	}{
+		{name: "envelope of the signer", signer: alice, claims: alice.id},
+		{name: "envelope claiming another peer", signer: mallory, claims: alice.id, wantErr: errSenderMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled = 0
+			env := Envelope{Version: envelopeVersion, Type: MessageAnnounce, PeerID: tt.claims, OwnerGUID: "owner", Body: json.RawMessage(`{}`)}
+			msg := PubSubMessage{From: tt.signer.id, Data: encode(t, signedBy(t, tt.signer, encode(t, env)))}
+			err := r.Route(context.Background(), msg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if want := map[bool]int{true: 1, false: 0}[tt.wantErr == nil]; handled != want {
+				t.Errorf("handler ran %d times, want %d", handled, want)
+			}
+		})
+	}
+}
+
+func TestRouteVersions(t *testing.T) {
+	hub := NewMemoryHub()
+	sender := NewMemoryNode(hub)
+
+	tests := []struct {
+		name    string
+		payload interface{}
+		wantErr error
+	}{
+		{name: "message of a node that predates envelopes",
+			payload: map[string]interface{}{"peerId": sender.id, "ownerGuid": "owner", "cids": []CID{"a", "b"}},
+			wantErr: errUnsupportedVersion},
+		{name: "envelope of a later version",
+			payload: Envelope{Version: envelopeVersion + 1, Type: MessageAnnounce, PeerID: sender.id, Body: json.RawMessage(`{}`)},
+			wantErr: errUnsupportedVersion},
+		{name: "kudos",
+			payload: Envelope{Version: envelopeVersion, Type: MessageKudos, PeerID: sender.id, Body: json.RawMessage(`{}`)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState(t)
+
+			msg := PubSubMessage{From: sender.id, Data: encode(t, signedBy(t, sender, encode(t, tt.payload)))}
+			err := newPeerMessageRouter().Route(context.Background(), msg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if len(replicator.announced[sender.id]) > 0 {
+				t.Errorf("peer announced %v, want nothing", sortedKeys(replicator.announced[sender.id]))
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SubscriptionState string
+
+const (
+	SubscriptionConnecting SubscriptionState = "connecting"
+	SubscriptionConnected  SubscriptionState = "connected"
+	SubscriptionRetrying   SubscriptionState = "retrying"
+	SubscriptionStopped    SubscriptionState = "stopped"
+)
+
+// SubscriptionStatus is a snapshot of a supervised subscription
+type SubscriptionStatus struct {
+	Topic       string            `json:"topic"`
+	State       SubscriptionState `json:"state"`
+	ConnectedAt *time.Time        `json:"connectedAt,omitempty"`
+	LastError   string            `json:"lastError,omitempty"`
+	LastErrorAt *time.Time        `json:"lastErrorAt,omitempty"`
+	NextRetryAt *time.Time        `json:"nextRetryAt,omitempty"`
+	Failures    int               `json:"failures"`
+	Reconnects  int               `json:"reconnects"`
+	Received    int               `json:"received"`
+	// Rejected counts the messages the handler refused, such as unsigned
+	// ones
+	Rejected        int        `json:"rejected"`
+	LastRejection   string     `json:"lastRejection,omitempty"`
+	LastRejectionAt *time.Time `json:"lastRejectionAt,omitempty"`
+}
+
+// MessageHandler handles a message received on a topic. An error rejects
+// the message.
+type MessageHandler func(context.Context, PubSubMessage) error
+
+// Subscription keeps a pubsub subscription alive, resubscribing with
+// exponential backoff whenever subscribing fails or the stream ends
+type Subscription struct {
+	topic      string
+	handler    MessageHandler
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu     sync.RWMutex
+	status SubscriptionStatus
+}
+
+var (
+	subscriptions   = make(map[string]*Subscription)
+	subscriptionsMu sync.RWMutex
+)
+
+func NewSubscription(topic string, handler MessageHandler, minBackoff, maxBackoff time.Duration) *Subscription {
+	return &Subscription{
+		topic:      topic,
+		handler:    handler,
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		status:     SubscriptionStatus{Topic: topic, State: SubscriptionConnecting},
+	}
+}
+
+// startSubscription registers a supervised subscription and runs it until
+// ctx is done
+func startSubscription(ctx context.Context, topic string, handler MessageHandler) *Subscription {
+	sub := NewSubscription(topic, handler, config.SubscribeMinBackoff, config.SubscribeMaxBackoff)
+
+	subscriptionsMu.Lock()
+	subscriptions[topic] = sub
+	subscriptionsMu.Unlock()
+
+	go sub.Run(ctx)
+	return sub
+}
+
+func (s *Subscription) Status() SubscriptionStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+func (s *Subscription) update(fn func(*SubscriptionStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.status)
+}
+
+func (s *Subscription) Run(ctx context.Context) {
+	defer s.update(func(st *SubscriptionStatus) {
+		st.State = SubscriptionStopped
+		st.NextRetryAt = nil
+	})
+
+	backoff := s.minBackoff
+	for ctx.Err() == nil {
+		s.update(func(st *SubscriptionStatus) { st.State = SubscriptionConnecting })
+
+		ch, err := node.Subscribe(ctx, s.topic)
+		if err == nil {
+			connectedAt := time.Now()
+			s.update(func(st *SubscriptionStatus) {
+				if st.ConnectedAt != nil {
+					st.Reconnects++
+				}
+				st.State = SubscriptionConnected
+				st.ConnectedAt = &connectedAt
+				st.NextRetryAt = nil
+				st.Failures = 0
+			})
+			log.Printf("Subscribed to topic: %s", s.topic)
+
+			s.consume(ctx, ch)
+			if ctx.Err() != nil {
+				return
+			}
+			err = fmt.Errorf("subscription stream closed")
+
+			// Only a connection that stayed up for a while resets the backoff,
+			// so a daemon that accepts and immediately drops us is not hammered
+			if time.Since(connectedAt) > s.maxBackoff {
+				backoff = s.minBackoff
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/5+1))
+		now := time.Now()
+		retryAt := now.Add(wait)
+		s.update(func(st *SubscriptionStatus) {
+			st.State = SubscriptionRetrying
+			st.LastError = err.Error()
+			st.LastErrorAt = &now
+			st.NextRetryAt = &retryAt
+			st.Failures++
+		})
+		log.Printf("Subscription to %s failed: %v, retrying in %s", s.topic, err, wait.Round(time.Millisecond))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+func (s *Subscription) consume(ctx context.Context, ch <-chan PubSubMessage) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			s.update(func(st *SubscriptionStatus) { st.Received++ })
+			if err := s.deliver(ctx, msg); err != nil {
+				now := time.Now()
+				s.update(func(st *SubscriptionStatus) {
+					st.Rejected++
+					st.LastRejection = err.Error()
+					st.LastRejectionAt = &now
+				})
+				log.Printf("Rejected message on %s from %s: %v", s.topic, msg.From, err)
+			}
+		}
+	}
+}
+
+// deliver runs the handler, making sure a bad message cannot take the
+// process down. A handler that panics rejects the message.
+func (s *Subscription) deliver(ctx context.Context, msg PubSubMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return s.handler(ctx, msg)
+}
+
+func getSubscriptions(c *gin.Context) {
+	subscriptionsMu.RLock()
+	statuses := make([]SubscriptionStatus, 0, len(subscriptions))
+	for _, sub := range subscriptions {
+		statuses = append(statuses, sub.Status())
+	}
+	subscriptionsMu.RUnlock()
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Topic < statuses[j].Topic })
+	c.JSON(http.StatusOK, statuses)
+}
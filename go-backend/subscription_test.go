@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionRejectsMessageOnPanic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := resetState(t)
+
+	sub := NewSubscription("topic", func(ctx context.Context, msg PubSubMessage) error {
+		if string(msg.Data) == "bad" {
+			panic("bad message")
+		}
+		return nil
+	}, time.Millisecond, time.Millisecond)
+	go sub.Run(ctx)
+	waitFor(t, func() bool { return sub.Status().State == SubscriptionConnected })
+
+	for _, data := range []string{"bad", "good"} {
+		if err := n.Publish(ctx, "topic", []byte(data)); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	waitFor(t, func() bool { return sub.Status().Received == 2 })
+
+	st := sub.Status()
+	if st.Rejected != 1 || !strings.Contains(st.LastRejection, "panicked") {
+		t.Errorf("rejected %d messages, last for %q, want the one that panicked", st.Rejected, st.LastRejection)
+	}
+}
+
+// flakyNode hands out the subscriptions the test sends it, failing to
+// subscribe when it is sent nil
+type flakyNode struct {
+	*MemoryNode
+	subscribes chan chan PubSubMessage
+}
+
+func (f *flakyNode) Subscribe(ctx context.Context, topic string) (<-chan PubSubMessage, error) {
+	select {
+	case ch := <-f.subscribes:
+		if ch == nil {
+			return nil, errors.New("daemon unavailable")
+		}
+		return ch, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestSubscriptionBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	flaky := &flakyNode{MemoryNode: resetState(t), subscribes: make(chan chan PubSubMessage)}
+	node = flaky
+
+	const minBackoff, maxBackoff = 10 * time.Millisecond, 80 * time.Millisecond
+	sub := NewSubscription("topic", func(ctx context.Context, msg PubSubMessage) error { return nil }, minBackoff, maxBackoff)
+	go sub.Run(ctx)
+
+	steps := []struct {
+		name string
+		// connect subscribes and drops the subscription after up, otherwise
+		// subscribing fails
+		connect        bool
+		up             time.Duration
+		wantError      string
+		wantBackoff    time.Duration
+		wantFailures   int
+		wantReconnects int
+	}{
+		{name: "first failure", wantError: "daemon unavailable", wantBackoff: minBackoff, wantFailures: 1},
+		{name: "backoff doubles", wantError: "daemon unavailable", wantBackoff: 2 * minBackoff, wantFailures: 2},
+		{name: "backoff doubles again", wantError: "daemon unavailable", wantBackoff: 4 * minBackoff, wantFailures: 3},
+		{name: "backoff reaches the maximum", wantError: "daemon unavailable", wantBackoff: maxBackoff, wantFailures: 4},
+		{name: "backoff stays at the maximum", wantError: "daemon unavailable", wantBackoff: maxBackoff, wantFailures: 5},
+		{name: "dropped right away keeps the backoff", connect: true,
+			wantError: "subscription stream closed", wantBackoff: maxBackoff, wantFailures: 1},
+		{name: "dropped after a while resets the backoff", connect: true, up: maxBackoff + 20*time.Millisecond,
+			wantError: "subscription stream closed", wantBackoff: minBackoff, wantFailures: 1, wantReconnects: 1},
+	}
+	for _, step := range steps {
+		if step.connect {
+			ch := make(chan PubSubMessage)
+			flaky.subscribes <- ch
+			waitFor(t, func() bool { return sub.Status().State == SubscriptionConnected })
+			if st := sub.Status(); st.Failures != 0 || st.Reconnects != step.wantReconnects || st.NextRetryAt != nil {
+				t.Errorf("%s: connected with %+v, want no failures and %d reconnects", step.name, st, step.wantReconnects)
+			}
+			time.Sleep(step.up)
+			close(ch)
+		} else {
+			flaky.subscribes <- nil
+		}
+		waitFor(t, func() bool {
+			st := sub.Status()
+			return st.State == SubscriptionRetrying && st.Failures == step.wantFailures
+		})
+
+		st := sub.Status()
+		if st.LastError != step.wantError || st.Reconnects != step.wantReconnects {
+			t.Errorf("%s: failed with %q after %d reconnects, want %q after %d", step.name, st.LastError, st.Reconnects, step.wantError, step.wantReconnects)
+		}
+		// The retry is jittered by up to a fifth of the backoff
+		if backoff := st.NextRetryAt.Sub(*st.LastErrorAt); backoff < step.wantBackoff || backoff > step.wantBackoff+step.wantBackoff/5 {
+			t.Errorf("%s: retrying in %s, want %s", step.name, backoff, step.wantBackoff)
+		}
+	}
+
+	cancel()
+	waitFor(t, func() bool { return sub.Status().State == SubscriptionStopped })
+}
+
+// waitFor polls cond for up to a second
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
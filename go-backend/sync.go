@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Announcements carry only what changed since the previous one. Every
+// announcement with changes takes the next sequence number of its sender,
+// while announcements without changes repeat the current one, so a receiver
+// that missed some notices the gap and asks the sender to catch it up.
+//
+// Catching up is paged so that no answer grows past the message size limit.
+// Changes are sent up to the sequence number that fits, and the requester
+// asks again for the rest. The whole state is sent concepts first, then
+// relationships, each in order, and every page names the item the next one
+// starts after. The requester stays at the sequence number of the first
+// page, so what changed while it was paging is picked up from the change
+// log with the next announcement.
+
+// syncRequestInterval keeps a peer that does not answer from being asked
+// again on every announcement
+const syncRequestInterval = 30 * time.Second
+
+// ChangeSet is what changed between two announcements
+type ChangeSet struct {
+	Added   []CID `json:"added,omitempty"`
+	Removed []CID `json:"removed,omitempty"`
+	// Relationships maps the relationships that changed to their new version
+	Relationships map[GUID]CID `json:"relationships,omitempty"`
+}
+
+func (c *ChangeSet) empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Relationships) == 0
+}
+
+// SyncRequest asks a peer for its changes after Since, or for its whole state
+// if Since is 0. Cursor asks for the page of the whole state after it.
+type SyncRequest struct {
+	To     PeerID `json:"to"`
+	Since  uint64 `json:"since"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// SyncResponse answers a SyncRequest with the changes from Since up to Seq
+// if the change log of the sender still holds them, and with a page of the
+// whole state as of Seq otherwise
+type SyncResponse struct {
+	To               PeerID       `json:"to"`
+	Seq              uint64       `json:"seq"`
+	Since            uint64       `json:"since"`
+	Changes          *ChangeSet   `json:"changes,omitempty"`
+	CIDs             []CID        `json:"cids,omitempty"`
+	RelationshipCIDs map[GUID]CID `json:"relationshipCids,omitempty"`
+	// Tombstones holds the deletions the sender passes on, whatever Since
+	Tombstones []Tombstone `json:"tombstones,omitempty"`
+	// More is set if there are changes after Seq that did not fit
+	More bool `json:"more,omitempty"`
+	// Cursor is the cursor of the request, Next the one of the next page of
+	// the whole state, empty on the last page
+	Cursor string `json:"cursor,omitempty"`
+	Next   string `json:"next,omitempty"`
+}
+
+// syncPageSize is how many bytes of items a sync response may carry. Half
+// the message size limit leaves room for the envelope and for the base64
+// encoding of the signed payload.
+func syncPageSize() int {
+	return config.MaxMessageSize / 2
+}
+
+type changeLogEntry struct {
+	Seq     uint64
+	Changes ChangeSet
+}
+
+// ChangeLog records what we announced
+type ChangeLog struct {
+	Seq uint64
+	// Concepts and Relationships are the state announced as of Seq
+	Concepts      []CID
+	Relationships map[GUID]CID
+	// Entries holds the most recent announcements, oldest first
+	Entries []changeLogEntry
+}
+
+var (
+	changeLog   = ChangeLog{Relationships: make(map[GUID]CID)}
+	changeLogMu sync.RWMutex
+)
+
+// recordAnnouncement compares the state about to be announced with the one
+// announced last and logs the difference under the next sequence number. It
+// returns the sequence number to announce along with the changes, which are
+// nil if nothing changed.
+func recordAnnouncement(concepts []CID, relationships map[GUID]CID) (uint64, *ChangeSet) {
+	changeLogMu.Lock()
+	defer changeLogMu.Unlock()
+
+	previous := make(map[CID]bool, len(changeLog.Concepts))
+	for _, cid := range changeLog.Concepts {
+		previous[cid] = true
+	}
+	current := make(map[CID]bool, len(concepts))
+	changes := ChangeSet{Relationships: make(map[GUID]CID)}
+	for _, cid := range concepts {
+		current[cid] = true
+		if !previous[cid] {
+			changes.Added = append(changes.Added, cid)
+		}
+	}
+	for cid := range previous {
+		if !current[cid] {
+			changes.Removed = append(changes.Removed, cid)
+		}
+	}
+	for id, cid := range relationships {
+		if changeLog.Relationships[id] != cid {
+			changes.Relationships[id] = cid
+		}
+	}
+	// The first announcement takes a sequence number even if there is
+	// nothing in it, as 0 marks peers that predate sequence numbers
+	if changes.empty() && changeLog.Seq > 0 {
+		return changeLog.Seq, nil
+	}
+	slices.Sort(changes.Added)
+	slices.Sort(changes.Removed)
+
+	changeLog.Seq++
+	changeLog.Concepts = sortedKeys(current)
+	changeLog.Relationships = make(map[GUID]CID, len(relationships))
+	for id, cid := range relationships {
+		changeLog.Relationships[id] = cid
+	}
+	changeLog.Entries = append(changeLog.Entries, changeLogEntry{Seq: changeLog.Seq, Changes: changes})
+	if excess := len(changeLog.Entries) - config.ChangeLogSize; excess > 0 {
+		changeLog.Entries = slices.Delete(changeLog.Entries, 0, excess)
+	}
+	persister.MarkDirty(changeLogPath)
+	return changeLog.Seq, &changes
+}
+
+// changesSince folds the logged changes after since into one change set,
+// stopping before the entry that would take it past size bytes. It returns
+// the sequence number the changes reach, and reports false if the log no
+// longer reaches back to since or its next entry alone is larger than size.
+// changeLogMu must be held.
+func changesSince(since uint64, size int) (*ChangeSet, uint64, bool) {
+	if since > changeLog.Seq {
+		return nil, 0, false
+	}
+	if since < changeLog.Seq && (len(changeLog.Entries) == 0 || changeLog.Entries[0].Seq > since+1) {
+		return nil, 0, false
+	}
+
+	added := make(map[CID]bool)
+	removed := make(map[CID]bool)
+	changes := &ChangeSet{Relationships: make(map[GUID]CID)}
+	seq, used := since, 0
+	for _, entry := range changeLog.Entries {
+		if entry.Seq <= since {
+			continue
+		}
+		if used += entry.Changes.size(); used > size {
+			if seq == since {
+				return nil, 0, false
+			}
+			break
+		}
+		seq = entry.Seq
+		for _, cid := range entry.Changes.Added {
+			if removed[cid] {
+				delete(removed, cid)
+			} else {
+				added[cid] = true
+			}
+		}
+		for _, cid := range entry.Changes.Removed {
+			if added[cid] {
+				delete(added, cid)
+			} else {
+				removed[cid] = true
+			}
+		}
+		for id, cid := range entry.Changes.Relationships {
+			changes.Relationships[id] = cid
+		}
+	}
+	changes.Added = sortedKeys(added)
+	changes.Removed = sortedKeys(removed)
+	return changes, seq, true
+}
+
+// size estimates the bytes a change set takes in a message
+func (c *ChangeSet) size() int {
+	n := 0
+	for _, cid := range append(slices.Clone(c.Added), c.Removed...) {
+		n += len(cid) + 3
+	}
+	for id, cid := range c.Relationships {
+		n += len(id) + len(cid) + 6
+	}
+	return n
+}
+
+// statePage fills resp with the page of our whole state after cursor that
+// fits size bytes, and sets Next if there is more. changeLogMu must be held.
+func statePage(resp *SyncResponse, cursor string, size int) {
+	set, after, _ := strings.Cut(cursor, "/")
+	used, items := 0, 0
+	fits := func(n int) bool {
+		used += n
+		items++
+		return used <= size || items == 1
+	}
+	if set != "relationships" {
+		for _, cid := range changeLog.Concepts {
+			if set == "concepts" && string(cid) <= after {
+				continue
+			}
+			if !fits(len(cid) + 3) {
+				resp.Next = "concepts/" + string(resp.CIDs[len(resp.CIDs)-1])
+				return
+			}
+			resp.CIDs = append(resp.CIDs, cid)
+		}
+		after = ""
+	}
+	resp.RelationshipCIDs = make(map[GUID]CID)
+	var last GUID
+	for _, id := range sortedKeys(changeLog.Relationships) {
+		if string(id) <= after {
+			continue
+		}
+		cid := changeLog.Relationships[id]
+		if !fits(len(id) + len(cid) + 6) {
+			if last == "" {
+				resp.Next = "concepts/" + string(resp.CIDs[len(resp.CIDs)-1])
+			} else {
+				resp.Next = "relationships/" + string(last)
+			}
+			return
+		}
+		resp.RelationshipCIDs[id] = cid
+		last = id
+	}
+}
+
+// peerSyncState is what we know of the announcements of a peer
+type peerSyncState struct {
+	// synced is set once the state below is complete
+	synced   bool
+	seq      uint64
+	concepts map[CID]bool
+	// requested is when we last asked the peer to catch us up, zero once it
+	// did. Responses we did not ask for are dropped.
+	requested time.Time
+	// cursor is the page of the whole state we asked for and pageSeq the
+	// sequence number of its first page
+	cursor  string
+	pageSeq uint64
+}
+
+var (
+	peerSyncStates = make(map[PeerID]*peerSyncState)
+	peerSyncMu     sync.Mutex
+)
+
+// syncState returns the state of a peer, creating it if needed. peerSyncMu
+// must be held.
+func syncState(id PeerID) *peerSyncState {
+	st, ok := peerSyncStates[id]
+	if !ok {
+		st = &peerSyncState{concepts: make(map[CID]bool)}
+		peerSyncStates[id] = st
+	}
+	return st
+}
+
+func (st *peerSyncState) apply(changes *ChangeSet) {
+	for _, cid := range changes.Added {
+		st.concepts[cid] = true
+	}
+	for _, cid := range changes.Removed {
+		delete(st.concepts, cid)
+	}
+}
+
+// handleAnnouncement applies the changes a peer announced if they follow the
+// ones we have, and asks the peer to catch us up otherwise
+func handleAnnouncement(ctx context.Context, from PeerID, message Announcement) {
+	peerSyncMu.Lock()
+	st := syncState(from)
+	var cids []CID
+	applied, behind := false, false
+	var since uint64
+	switch {
+	case st.synced && message.Seq == st.seq:
+		// Nothing changed since the last announcement
+	case st.synced && message.Seq == st.seq+1 && message.Changes != nil:
+		st.apply(message.Changes)
+		st.seq = message.Seq
+		cids = sortedKeys(st.concepts)
+		applied = true
+	default:
+		// A peer whose sequence number went back lost its log, so we ask
+		// it for everything
+		if st.synced && message.Seq > st.seq {
+			since = st.seq
+		}
+		behind = time.Since(st.requested) > syncRequestInterval
+		if behind {
+			// A paged catch up that stalled starts over
+			st.requested = time.Now()
+			st.cursor = ""
+		}
+	}
+	peerSyncMu.Unlock()
+
+	if applied {
+		updatePeerCIDs(from, cids)
+	}
+	// Relationships merge in any order, so they are taken in even when
+	// the concepts have to wait for the catch up
+	if message.Changes != nil {
+		replicator.AnnounceRelationships(from, message.Changes.Relationships)
+	}
+	if behind {
+		log.Printf("Peer %s is at %d, requesting its changes since %d", from, message.Seq, since)
+		requestSync(ctx, SyncRequest{To: from, Since: since})
+	}
+}
+
+func requestSync(ctx context.Context, req SyncRequest) {
+	if err := publishMessage(ctx, MessageSyncRequest, req); err != nil {
+		log.Printf("Failed to request changes of peer %s: %v", req.To, err)
+	}
+}
+
+// answerSyncRequest sends a peer the changes it asked for
+func answerSyncRequest(ctx context.Context, from PeerID, req SyncRequest) {
+	if req.To != peerID {
+		return
+	}
+	resp := SyncResponse{To: from, Since: req.Since, Cursor: req.Cursor}
+	size := syncPageSize()
+	if req.Cursor == "" {
+		resp.Tombstones = sharedTombstones()
+		if data, err := json.Marshal(resp.Tombstones); err == nil {
+			size -= len(data)
+		}
+	}
+
+	changeLogMu.RLock()
+	resp.Seq = changeLog.Seq
+	var changes *ChangeSet
+	var seq uint64
+	ok := false
+	if req.Since > 0 && req.Cursor == "" {
+		changes, seq, ok = changesSince(req.Since, size)
+	}
+	if ok {
+		resp.Changes, resp.Seq = changes, seq
+		resp.More = seq < changeLog.Seq
+	} else {
+		resp.Since = 0
+		statePage(&resp, req.Cursor, size)
+	}
+	changeLogMu.RUnlock()
+
+	if err := publishMessage(ctx, MessageSyncResponse, resp); err != nil {
+		log.Printf("Failed to answer sync request of peer %s: %v", from, err)
+		return
+	}
+	log.Printf("Sent changes %d..%d to peer %s", resp.Since, resp.Seq, from)
+}
+
+// handleSyncResponse applies the changes a peer sent in answer to our request
+func handleSyncResponse(ctx context.Context, from PeerID, resp SyncResponse) {
+	if resp.To != peerID {
+		return
+	}
+	peerSyncMu.Lock()
+	st := syncState(from)
+	if st.requested.IsZero() || resp.Cursor != st.cursor {
+		peerSyncMu.Unlock()
+		log.Printf("Ignoring changes of peer %s we did not ask for", from)
+		return
+	}
+	relationships := resp.RelationshipCIDs
+	var next *SyncRequest
+	if resp.Changes != nil {
+		if !st.synced || st.seq != resp.Since {
+			peerSyncMu.Unlock()
+			log.Printf("Ignoring changes of peer %s since %d, we are at %d", from, resp.Since, st.seq)
+			return
+		}
+		st.apply(resp.Changes)
+		st.seq = resp.Seq
+		relationships = resp.Changes.Relationships
+		if resp.More {
+			next = &SyncRequest{To: from, Since: resp.Seq}
+		}
+	} else {
+		if resp.Cursor == "" {
+			st.synced = false
+			st.pageSeq = resp.Seq
+			st.concepts = make(map[CID]bool, len(resp.CIDs))
+		}
+		for _, cid := range resp.CIDs {
+			st.concepts[cid] = true
+		}
+		if resp.Next != "" {
+			next = &SyncRequest{To: from, Cursor: resp.Next}
+		} else {
+			st.synced = true
+			st.seq = st.pageSeq
+		}
+	}
+	st.cursor = ""
+	st.requested = time.Time{}
+	if next != nil {
+		st.cursor = next.Cursor
+		st.requested = time.Now()
+	}
+	synced := st.synced
+	cids := sortedKeys(st.concepts)
+	peerSyncMu.Unlock()
+
+	for _, t := range resp.Tombstones {
+		applyTombstone(ctx, from, t)
+	}
+	// The concepts of a peer are only handed on once we have all of them,
+	// as the replicator forgets the ones a peer no longer announces
+	if synced {
+		updatePeerCIDs(from, cids)
+	}
+	replicator.AnnounceRelationships(from, relationships)
+	if next != nil {
+		requestSync(ctx, *next)
+		return
+	}
+	log.Printf("Caught up with peer %s at %d", from, resp.Seq)
+}
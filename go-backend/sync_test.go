@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+// resetSync resets the state and subscribes to the topic to see what the
+// node publishes
+func resetSync(t *testing.T) <-chan PubSubMessage {
+	t.Helper()
+	n := resetState(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ch, err := n.Subscribe(ctx, config.PubsubTopic)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	return ch
+}
+
+// published decodes the next message the node published, if any
+func published(t *testing.T, ch <-chan PubSubMessage, body interface{}) (MessageType, bool) {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		env := decodeEnvelope(t, msg)
+		if err := json.Unmarshal(env.Body, body); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		return env.Type, true
+	case <-time.After(100 * time.Millisecond):
+		return "", false
+	}
+}
+
+// decodeEnvelope unwraps a signed message the node published
+func decodeEnvelope(t *testing.T, msg PubSubMessage) Envelope {
+	t.Helper()
+	var signed SignedMessage
+	var env Envelope
+	if err := json.Unmarshal(msg.Data, &signed); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if err := json.Unmarshal(signed.Payload, &env); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	return env
+}
+
+// sameChanges compares change sets, taking empty lists as missing ones
+func sameChanges(a, b *ChangeSet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return slices.Equal(a.Added, b.Added) && slices.Equal(a.Removed, b.Removed) && maps.Equal(a.Relationships, b.Relationships)
+}
+
+func TestRecordAnnouncement(t *testing.T) {
+	resetSync(t)
+	steps := []struct {
+		name          string
+		concepts      []CID
+		relationships map[GUID]CID
+		wantSeq       uint64
+		// want is nil when nothing changed
+		want *ChangeSet
+	}{
+		{name: "first announcement is numbered even if empty", wantSeq: 1, want: &ChangeSet{Relationships: map[GUID]CID{}}},
+		{name: "nothing changed", wantSeq: 1},
+		{name: "concepts added", concepts: []CID{"b", "a"}, wantSeq: 2, want: &ChangeSet{Added: []CID{"a", "b"}, Relationships: map[GUID]CID{}}},
+		{name: "concept removed and relationship changed", concepts: []CID{"b"}, relationships: map[GUID]CID{"r": "r1"}, wantSeq: 3,
+			want: &ChangeSet{Removed: []CID{"a"}, Relationships: map[GUID]CID{"r": "r1"}}},
+		{name: "same state again", concepts: []CID{"b"}, relationships: map[GUID]CID{"r": "r1"}, wantSeq: 3},
+	}
+	for _, step := range steps {
+		seq, changes := recordAnnouncement(step.concepts, step.relationships)
+		if seq != step.wantSeq {
+			t.Errorf("%s: got seq %d, want %d", step.name, seq, step.wantSeq)
+		}
+		if !sameChanges(changes, step.want) {
+			t.Errorf("%s: got changes %+v, want %+v", step.name, changes, step.want)
+		}
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	resetSync(t)
+	config.ChangeLogSize = 3
+	// Announces seq 1 to 5, of which the log keeps 3 to 5
+	for _, concepts := range [][]CID{{"a"}, {"a", "b"}, {"b"}, {"b", "c"}, {"c"}} {
+		recordAnnouncement(concepts, nil)
+	}
+
+	// Every change of a one letter CID takes 4 bytes
+	tests := []struct {
+		name    string
+		since   uint64
+		size    int
+		want    *ChangeSet
+		wantSeq uint64
+		wantOK  bool
+	}{
+		{name: "up to date", since: 5, size: 100, want: &ChangeSet{Relationships: map[GUID]CID{}}, wantSeq: 5, wantOK: true},
+		{name: "one behind", since: 4, size: 100, want: &ChangeSet{Removed: []CID{"b"}, Relationships: map[GUID]CID{}}, wantSeq: 5, wantOK: true},
+		{name: "changes are folded", since: 2, size: 100, want: &ChangeSet{Added: []CID{"c"}, Removed: []CID{"a", "b"}, Relationships: map[GUID]CID{}}, wantSeq: 5, wantOK: true},
+		{name: "changes stop at the size", since: 2, size: 8, want: &ChangeSet{Added: []CID{"c"}, Removed: []CID{"a"}, Relationships: map[GUID]CID{}}, wantSeq: 4, wantOK: true},
+		{name: "next change larger than the size", since: 2, size: 3},
+		{name: "log no longer reaches back", since: 1, size: 100},
+		{name: "ahead of us", since: 6, size: 100},
+	}
+	changeLogMu.RLock()
+	defer changeLogMu.RUnlock()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, seq, ok := changesSince(tt.since, tt.size)
+			if ok != tt.wantOK {
+				t.Fatalf("got ok %v, want %v", ok, tt.wantOK)
+			}
+			if !sameChanges(changes, tt.want) || seq != tt.wantSeq {
+				t.Errorf("got %+v at %d, want %+v at %d", changes, seq, tt.want, tt.wantSeq)
+			}
+		})
+	}
+}
+
+func TestHandleAnnouncementDetectsGaps(t *testing.T) {
+	const peer = PeerID("peer")
+	tests := []struct {
+		name string
+		// state is what we know of the peer before the announcement, nil
+		// if nothing
+		state        *peerSyncState
+		announcement Announcement
+		wantSeq      uint64
+		wantConcepts []CID
+		// wantRequest is the Since of the sync request expected, -1 if none
+		wantRequest int
+	}{
+		{name: "nothing changed", state: &peerSyncState{synced: true, seq: 3, concepts: map[CID]bool{"a": true}},
+			announcement: Announcement{Seq: 3}, wantSeq: 3, wantConcepts: []CID{"a"}, wantRequest: -1},
+		{name: "next announcement is applied", state: &peerSyncState{synced: true, seq: 3, concepts: map[CID]bool{"a": true}},
+			announcement: Announcement{Seq: 4, Changes: &ChangeSet{Added: []CID{"b"}, Removed: []CID{"a"}}}, wantSeq: 4, wantConcepts: []CID{"b"}, wantRequest: -1},
+		{name: "gap asks for the missed changes", state: &peerSyncState{synced: true, seq: 3, concepts: map[CID]bool{"a": true}},
+			announcement: Announcement{Seq: 6, Changes: &ChangeSet{Added: []CID{"b"}}}, wantSeq: 3, wantConcepts: []CID{"a"}, wantRequest: 3},
+		{name: "sequence going back asks for everything", state: &peerSyncState{synced: true, seq: 3, concepts: map[CID]bool{"a": true}},
+			announcement: Announcement{Seq: 1, Changes: &ChangeSet{Added: []CID{"b"}}}, wantSeq: 3, wantConcepts: []CID{"a"}, wantRequest: 0},
+		{name: "unknown peer asks for everything", announcement: Announcement{Seq: 2, Changes: &ChangeSet{Added: []CID{"b"}}}, wantRequest: 0},
+		{name: "peer asked recently is not asked again", state: &peerSyncState{synced: true, seq: 3, concepts: map[CID]bool{}, requested: time.Now()},
+			announcement: Announcement{Seq: 6}, wantSeq: 3, wantRequest: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := resetSync(t)
+			if tt.state != nil {
+				peerSyncStates[peer] = tt.state
+			}
+
+			handleAnnouncement(context.Background(), peer, tt.announcement)
+
+			st := peerSyncStates[peer]
+			if st.seq != tt.wantSeq {
+				t.Errorf("got seq %d, want %d", st.seq, tt.wantSeq)
+			}
+			if got := sortedKeys(st.concepts); !slices.Equal(got, tt.wantConcepts) {
+				t.Errorf("got concepts %v, want %v", got, tt.wantConcepts)
+			}
+			var req SyncRequest
+			typ, ok := published(t, ch, &req)
+			switch {
+			case tt.wantRequest < 0 && ok:
+				t.Errorf("published %s %+v, want nothing", typ, req)
+			case tt.wantRequest >= 0 && !ok:
+				t.Fatal("no sync request published")
+			case tt.wantRequest >= 0 && (typ != MessageSyncRequest || req.To != peer || req.Since != uint64(tt.wantRequest)):
+				t.Errorf("published %s %+v, want a sync request to %s since %d", typ, req, peer, tt.wantRequest)
+			}
+		})
+	}
+}
+
+func TestCatchUpAfterGap(t *testing.T) {
+	ctx := context.Background()
+	const peer = PeerID("peer")
+
+	tests := []struct {
+		name         string
+		response     SyncResponse
+		wantSeq      uint64
+		wantConcepts []CID
+	}{
+		{name: "missed changes are applied",
+			response: SyncResponse{Seq: 6, Since: 3, Changes: &ChangeSet{Added: []CID{"b", "c"}, Removed: []CID{"a"}}},
+			wantSeq:  6, wantConcepts: []CID{"b", "c"}},
+		{name: "whole state replaces ours",
+			response: SyncResponse{Seq: 6, CIDs: []CID{"c"}},
+			wantSeq:  6, wantConcepts: []CID{"c"}},
+		{name: "changes from elsewhere are ignored",
+			response: SyncResponse{Seq: 6, Since: 2, Changes: &ChangeSet{Added: []CID{"b"}}},
+			wantSeq:  3, wantConcepts: []CID{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := resetSync(t)
+			peerSyncStates[peer] = &peerSyncState{synced: true, seq: 3, concepts: map[CID]bool{"a": true}}
+
+			handleAnnouncement(ctx, peer, Announcement{Seq: 6})
+			var req SyncRequest
+			if _, ok := published(t, ch, &req); !ok || req.Since != 3 {
+				t.Fatalf("got sync request %+v, want one since 3", req)
+			}
+
+			tt.response.To = peerID
+			handleSyncResponse(ctx, peer, tt.response)
+
+			st := peerSyncStates[peer]
+			if st.seq != tt.wantSeq || !slices.Equal(sortedKeys(st.concepts), tt.wantConcepts) {
+				t.Errorf("got %v at %d, want %v at %d", sortedKeys(st.concepts), st.seq, tt.wantConcepts, tt.wantSeq)
+			}
+		})
+	}
+}
+
+func TestAnswerSyncRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		since     uint64
+		wantSince uint64
+		want      *ChangeSet
+		wantCIDs  []CID
+	}{
+		{name: "changes still logged", since: 2, wantSince: 2, want: &ChangeSet{Added: []CID{"c"}, Removed: []CID{"b"}, Relationships: map[GUID]CID{}}},
+		{name: "log no longer reaches back", since: 1, wantCIDs: []CID{"a", "c"}},
+		{name: "whole state asked for", since: 0, wantCIDs: []CID{"a", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := resetSync(t)
+			config.ChangeLogSize = 2
+			for _, concepts := range [][]CID{{"a"}, {"a", "b"}, {"a", "b"}, {"a"}, {"a", "c"}} {
+				recordAnnouncement(concepts, nil)
+			}
+
+			answerSyncRequest(context.Background(), "peer", SyncRequest{To: peerID, Since: tt.since})
+
+			var resp SyncResponse
+			typ, ok := published(t, ch, &resp)
+			if !ok || typ != MessageSyncResponse {
+				t.Fatalf("got %s, want a sync response", typ)
+			}
+			if resp.To != "peer" || resp.Seq != 4 || resp.Since != tt.wantSince {
+				t.Errorf("got response to %s for %d..%d, want to peer for %d..4", resp.To, resp.Since, resp.Seq, tt.wantSince)
+			}
+			if !sameChanges(resp.Changes, tt.want) || !slices.Equal(resp.CIDs, tt.wantCIDs) {
+				t.Errorf("got changes %+v and CIDs %v, want %+v and %v", resp.Changes, resp.CIDs, tt.want, tt.wantCIDs)
+			}
+		})
+	}
+}
+
+func TestUnrequestedSyncResponseIsDropped(t *testing.T) {
+	resetSync(t)
+	const peer = PeerID("peer")
+	peerSyncStates[peer] = &peerSyncState{synced: true, seq: 3, concepts: map[CID]bool{"a": true}}
+
+	handleSyncResponse(context.Background(), peer, SyncResponse{To: peerID, Seq: 9, CIDs: []CID{"x"}})
+
+	st := peerSyncStates[peer]
+	if st.seq != 3 || !slices.Equal(sortedKeys(st.concepts), []CID{"a"}) {
+		t.Errorf("got %v at %d, want the state left as it was", sortedKeys(st.concepts), st.seq)
+	}
+}
+
+func TestPagedCatchUp(t *testing.T) {
+	ctx := context.Background()
+	const peer = PeerID("peer")
+
+	var concepts []CID
+	relationships := make(map[GUID]CID)
+	for i := 0; i < 40; i++ {
+		concepts = append(concepts, CID(fmt.Sprintf("concept-%02d", i)))
+		relationships[GUID(fmt.Sprintf("relationship-%02d", i))] = CID(fmt.Sprintf("version-%02d", i))
+	}
+
+	tests := []struct {
+		name string
+		// state is what we know of the peer before catching up
+		state   *peerSyncState
+		request SyncRequest
+	}{
+		{name: "whole state", state: &peerSyncState{concepts: map[CID]bool{}}, request: SyncRequest{To: peerID}},
+		{name: "changes", state: &peerSyncState{synced: true, seq: 1, concepts: map[CID]bool{}}, request: SyncRequest{To: peerID, Since: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := resetSync(t)
+			config.MaxMessageSize = 2048
+			recordAnnouncement(nil, nil)
+			announced := make(map[GUID]CID)
+			for i := range concepts {
+				id := GUID(fmt.Sprintf("relationship-%02d", i))
+				announced[id] = relationships[id]
+				recordAnnouncement(concepts[:i+1], maps.Clone(announced))
+			}
+			tt.state.requested = time.Now()
+			peerSyncStates[peer] = tt.state
+
+			// We play both sides, answering each request we publish
+			req, pages := tt.request, 0
+			for {
+				answerSyncRequest(ctx, peer, SyncRequest{To: peerID, Since: req.Since, Cursor: req.Cursor})
+				msg := <-ch
+				if len(msg.Data) > config.MaxMessageSize {
+					t.Fatalf("page %d takes %d bytes, more than %d", pages, len(msg.Data), config.MaxMessageSize)
+				}
+				var resp SyncResponse
+				if err := json.Unmarshal(decodeEnvelope(t, msg).Body, &resp); err != nil {
+					t.Fatalf("Unmarshal: %v", err)
+				}
+				pages++
+				resp.To = peerID
+				handleSyncResponse(ctx, peer, resp)
+				if _, ok := published(t, ch, &req); !ok {
+					break
+				}
+			}
+
+			st := peerSyncStates[peer]
+			if pages < 2 {
+				t.Errorf("caught up in %d page, want several", pages)
+			}
+			if !st.synced || st.seq != changeLog.Seq || !slices.Equal(sortedKeys(st.concepts), concepts) {
+				t.Errorf("got %d concepts at %d, synced %v, want %d at %d", len(st.concepts), st.seq, st.synced, len(concepts), changeLog.Seq)
+			}
+			for id := range relationships {
+				if !replicator.pending[replicationJob{peer: peer, cid: relationships[id], relationship: id}] {
+					t.Errorf("relationship %s was not queued", id)
+				}
+			}
+		})
+	}
+}
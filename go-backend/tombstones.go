@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deleting a concept or relationship leaves a tombstone. Tombstones are
+// broadcast and handed out when catching peers up, so peers drop their
+// copies instead of bringing them back. They are forgotten once the
+// retention window has passed, so a peer that stays away longer than that
+// can bring a deleted relationship back.
+
+const tombstoneGCInterval = time.Hour
+
+type TombstoneKind string
+
+const (
+	TombstoneConcept      TombstoneKind = "concept"
+	TombstoneRelationship TombstoneKind = "relationship"
+)
+
+type Tombstone struct {
+	Kind TombstoneKind `json:"kind"`
+	ID   GUID          `json:"id"`
+	// CID is the last version of what was deleted
+	CID CID `json:"cid"`
+	// PeerID is the peer that deleted it. A concept can only be deleted by
+	// the peer it belongs to, a relationship by a peer of the owner of its
+	// source or target.
+	PeerID    PeerID    `json:"peerId"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// TombstoneMessage is the body of a tombstone message
+type TombstoneMessage struct {
+	Tombstones []Tombstone `json:"tombstones"`
+}
+
+// key identifies what a tombstone deletes. Concepts are only deleted for the
+// peer they belong to, as peers create concepts with the same GUID.
+func (t Tombstone) key() string {
+	if t.Kind == TombstoneConcept {
+		return path.Join(string(t.Kind), string(t.PeerID), string(t.ID))
+	}
+	return path.Join(string(t.Kind), string(t.ID))
+}
+
+var (
+	tombstones   = make(map[string]Tombstone)
+	tombstonesMu sync.RWMutex
+)
+
+func newTombstone(kind TombstoneKind, id GUID, cid CID) Tombstone {
+	return Tombstone{Kind: kind, ID: id, CID: cid, PeerID: peerID, DeletedAt: time.Now().UTC()}
+}
+
+// addTombstone records a tombstone unless it expired or a later one for the
+// same item is known. It reports whether the tombstone was recorded.
+func addTombstone(t Tombstone) bool {
+	if time.Since(t.DeletedAt) > config.TombstoneRetention {
+		return false
+	}
+	tombstonesMu.Lock()
+	existing, ok := tombstones[t.key()]
+	if ok && !t.DeletedAt.After(existing.DeletedAt) {
+		tombstonesMu.Unlock()
+		return false
+	}
+	tombstones[t.key()] = t
+	tombstonesMu.Unlock()
+	persister.MarkDirty(tombstonesPath)
+	return true
+}
+
+// conceptDeleted reports whether a peer deleted the concept with guid, or
+// the version of one of its concepts with cid
+func conceptDeleted(peer PeerID, guid GUID, cid CID) bool {
+	tombstonesMu.RLock()
+	defer tombstonesMu.RUnlock()
+	if guid != "" {
+		_, ok := tombstones[Tombstone{Kind: TombstoneConcept, PeerID: peer, ID: guid}.key()]
+		return ok
+	}
+	for _, t := range tombstones {
+		if t.Kind == TombstoneConcept && t.PeerID == peer && t.CID == cid {
+			return true
+		}
+	}
+	return false
+}
+
+func relationshipDeleted(id GUID) bool {
+	tombstonesMu.RLock()
+	defer tombstonesMu.RUnlock()
+	_, ok := tombstones[Tombstone{Kind: TombstoneRelationship, ID: id}.key()]
+	return ok
+}
+
+// sharedTombstones returns the tombstones we pass on to peers. Peers only
+// take a tombstone from the peer that deleted, so these are our own.
+func sharedTombstones() []Tombstone {
+	tombstonesMu.RLock()
+	defer tombstonesMu.RUnlock()
+	var shared []Tombstone
+	for _, t := range tombstones {
+		if t.PeerID == peerID {
+			shared = append(shared, t)
+		}
+	}
+	return shared
+}
+
+func publishTombstones(ctx context.Context, ts ...Tombstone) {
+	if err := publishMessage(ctx, MessageTombstone, TombstoneMessage{Tombstones: ts}); err != nil {
+		log.Printf("Failed to publish %d tombstones: %v", len(ts), err)
+	}
+}
+
+func handleTombstones(ctx context.Context, from PeerID, msg TombstoneMessage) {
+	for _, t := range msg.Tombstones {
+		applyTombstone(ctx, from, t)
+	}
+}
+
+// applyTombstone drops what a tombstone received from a peer deletes
+func applyTombstone(ctx context.Context, from PeerID, t Tombstone) {
+	if t.PeerID != from {
+		log.Printf("Ignoring tombstone of %s %s of peer %s sent by %s", t.Kind, t.ID, t.PeerID, from)
+		return
+	}
+	// A deletion dated ahead would outlive the retention window and win
+	// over any later one
+	if now := time.Now().UTC(); t.DeletedAt.After(now) {
+		t.DeletedAt = now
+	}
+	switch t.Kind {
+	case TombstoneConcept:
+		if !addTombstone(t) {
+			return
+		}
+		forgetRemoteConcept(t.PeerID, t.ID)
+		log.Printf("Peer %s deleted concept %s", t.PeerID, t.ID)
+	case TombstoneRelationship:
+		if !mayDeleteRelationship(peerOwner(from), t.ID) {
+			log.Printf("Ignoring tombstone of relationship %s from peer %s, whose owner owns neither end", t.ID, from)
+			return
+		}
+		if trustOf(from) == TrustUntrusted {
+			if !relationshipDeleted(t.ID) {
+				quarantineItem(QuarantinedItem{Kind: QuarantineTombstone, Peer: from, ItemID: t.ID, CID: t.CID, Tombstone: &t})
+			}
+			return
+		}
+		acceptRelationshipTombstone(ctx, t)
+	default:
+		log.Printf("Ignoring tombstone of unknown kind %q from peer %s", t.Kind, from)
+	}
+}
+
+// mayDeleteRelationship reports whether an owner owns the source or the
+// target of a relationship we hold
+func mayDeleteRelationship(owner, id GUID) bool {
+	relationshipMu.RLock()
+	r, ok := relationshipMap[id]
+	relationshipMu.RUnlock()
+	if !ok || owner == "" {
+		return false
+	}
+	return ownsConcept(owner, r.SourceID) || ownsConcept(owner, r.TargetID)
+}
+
+// ownsConcept reports whether guid is a concept of owner, either one of
+// ours or one replicated from a node of owner
+func ownsConcept(owner, guid GUID) bool {
+	ownerMu.RLock()
+	ours := owner == ownerGUID
+	ownerMu.RUnlock()
+	if ours {
+		conceptMu.RLock()
+		_, ok := conceptMap[guid]
+		conceptMu.RUnlock()
+		if ok {
+			return true
+		}
+	}
+
+	remoteConceptsMu.RLock()
+	var holders []PeerID
+	for peer, concepts := range remoteConcepts {
+		if _, ok := concepts[guid]; ok {
+			holders = append(holders, peer)
+		}
+	}
+	remoteConceptsMu.RUnlock()
+	for _, peer := range holders {
+		if peerOwner(peer) == owner {
+			return true
+		}
+	}
+	return false
+}
+
+func peerOwner(id PeerID) GUID {
+	peerMapMu.RLock()
+	defer peerMapMu.RUnlock()
+	if p, ok := peerMap[id]; ok {
+		return p.GetOwnerGUID()
+	}
+	return ""
+}
+
+func acceptRelationshipTombstone(ctx context.Context, t Tombstone) {
+	if !addTombstone(t) {
+		return
+	}
+	forgetRelationship(ctx, t.ID)
+	log.Printf("Peer %s deleted relationship %s", t.PeerID, t.ID)
+}
+
+func forgetRemoteConcept(peer PeerID, guid GUID) {
+	remoteConceptsMu.Lock()
+	_, ok := remoteConcepts[peer][guid]
+	delete(remoteConcepts[peer], guid)
+	remoteConceptsMu.Unlock()
+	if ok {
+		persister.MarkDirty(remoteConceptsPath)
+	}
+}
+
+// forgetRelationship removes a relationship along with the links our
+// concepts hold to it
+func forgetRelationship(ctx context.Context, id GUID) {
+	relationshipMu.Lock()
+	r, ok := relationshipMap[id]
+	cid, indexed := relationship2CID[id]
+	delete(relationshipMap, id)
+	delete(relationship2CID, id)
+	relationshipMu.Unlock()
+	if indexed {
+		persister.MarkDirty(relationshipIndexPath)
+		releasePin(ctx, cid)
+	}
+	if !ok {
+		return
+	}
+	for _, guid := range []GUID{r.SourceID, r.TargetID} {
+		if err := unlinkRelationship(ctx, guid, id); err != nil {
+			log.Printf("Failed to unlink relationship %s from %s: %v", id, guid, err)
+		}
+	}
+}
+
+// expireTombstones forgets the tombstones older than the retention window
+func expireTombstones(ctx context.Context) {
+	expired := 0
+	tombstonesMu.Lock()
+	for key, t := range tombstones {
+		if time.Since(t.DeletedAt) > config.TombstoneRetention {
+			delete(tombstones, key)
+			expired++
+		}
+	}
+	tombstonesMu.Unlock()
+	if expired > 0 {
+		persister.MarkDirty(tombstonesPath)
+		log.Printf("Expired %d tombstones", expired)
+	}
+}
+
+func getTombstones(c *gin.Context) {
+	tombstonesMu.RLock()
+	list := make([]Tombstone, 0, len(tombstones))
+	for _, t := range tombstones {
+		list = append(list, t)
+	}
+	tombstonesMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].DeletedAt.After(list[j].DeletedAt) })
+	c.JSON(http.StatusOK, list)
+}
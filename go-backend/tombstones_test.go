@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestApplyTombstone(t *testing.T) {
+	const (
+		owner    = PeerID("owner-peer")
+		stranger = PeerID("stranger-peer")
+	)
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name      string
+		from      PeerID
+		tombstone Tombstone
+		// wantDeleted is whether the relationship is gone afterwards
+		wantDeleted bool
+		// wantRecorded is whether the tombstone is kept, and wantAt when
+		wantRecorded bool
+		wantAt       time.Time
+	}{
+		{name: "owner of the target deletes", from: owner,
+			tombstone:   Tombstone{Kind: TombstoneRelationship, ID: "r", PeerID: owner, DeletedAt: now},
+			wantDeleted: true, wantRecorded: true, wantAt: now},
+		{name: "deletion dated ahead is clamped", from: owner,
+			tombstone:   Tombstone{Kind: TombstoneRelationship, ID: "r", PeerID: owner, DeletedAt: now.Add(24 * time.Hour)},
+			wantDeleted: true, wantRecorded: true},
+		{name: "owner of neither end", from: stranger,
+			tombstone: Tombstone{Kind: TombstoneRelationship, ID: "r", PeerID: stranger, DeletedAt: now}},
+		{name: "relayed in the name of another peer", from: stranger,
+			tombstone: Tombstone{Kind: TombstoneRelationship, ID: "r", PeerID: owner, DeletedAt: now}},
+		{name: "concept of another peer", from: stranger,
+			tombstone: Tombstone{Kind: TombstoneConcept, ID: "t", PeerID: owner, DeletedAt: now}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState(t)
+			peerMap[owner] = &Peer{ID: owner, OwnerGUID: "owner"}
+			peerMap[stranger] = &Peer{ID: stranger, OwnerGUID: "stranger"}
+			remoteConcepts[owner] = map[GUID]*Concept{"t": {GUID: "t", Name: "target"}}
+			relationshipMap["r"] = &Relationship{ID: "r", SourceID: "s", TargetID: "t"}
+
+			applyTombstone(context.Background(), tt.from, tt.tombstone)
+
+			if _, ok := relationshipMap["r"]; ok == tt.wantDeleted {
+				t.Errorf("relationship kept: %v, want %v", ok, !tt.wantDeleted)
+			}
+			recorded, ok := tombstones[tt.tombstone.key()]
+			if ok != tt.wantRecorded {
+				t.Fatalf("tombstone recorded: %v, want %v", ok, tt.wantRecorded)
+			}
+			if !ok {
+				return
+			}
+			if !tt.wantAt.IsZero() && !recorded.DeletedAt.Equal(tt.wantAt) {
+				t.Errorf("deleted at %v, want %v", recorded.DeletedAt, tt.wantAt)
+			}
+			if recorded.DeletedAt.After(time.Now()) {
+				t.Errorf("deleted at %v, want it clamped to the time received", recorded.DeletedAt)
+			}
+		})
+	}
+}
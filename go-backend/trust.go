@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Every peer has a trust level, set by the owner or DefaultTrust otherwise:
+//
+//   - blocked peers have their messages rejected and their data dropped
+//   - what untrusted peers send is quarantined until approved
+//   - data from known and trusted peers is taken in as it arrives
+//
+// Levels are kept apart from the peer list, so a blocked peer stays blocked
+// after it is evicted.
+
+type TrustLevel string
+
+const (
+	TrustBlocked   TrustLevel = "blocked"
+	TrustUntrusted TrustLevel = "untrusted"
+	TrustKnown     TrustLevel = "known"
+	TrustTrusted   TrustLevel = "trusted"
+)
+
+var trustLevels = []TrustLevel{TrustBlocked, TrustUntrusted, TrustKnown, TrustTrusted}
+
+var errPeerBlocked = errors.New("peer is blocked")
+
+var (
+	peerTrust   = make(map[PeerID]TrustLevel)
+	peerTrustMu sync.RWMutex
+)
+
+func validTrustLevel(level TrustLevel) bool {
+	for _, l := range trustLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+func trustOf(id PeerID) TrustLevel {
+	if id == peerID {
+		return TrustTrusted
+	}
+	peerTrustMu.RLock()
+	defer peerTrustMu.RUnlock()
+	if level, ok := peerTrust[id]; ok {
+		return level
+	}
+	return TrustLevel(config.DefaultTrust)
+}
+
+// setTrust changes the trust level of a peer. Blocking a peer drops what we
+// hold from it, trusting it approves what it has in quarantine.
+func setTrust(ctx context.Context, id PeerID, level TrustLevel) {
+	peerTrustMu.Lock()
+	peerTrust[id] = level
+	peerTrustMu.Unlock()
+	persister.MarkDirty(peerTrustPath)
+	log.Printf("Set trust of peer %s to %s", id, level)
+
+	switch level {
+	case TrustBlocked:
+		forgetPeer(id)
+	case TrustKnown, TrustTrusted:
+		for _, item := range quarantinedFrom(id) {
+			if err := approveQuarantined(ctx, item.ID); err != nil {
+				log.Printf("Failed to approve %s %s of peer %s: %v", item.Kind, item.ItemID, id, err)
+			}
+		}
+	}
+}
+
+type QuarantineKind string
+
+const (
+	QuarantineConcept      QuarantineKind = "concept"
+	QuarantineRelationship QuarantineKind = "relationship"
+	QuarantineTombstone    QuarantineKind = "tombstone"
+)
+
+// QuarantinedItem is data an untrusted peer sent, held until approved.
+// Relationships are fetched again from their CID on approval, as their
+// replicated state is not kept here.
+type QuarantinedItem struct {
+	ID           string         `json:"id"`
+	Kind         QuarantineKind `json:"kind"`
+	Peer         PeerID         `json:"peer"`
+	ItemID       GUID           `json:"itemId"`
+	CID          CID            `json:"cid,omitempty"`
+	ReceivedAt   time.Time      `json:"receivedAt"`
+	Concept      *Concept       `json:"concept,omitempty"`
+	Relationship *Relationship  `json:"relationship,omitempty"`
+	Tombstone    *Tombstone     `json:"tombstone,omitempty"`
+}
+
+// quarantineKey finds the item of a peer by what it holds: the GUID of the
+// concept, relationship or tombstone, or the CID of the version
+type quarantineKey struct {
+	kind QuarantineKind
+	peer PeerID
+	item GUID
+	cid  CID
+}
+
+var (
+	quarantine      = make(map[string]*QuarantinedItem)
+	quarantineIndex = make(map[quarantineKey]*QuarantinedItem)
+	// quarantineCounts holds the number of items of every peer, which
+	// config.QuarantineLimit bounds
+	quarantineCounts = make(map[PeerID]int)
+	quarantineMu     sync.RWMutex
+)
+
+// indexQuarantined adds an item to the index. quarantineMu must be held.
+func indexQuarantined(item *QuarantinedItem) {
+	quarantineIndex[quarantineKey{kind: item.Kind, peer: item.Peer, item: item.ItemID}] = item
+	if item.CID != "" {
+		quarantineIndex[quarantineKey{kind: item.Kind, peer: item.Peer, cid: item.CID}] = item
+	}
+	quarantineCounts[item.Peer]++
+}
+
+// removeQuarantined drops an item unless it was replaced meanwhile.
+// quarantineMu must be held.
+func removeQuarantined(item *QuarantinedItem) bool {
+	if quarantine[item.ID] != item {
+		return false
+	}
+	delete(quarantine, item.ID)
+	for _, key := range []quarantineKey{
+		{kind: item.Kind, peer: item.Peer, item: item.ItemID},
+		{kind: item.Kind, peer: item.Peer, cid: item.CID},
+	} {
+		if quarantineIndex[key] == item {
+			delete(quarantineIndex, key)
+		}
+	}
+	if quarantineCounts[item.Peer]--; quarantineCounts[item.Peer] <= 0 {
+		delete(quarantineCounts, item.Peer)
+	}
+	return true
+}
+
+// reindexQuarantine rebuilds the index of the quarantine once loaded
+func reindexQuarantine() {
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	quarantineIndex = make(map[quarantineKey]*QuarantinedItem, len(quarantine))
+	quarantineCounts = make(map[PeerID]int)
+	for _, item := range quarantine {
+		indexQuarantined(item)
+	}
+}
+
+// quarantineItem holds an item until approved, replacing what the same peer
+// sent earlier for the same concept or relationship. A peer with
+// config.QuarantineLimit items has anything new dropped.
+func quarantineItem(item QuarantinedItem) {
+	item.ReceivedAt = time.Now()
+	quarantineMu.Lock()
+	existing, replaces := quarantineIndex[quarantineKey{kind: item.Kind, peer: item.Peer, item: item.ItemID}]
+	if !replaces && quarantineCounts[item.Peer] >= config.QuarantineLimit {
+		quarantineMu.Unlock()
+		log.Printf("Quarantine of peer %s is full, dropping %s %s", item.Peer, item.Kind, item.ItemID)
+		return
+	}
+	if replaces {
+		item.ID = existing.ID
+		removeQuarantined(existing)
+	} else {
+		item.ID = uuid.New().String()
+	}
+	quarantine[item.ID] = &item
+	indexQuarantined(&item)
+	quarantineMu.Unlock()
+	persister.MarkDirty(quarantinePath)
+	log.Printf("Quarantined %s %s from untrusted peer %s", item.Kind, item.ItemID, item.Peer)
+}
+
+// quarantinedCID returns the CID of the item a peer has in quarantine
+func quarantinedCID(kind QuarantineKind, peer PeerID, id GUID) CID {
+	quarantineMu.RLock()
+	defer quarantineMu.RUnlock()
+	if q, ok := quarantineIndex[quarantineKey{kind: kind, peer: peer, item: id}]; ok {
+		return q.CID
+	}
+	return ""
+}
+
+// quarantinedConceptCID reports whether a peer has a concept version in
+// quarantine
+func quarantinedConceptCID(peer PeerID, cid CID) bool {
+	quarantineMu.RLock()
+	defer quarantineMu.RUnlock()
+	_, ok := quarantineIndex[quarantineKey{kind: QuarantineConcept, peer: peer, cid: cid}]
+	return ok
+}
+
+func quarantinedFrom(peer PeerID) []QuarantinedItem {
+	quarantineMu.RLock()
+	defer quarantineMu.RUnlock()
+	var items []QuarantinedItem
+	for _, q := range quarantine {
+		if q.Peer == peer {
+			items = append(items, *q)
+		}
+	}
+	return items
+}
+
+func takeQuarantined(id string) (*QuarantinedItem, bool) {
+	quarantineMu.Lock()
+	item, ok := quarantine[id]
+	if ok {
+		removeQuarantined(item)
+	}
+	quarantineMu.Unlock()
+	if ok {
+		persister.MarkDirty(quarantinePath)
+	}
+	return item, ok
+}
+
+// discardQuarantined drops everything a peer has in quarantine
+func discardQuarantined(peer PeerID) {
+	quarantineMu.Lock()
+	discarded := 0
+	for _, q := range quarantine {
+		if q.Peer == peer {
+			removeQuarantined(q)
+			discarded++
+		}
+	}
+	quarantineMu.Unlock()
+	if discarded > 0 {
+		persister.MarkDirty(quarantinePath)
+	}
+}
+
+var (
+	errNotQuarantined   = errors.New("item not in quarantine")
+	errStaleQuarantined = errors.New("item is no longer announced")
+)
+
+// approveQuarantined takes in a quarantined item as if its peer were known.
+// The item stays in quarantine if that fails, or if its peer has been
+// blocked since. A concept the peer deleted or no longer announces is
+// dropped instead of being kept.
+func approveQuarantined(ctx context.Context, id string) error {
+	quarantineMu.RLock()
+	item, ok := quarantine[id]
+	quarantineMu.RUnlock()
+	if !ok {
+		return errNotQuarantined
+	}
+	if trustOf(item.Peer) == TrustBlocked {
+		return fmt.Errorf("%w: %s", errPeerBlocked, item.Peer)
+	}
+	switch item.Kind {
+	case QuarantineConcept:
+		if item.Concept == nil {
+			return fmt.Errorf("quarantined concept %s has no content", item.ItemID)
+		}
+		if conceptDeleted(item.Peer, item.Concept.GUID, "") ||
+			!replicator.stillAnnounced(replicationJob{peer: item.Peer, cid: item.CID}) {
+			takeQuarantined(id)
+			return fmt.Errorf("%w: concept %s", errStaleQuarantined, item.ItemID)
+		}
+		concept := *item.Concept
+		concept.CID = item.CID
+		keepRemoteConcept(item.Peer, &concept)
+	case QuarantineRelationship:
+		if !relationshipDeleted(item.ItemID) {
+			if err := mergeAnnouncedRelationship(ctx, item.Peer, item.ItemID, item.CID); err != nil {
+				return err
+			}
+		}
+	case QuarantineTombstone:
+		if item.Tombstone == nil {
+			return fmt.Errorf("quarantined tombstone of %s is empty", item.ItemID)
+		}
+		acceptRelationshipTombstone(ctx, *item.Tombstone)
+	}
+
+	quarantineMu.Lock()
+	removed := removeQuarantined(item)
+	quarantineMu.Unlock()
+	if removed {
+		persister.MarkDirty(quarantinePath)
+	}
+	log.Printf("Approved %s %s of peer %s", item.Kind, item.ItemID, item.Peer)
+	return nil
+}
+
+// PeerTrust is the trust level of a peer
+type PeerTrust struct {
+	Peer  PeerID     `json:"peer"`
+	Level TrustLevel `json:"level"`
+	// Explicit is set when the level was set rather than the default
+	Explicit bool `json:"explicit"`
+}
+
+func getTrust(c *gin.Context) {
+	peerTrustMu.RLock()
+	list := make([]PeerTrust, 0, len(peerTrust))
+	for id, level := range peerTrust {
+		list = append(list, PeerTrust{Peer: id, Level: level, Explicit: true})
+	}
+	peerTrustMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Peer < list[j].Peer })
+	c.JSON(http.StatusOK, gin.H{"default": config.DefaultTrust, "peers": list})
+}
+
+func updatePeerTrust(c *gin.Context) {
+	id := PeerID(c.Param("id"))
+	var req struct {
+		Level TrustLevel `json:"level"`
+	}
+	if err := c.BindJSON(&req); err != nil || !validTrustLevel(req.Level) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Level must be one of blocked, untrusted, known or trusted"})
+		return
+	}
+	if id == peerID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot set the trust of this node"})
+		return
+	}
+
+	setTrust(c.Request.Context(), id, req.Level)
+	c.JSON(http.StatusOK, PeerTrust{Peer: id, Level: req.Level, Explicit: true})
+}
+
+func getQuarantine(c *gin.Context) {
+	quarantineMu.RLock()
+	list := make([]QuarantinedItem, 0, len(quarantine))
+	for _, q := range quarantine {
+		list = append(list, *q)
+	}
+	quarantineMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ReceivedAt.Before(list[j].ReceivedAt) })
+	c.JSON(http.StatusOK, list)
+}
+
+func approveQuarantinedItem(c *gin.Context) {
+	err := approveQuarantined(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, errNotQuarantined) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	if errors.Is(err, errPeerBlocked) || errors.Is(err, errStaleQuarantined) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func rejectQuarantinedItem(c *gin.Context) {
+	item, ok := takeQuarantined(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	log.Printf("Rejected %s %s of peer %s", item.Kind, item.ItemID, item.Peer)
+	c.Status(http.StatusNoContent)
+}
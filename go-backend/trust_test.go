@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// quarantinedID returns the ID of the item a peer has in quarantine for id
+func quarantinedID(peer PeerID, kind QuarantineKind, id GUID) string {
+	quarantineMu.RLock()
+	defer quarantineMu.RUnlock()
+	if q, ok := quarantineIndex[quarantineKey{kind: kind, peer: peer, item: id}]; ok {
+		return q.ID
+	}
+	return ""
+}
+
+func TestQuarantineIndex(t *testing.T) {
+	resetState(t)
+	quarantineItem(QuarantinedItem{Kind: QuarantineConcept, Peer: "p", ItemID: "c", CID: "v1", Concept: &Concept{GUID: "c"}})
+	first := quarantinedID("p", QuarantineConcept, "c")
+	quarantineItem(QuarantinedItem{Kind: QuarantineConcept, Peer: "p", ItemID: "c", CID: "v2", Concept: &Concept{GUID: "c"}})
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{name: "newer version replaces the item", got: quarantinedID("p", QuarantineConcept, "c"), want: first},
+		{name: "one item is kept", got: len(quarantine), want: 1},
+		{name: "CID of the item", got: quarantinedCID(QuarantineConcept, "p", "c"), want: CID("v2")},
+		{name: "replaced version", got: quarantinedConceptCID("p", "v1"), want: false},
+		{name: "current version", got: quarantinedConceptCID("p", "v2"), want: true},
+		{name: "version of another peer", got: quarantinedConceptCID("q", "v2"), want: false},
+		{name: "item of another kind", got: quarantinedCID(QuarantineRelationship, "p", "c"), want: CID("")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuarantineLimit(t *testing.T) {
+	resetState(t)
+	config.QuarantineLimit = 2
+
+	for _, item := range []QuarantinedItem{
+		{Kind: QuarantineRelationship, Peer: "p", ItemID: "a", CID: "a1"},
+		{Kind: QuarantineRelationship, Peer: "p", ItemID: "b", CID: "b1"},
+		// Over the limit of p
+		{Kind: QuarantineRelationship, Peer: "p", ItemID: "c", CID: "c1"},
+		// Replaces an item of p, so it is taken
+		{Kind: QuarantineRelationship, Peer: "p", ItemID: "a", CID: "a2"},
+		// Other peers have limits of their own
+		{Kind: QuarantineRelationship, Peer: "q", ItemID: "c", CID: "c1"},
+	} {
+		quarantineItem(item)
+	}
+
+	tests := []struct {
+		peer PeerID
+		id   GUID
+		want CID
+	}{
+		{peer: "p", id: "a", want: "a2"},
+		{peer: "p", id: "b", want: "b1"},
+		{peer: "p", id: "c", want: ""},
+		{peer: "q", id: "c", want: "c1"},
+	}
+	for _, tt := range tests {
+		if got := quarantinedCID(QuarantineRelationship, tt.peer, tt.id); got != tt.want {
+			t.Errorf("%s of peer %s: got %q, want %q", tt.id, tt.peer, got, tt.want)
+		}
+	}
+	if n := quarantineCounts["p"]; n != 2 {
+		t.Errorf("peer p has %d items, want 2", n)
+	}
+}
+
+func TestApproveQuarantined(t *testing.T) {
+	concept := QuarantinedItem{Kind: QuarantineConcept, Peer: "p", ItemID: "c", CID: "v1", Concept: &Concept{GUID: "c", Name: "c"}}
+	tests := []struct {
+		name string
+		item QuarantinedItem
+		// announced is whether the peer still announces the item, trust what
+		// the peer is trusted with since it was quarantined and deleted
+		// whether it deleted the item since
+		announced bool
+		trust     TrustLevel
+		deleted   bool
+		wantErr   bool
+		// wantErrIs is the error expected, if a particular one
+		wantErrIs error
+		// wantKept is whether the concept was taken in
+		wantKept    bool
+		wantRemains bool
+	}{
+		{name: "approved concept leaves quarantine", item: concept, announced: true, wantKept: true},
+		{name: "relationship that cannot be fetched stays",
+			item:    QuarantinedItem{Kind: QuarantineRelationship, Peer: "p", ItemID: "r", CID: "bafyreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"},
+			wantErr: true, wantRemains: true},
+		{name: "concept without content stays",
+			item:      QuarantinedItem{Kind: QuarantineConcept, Peer: "p", ItemID: "c", CID: "v1"},
+			announced: true, wantErr: true, wantRemains: true},
+		{name: "concept of a peer blocked since stays", item: concept, announced: true, trust: TrustBlocked,
+			wantErr: true, wantErrIs: errPeerBlocked, wantRemains: true},
+		{name: "concept deleted since is dropped", item: concept, announced: true, deleted: true, wantErr: true, wantErrIs: errStaleQuarantined},
+		{name: "concept no longer announced is dropped", item: concept, wantErr: true, wantErrIs: errStaleQuarantined},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState(t)
+			quarantineItem(tt.item)
+			id := quarantinedID(tt.item.Peer, tt.item.Kind, tt.item.ItemID)
+			if tt.announced {
+				replicator.Announce(tt.item.Peer, []CID{tt.item.CID})
+			}
+			if tt.trust != "" {
+				peerTrust[tt.item.Peer] = tt.trust
+			}
+			if tt.deleted {
+				addTombstone(Tombstone{Kind: TombstoneConcept, ID: tt.item.ItemID, PeerID: tt.item.Peer, DeletedAt: time.Now().UTC()})
+			}
+
+			err := approveQuarantined(context.Background(), id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErrIs)
+			}
+			if _, remains := quarantine[id]; remains != tt.wantRemains {
+				t.Errorf("item in quarantine: %v, want %v", remains, tt.wantRemains)
+			}
+			if _, kept := remoteConcepts[tt.item.Peer][tt.item.ItemID]; kept != tt.wantKept {
+				t.Errorf("concept kept: %v, want %v", kept, tt.wantKept)
+			}
+			if !tt.wantRemains {
+				if err := approveQuarantined(context.Background(), id); !errors.Is(err, errNotQuarantined) {
+					t.Errorf("approving again: got %v, want %v", err, errNotQuarantined)
+				}
+			}
+		})
+	}
+}
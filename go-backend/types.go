@@ -5,16 +5,11 @@ import (
 	"time"
 )
 
-type PeerMessage struct {
-	PeerID        PeerID          `json:"peerId"`
-	OwnerGUID     GUID            `json:"ownerGuid"`
-	CIDs          []CID           `json:"cids"`
-	Relationships RelationshipMap `json:"relationships"`
-}
-
 type PeerMap map[PeerID]Peer_i
 
 type ConceptFilter struct {
+	// Peer selects the concepts replicated from a peer instead of our own
+	Peer           PeerID
 	CID            string
 	GUID           GUID
 	Name           string
@@ -29,6 +24,7 @@ var (
 	conceptMu  sync.RWMutex
 
 	relationshipMap RelationshipMap
+	relationshipMu  sync.RWMutex
 
 	peerMap   PeerMap
 	peerMapMu sync.RWMutex
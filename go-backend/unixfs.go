@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	gocid "github.com/ipfs/go-cid"
+)
+
+// These mirror the defaults `ipfs add --cid-version=1` uses: 256KiB chunks,
+// raw leaves and a balanced DAG of at most 174 links per node.
+const (
+	unixfsChunkSize = 256 << 10
+	unixfsMaxLinks  = 174
+
+	unixfsTypeFile = 2
+)
+
+// Block is a single content-addressed block of a DAG
+type Block struct {
+	CID  gocid.Cid
+	Data []byte
+}
+
+type unixfsNode struct {
+	cid      gocid.Cid
+	tsize    uint64
+	fileSize uint64
+}
+
+type unixfsBuilder struct {
+	data   []byte
+	offset int
+	blocks []Block
+}
+
+// buildUnixFSFile splits data into the same DAG `ipfs add --cid-version=1`
+// would build and returns its root CID together with every block
+func buildUnixFSFile(data []byte) (gocid.Cid, []Block, error) {
+	b := &unixfsBuilder{data: data}
+
+	root, err := b.leaf()
+	if err != nil {
+		return gocid.Undef, nil, err
+	}
+	for depth := 1; !b.done(); depth++ {
+		root, err = b.fill([]unixfsNode{root}, depth)
+		if err != nil {
+			return gocid.Undef, nil, err
+		}
+	}
+	return root.cid, b.blocks, nil
+}
+
+func (b *unixfsBuilder) done() bool {
+	return b.offset >= len(b.data)
+}
+
+func (b *unixfsBuilder) leaf() (unixfsNode, error) {
+	end := b.offset + unixfsChunkSize
+	if end > len(b.data) {
+		end = len(b.data)
+	}
+	chunk := b.data[b.offset:end]
+	b.offset = end
+
+	c, err := newCID(gocid.Raw, chunk)
+	if err != nil {
+		return unixfsNode{}, err
+	}
+	b.blocks = append(b.blocks, Block{CID: c, Data: chunk})
+	return unixfsNode{cid: c, tsize: uint64(len(chunk)), fileSize: uint64(len(chunk))}, nil
+}
+
+func (b *unixfsBuilder) fill(children []unixfsNode, depth int) (unixfsNode, error) {
+	for len(children) < unixfsMaxLinks && !b.done() {
+		var child unixfsNode
+		var err error
+		if depth == 1 {
+			child, err = b.leaf()
+		} else {
+			child, err = b.fill(nil, depth-1)
+		}
+		if err != nil {
+			return unixfsNode{}, err
+		}
+		children = append(children, child)
+	}
+	return b.parent(children)
+}
+
+func (b *unixfsBuilder) parent(children []unixfsNode) (unixfsNode, error) {
+	var fileSize uint64
+	for _, child := range children {
+		fileSize += child.fileSize
+	}
+
+	// UnixFS Data message: Type, Filesize, Blocksizes
+	fsData := []byte{0x08, unixfsTypeFile, 0x18}
+	fsData = binary.AppendUvarint(fsData, fileSize)
+	for _, child := range children {
+		fsData = append(fsData, 0x20)
+		fsData = binary.AppendUvarint(fsData, child.fileSize)
+	}
+
+	// dag-pb PBNode: Links come before Data in canonical form
+	var encoded []byte
+	tsize := uint64(0)
+	for _, child := range children {
+		hash := child.cid.Bytes()
+		link := []byte{0x0a}
+		link = binary.AppendUvarint(link, uint64(len(hash)))
+		link = append(link, hash...)
+		link = append(link, 0x12, 0x00, 0x18)
+		link = binary.AppendUvarint(link, child.tsize)
+
+		encoded = append(encoded, 0x12)
+		encoded = binary.AppendUvarint(encoded, uint64(len(link)))
+		encoded = append(encoded, link...)
+		tsize += child.tsize
+	}
+	encoded = append(encoded, 0x0a)
+	encoded = binary.AppendUvarint(encoded, uint64(len(fsData)))
+	encoded = append(encoded, fsData...)
+
+	c, err := newCID(gocid.DagProtobuf, encoded)
+	if err != nil {
+		return unixfsNode{}, err
+	}
+	b.blocks = append(b.blocks, Block{CID: c, Data: encoded})
+	return unixfsNode{cid: c, tsize: tsize + uint64(len(encoded)), fileSize: fileSize}, nil
+}
+
+// walkUnixFSFile visits the blocks of a UnixFS file in file order, fetching
+// each one with get. fileData is the part of the file a block carries.
+func walkUnixFSFile(ctx context.Context, root gocid.Cid, get func(gocid.Cid) ([]byte, error), visit func(c gocid.Cid, data, fileData []byte) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := get(root)
+	if err != nil {
+		return err
+	}
+
+	switch root.Type() {
+	case gocid.Raw:
+		return visit(root, data, data)
+	case gocid.DagProtobuf:
+		links, fileData, err := decodeDagPB(data)
+		if err != nil {
+			return fmt.Errorf("failed to decode block %s: %v", root, err)
+		}
+		if err := visit(root, data, fileData); err != nil {
+			return err
+		}
+		for _, link := range links {
+			if err := walkUnixFSFile(ctx, link, get, visit); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported codec for %s", root)
+	}
+}
+
+// readUnixFSFile writes the content of a UnixFS file to w
+func readUnixFSFile(ctx context.Context, root gocid.Cid, get func(gocid.Cid) ([]byte, error), w io.Writer) error {
+	return walkUnixFSFile(ctx, root, get, func(_ gocid.Cid, _, fileData []byte) error {
+		_, err := w.Write(fileData)
+		return err
+	})
+}
+
+// decodeDagPB returns the links and the UnixFS file data of a dag-pb block
+func decodeDagPB(data []byte) ([]gocid.Cid, []byte, error) {
+	var links []gocid.Cid
+	var fileData []byte
+	err := walkProtobuf(data, func(field int, value []byte) error {
+		switch field {
+		case 1:
+			return walkProtobuf(value, func(field int, value []byte) error {
+				if field == 2 {
+					fileData = value
+				}
+				return nil
+			})
+		case 2:
+			return walkProtobuf(value, func(field int, value []byte) error {
+				if field != 1 {
+					return nil
+				}
+				c, err := gocid.Cast(value)
+				if err != nil {
+					return fmt.Errorf("invalid link: %v", err)
+				}
+				links = append(links, c)
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return links, fileData, nil
+}
+
+// walkProtobuf calls fn for every length-delimited field of a protobuf
+// message, skipping varint fields
+func walkProtobuf(data []byte, fn func(field int, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("malformed protobuf key")
+		}
+		data = data[n:]
+
+		switch key & 0x7 {
+		case 0:
+			_, n = binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("malformed protobuf varint")
+			}
+			data = data[n:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return fmt.Errorf("malformed protobuf field")
+			}
+			value := data[n : n+int(length)]
+			data = data[n+int(length):]
+			if err := fn(int(key>>3), value); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&0x7)
+		}
+	}
+	return nil
+}
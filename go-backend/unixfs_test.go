@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	gocid "github.com/ipfs/go-cid"
+)
+
+// multiChunkFile is 600KiB, three chunks under one dag-pb node
+func multiChunkFile() []byte {
+	data := make([]byte, 600<<10)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestBuildUnixFSFile(t *testing.T) {
+	// The CIDs are those of `ipfs add --cid-version=1`
+	tests := []struct {
+		name       string
+		data       []byte
+		want       string
+		wantBlocks int
+	}{
+		{name: "single chunk", data: []byte("hello world\n"), want: "bafkreifjjcie6lypi6ny7amxnfftagclbuxndqonfipmb64f2km2devei4", wantBlocks: 1},
+		{name: "several chunks", data: multiChunkFile(), want: "bafybeib7rtiuapefdrbklxz5ysik3bixpon5h6cdrim7jhclqfyaz2t5cu", wantBlocks: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, blocks, err := buildUnixFSFile(tt.data)
+			if err != nil {
+				t.Fatalf("buildUnixFSFile: %v", err)
+			}
+			if root.String() != tt.want {
+				t.Errorf("got root %s, want %s", root, tt.want)
+			}
+			if len(blocks) != tt.wantBlocks {
+				t.Errorf("got %d blocks, want %d", len(blocks), tt.wantBlocks)
+			}
+
+			stored := make(map[gocid.Cid][]byte, len(blocks))
+			for _, b := range blocks {
+				stored[b.CID] = b.Data
+			}
+			get := func(c gocid.Cid) ([]byte, error) {
+				if data, ok := stored[c]; ok {
+					return data, nil
+				}
+				return nil, fmt.Errorf("block %s not found", c)
+			}
+			var buf bytes.Buffer
+			if err := readUnixFSFile(context.Background(), root, get, &buf); err != nil {
+				t.Fatalf("readUnixFSFile: %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), tt.data) {
+				t.Errorf("read back %d bytes that differ from the %d added", buf.Len(), len(tt.data))
+			}
+		})
+	}
+}
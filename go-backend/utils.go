@@ -32,19 +32,26 @@ func matchesConcept(concept Concept, filter ConceptFilter) bool {
 }
 
 func filterConcepts(filter ConceptFilter) []Concept {
-	conceptMu.RLock()
-	defer conceptMu.RUnlock()
+	source, mu := conceptMap, &conceptMu
+	if filter.Peer != "" && filter.Peer != peerID {
+		mu = &remoteConceptsMu
+		mu.RLock()
+		source = remoteConcepts[filter.Peer]
+		mu.RUnlock()
+	}
+	mu.RLock()
+	defer mu.RUnlock()
 
 	if isEmptyFilter(filter) {
-		concepts := make([]Concept, 0, len(conceptMap))
-		for _, concept := range conceptMap {
+		concepts := make([]Concept, 0, len(source))
+		for _, concept := range source {
 			concepts = append(concepts, *concept)
 		}
 		return concepts
 	}
 
 	var filteredConcepts []Concept
-	for _, concept := range conceptMap {
+	for _, concept := range source {
 		if matchesConcept(*concept, filter) {
 			filteredConcepts = append(filteredConcepts, *concept)
 		}
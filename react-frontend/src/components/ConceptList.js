@@ -2,6 +2,7 @@
 import React, { useState, useEffect } from 'react';
 import { ListGroup } from 'react-bootstrap';
 
+const API_URL = 'http://localhost:9090';
 const WS_URL = 'ws://localhost:9090/ws';
 
 function ConceptList() {
@@ -31,7 +32,14 @@ function ConceptList() {
             <p><strong>Type:</strong> {concept.Type}</p>
             <p><strong>Description:</strong> {concept.Description}</p>
             <p><strong>CID:</strong> {concept.Cid}</p>
-            <p><strong>Content:</strong> {concept.Content}</p>
+            {concept.Content && (
+              <p>
+                <strong>Content:</strong>{' '}
+                <a href={`${API_URL}/concept/${guid}/content`} target="_blank" rel="noreferrer">
+                  {concept.Content.MediaType}, {concept.Content.Size} bytes
+                </a>
+              </p>
+            )}
             <p><strong>Timestamp:</strong> {new Date(concept.Timestamp).toLocaleString()}</p>
           </ListGroup.Item>
         ))}